@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminToken is the bearer token of the admin endpoint, set by initAdmin. The
+// admin endpoint is disabled while it is empty.
+var adminToken string
+
+// initAdmin reads the admin token from ADMIN_TOKEN_FILE or ADMIN_TOKEN.
+func initAdmin() error {
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if path := os.Getenv("ADMIN_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read ADMIN_TOKEN_FILE: %w", err)
+		}
+		adminToken = strings.TrimSpace(string(data))
+	}
+	if adminToken != "" && len(adminToken) < 32 {
+		return fmt.Errorf("ADMIN_TOKEN must be at least 32 characters")
+	}
+	return nil
+}
+
+// newAdminServer returns the admin listener on ADMIN_ADDR (default
+// 127.0.0.1:8202), or nil when no admin token is configured. Every request
+// must carry the admin token as a bearer token.
+func newAdminServer() *http.Server {
+	if adminToken == "" {
+		return nil
+	}
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8202"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/revocations", handleAdminRevocations)
+	mux.HandleFunc("/admin/quotas", handleAdminQuotas)
+	mux.HandleFunc("/admin/share-read-holds", handleAdminShareReadHolds)
+	return &http.Server{Addr: addr, Handler: adminAuthMiddleware(mux)}
+}
+
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(r) {
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasAdminToken reports whether r carries the admin token as a bearer token.
+// It is false for every request while no admin token is configured.
+func hasAdminToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get(headerAuth), headerAuthPrefix)
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
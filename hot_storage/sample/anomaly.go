@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	anomalyActionOff    = "off"
+	anomalyActionLog    = "log"
+	anomalyActionStepUp = "step_up"
+	anomalyActionLock   = "lock"
+
+	anomalyNewNetwork    = "new_network"
+	anomalyNewUserAgent  = "new_user_agent"
+	anomalyAccountBurst  = "account_burst"
+	anomalyIPBurst       = "ip_burst"
+	anomalyDeviceBurst   = "device_burst"
+	shareReadClientNet   = "network"
+	shareReadClientAgent = "user_agent"
+
+	errShareReadsLocked = "share_reads_locked"
+	errStepUpRequired   = "step_up_required"
+)
+
+// shareAnomalyConfig decides what happens when a share read looks unusual.
+// Each signal has an action: "off", "log", "step_up" to require a token
+// authenticated after the anomaly, or "lock" to refuse share reads for
+// LockDuration.
+type shareAnomalyConfig struct {
+	Actions map[string]string
+
+	// StepUpACR and StepUpAMR are the acr and amr values of a token issued
+	// after the anomaly that pass a step-up without an auth_time claim.
+	StepUpACR []string
+	StepUpAMR []string
+
+	Window         time.Duration
+	MaxAccounts    int
+	MaxIPUsers     int
+	MaxDeviceReads int
+	FreshTokenAge  time.Duration
+	LockDuration   time.Duration
+}
+
+var (
+	shareAnomaly = shareAnomalyConfig{
+		Actions: map[string]string{
+			anomalyNewNetwork:   anomalyActionLog,
+			anomalyNewUserAgent: anomalyActionLog,
+			anomalyAccountBurst: anomalyActionLock,
+			anomalyIPBurst:      anomalyActionLog,
+			anomalyDeviceBurst:  anomalyActionStepUp,
+		},
+		Window:         10 * time.Minute,
+		MaxAccounts:    5,
+		MaxIPUsers:     20,
+		MaxDeviceReads: 20,
+		FreshTokenAge:  5 * time.Minute,
+		LockDuration:   15 * time.Minute,
+	}
+
+	shareReads = &shareReadWindows{maxKeys: 100000, events: make(map[string][]shareReadEvent)}
+)
+
+// initShareAnomaly reads the share-read anomaly settings:
+//
+//	SHARE_ANOMALY_<SIGNAL>          action of a signal: off, log, step_up or lock. SIGNAL is
+//	                                NEW_NETWORK, NEW_USER_AGENT, ACCOUNT_BURST, IP_BURST or DEVICE_BURST
+//	SHARE_ANOMALY_WINDOW            window of the burst signals, default 10m
+//	SHARE_ANOMALY_MAX_ACCOUNTS      accounts a user may read within the window, default 5
+//	SHARE_ANOMALY_MAX_IP_USERS      users that may read from one IP within the window, default 20
+//	SHARE_ANOMALY_MAX_DEVICE_READS  reads of one device within the window, default 20
+//	SHARE_ANOMALY_FRESH_TOKEN_AGE   how recent a token counts as just issued, default 5m
+//	SHARE_ANOMALY_LOCK_DURATION     how long a lock lasts, default 15m
+//	SHARE_ANOMALY_CACHE_SIZE        maximum keys tracked for the burst signals, default 100000
+//	SHARE_ANOMALY_STEP_UP_ACR       comma-separated acr values that pass a step-up
+//	SHARE_ANOMALY_STEP_UP_AMR       comma-separated amr values that pass a step-up
+func initShareAnomaly() error {
+	for signal := range shareAnomaly.Actions {
+		env := "SHARE_ANOMALY_" + strings.ToUpper(signal)
+		action := os.Getenv(env)
+		if action == "" {
+			continue
+		}
+		switch action {
+		case anomalyActionOff, anomalyActionLog, anomalyActionStepUp, anomalyActionLock:
+			shareAnomaly.Actions[signal] = action
+		default:
+			return fmt.Errorf("%s must be %q, %q, %q or %q", env, anomalyActionOff, anomalyActionLog, anomalyActionStepUp, anomalyActionLock)
+		}
+	}
+	// A step-up by one user proves nothing about an IP other users share, so
+	// the IP signal can only log or lock.
+	if shareAnomaly.Actions[anomalyIPBurst] == anomalyActionStepUp {
+		return fmt.Errorf("SHARE_ANOMALY_IP_BURST must be %q, %q or %q", anomalyActionOff, anomalyActionLog, anomalyActionLock)
+	}
+	shareAnomaly.StepUpACR = envList("SHARE_ANOMALY_STEP_UP_ACR")
+	shareAnomaly.StepUpAMR = envList("SHARE_ANOMALY_STEP_UP_AMR")
+
+	for _, setting := range []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"SHARE_ANOMALY_WINDOW", &shareAnomaly.Window},
+		{"SHARE_ANOMALY_FRESH_TOKEN_AGE", &shareAnomaly.FreshTokenAge},
+		{"SHARE_ANOMALY_LOCK_DURATION", &shareAnomaly.LockDuration},
+	} {
+		d, err := envDuration(setting.env, *setting.d)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", setting.env)
+		}
+		*setting.d = d
+	}
+	for _, setting := range []struct {
+		env string
+		n   *int
+	}{
+		{"SHARE_ANOMALY_MAX_ACCOUNTS", &shareAnomaly.MaxAccounts},
+		{"SHARE_ANOMALY_MAX_IP_USERS", &shareAnomaly.MaxIPUsers},
+		{"SHARE_ANOMALY_MAX_DEVICE_READS", &shareAnomaly.MaxDeviceReads},
+		{"SHARE_ANOMALY_CACHE_SIZE", &shareReads.maxKeys},
+	} {
+		n, err := envInt(setting.env, *setting.n)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("%s must be positive", setting.env)
+		}
+		*setting.n = n
+	}
+	return nil
+}
+
+// shareReadRefusal is returned by checkShareRead while share reads are
+// locked. A read that owes a step-up gets a *stepUpRefusal instead.
+type shareReadRefusal struct {
+	// RetryAfter is when the lock ends.
+	RetryAfter time.Duration
+}
+
+func (e *shareReadRefusal) Error() string {
+	return errShareReadsLocked
+}
+
+// checkShareRead is called before a share of account's device is decrypted.
+// It refuses the read when the token does not meet the step-up policy of
+// endpoint, or while the user or IP is locked or owes a step-up. Otherwise it
+// records the read and raises the configured action for any unusual pattern. The
+// burst signals are counted per replica; locks and step-ups are stored in the
+// database and apply to every replica.
+func checkShareRead(r *http.Request, endpoint string, account Account, deviceId string) error {
+	ctx := r.Context()
+	claims, _ := ctx.Value(fieldClaims).(jwt.MapClaims)
+	now := time.Now()
+	if refusal := checkStepUp(claims, endpoint, now); refusal != nil {
+		return refusal
+	}
+
+	user := account.AuthProvider + ":" + account.Username
+	ip := clientIP(r)
+	userKey, ipKey := "user:"+user, "ip:"+ip
+
+	stepUpPassed, err := checkShareReadHolds(ctx, claims, now, userKey, ipKey)
+	if err != nil {
+		return err
+	}
+
+	accountsKey, usersKey, deviceKey := "accounts:"+user, "users:"+ip, "device:"+deviceId
+	if stepUpPassed {
+		// The reads before the step-up must not raise it again.
+		shareReads.reset(accountsKey, deviceKey)
+	}
+
+	var signals []string
+	if shareReads.add(accountsKey, account.ID, now, shareAnomaly.Window) > shareAnomaly.MaxAccounts {
+		signals = append(signals, anomalyAccountBurst)
+	}
+	if shareReads.add(usersKey, user, now, shareAnomaly.Window) > shareAnomaly.MaxIPUsers {
+		signals = append(signals, anomalyIPBurst)
+	}
+	if shareReads.count(deviceKey, now, shareAnomaly.Window) > shareAnomaly.MaxDeviceReads {
+		signals = append(signals, anomalyDeviceBurst)
+	}
+
+	network := hashShareReadClient(networkOf(ip))
+	agent := hashShareReadClient(r.UserAgent())
+	newNetwork, err := isNewShareReadClient(ctx, account, shareReadClientNet, network)
+	if err != nil {
+		return err
+	}
+	if newNetwork {
+		signals = append(signals, anomalyNewNetwork)
+	}
+	newAgent, err := isNewShareReadClient(ctx, account, shareReadClientAgent, agent)
+	if err != nil {
+		return err
+	}
+	if issuedAt, ok := authenticatedAt(claims); newAgent && ok && now.Sub(issuedAt) <= shareAnomaly.FreshTokenAge {
+		signals = append(signals, anomalyNewUserAgent)
+	}
+
+	var refusal error
+	for _, signal := range signals {
+		action := shareAnomaly.Actions[signal]
+		if action == anomalyActionOff {
+			continue
+		}
+		slog.Warn("share read anomaly", slog.String("signal", signal), slog.String("action", action),
+			slog.String("accountId", account.ID), slog.String("deviceId", deviceId))
+		if action == anomalyActionStepUp && stepUpPassed {
+			continue
+		}
+		key := userKey
+		if signal == anomalyIPBurst {
+			key = ipKey
+		}
+		switch action {
+		case anomalyActionLock:
+			if err := placeShareReadHold(ctx, key, anomalyActionLock, signal, now.Add(shareAnomaly.LockDuration)); err != nil {
+				return err
+			}
+			// The lock is the sanction for the reads so far; they must not
+			// lock again once it ends.
+			shareReads.reset(accountsKey, usersKey, deviceKey)
+			refusal = &shareReadRefusal{RetryAfter: shareAnomaly.LockDuration}
+		case anomalyActionStepUp:
+			if err := placeShareReadHold(ctx, key, anomalyActionStepUp, signal, time.Time{}); err != nil {
+				return err
+			}
+			if refusal == nil {
+				refusal = &stepUpRefusal{ACRValues: shareAnomaly.StepUpACR, AMRValues: shareAnomaly.StepUpAMR}
+			}
+		}
+	}
+	if refusal != nil {
+		return refusal
+	}
+
+	// Networks and user agents become known once a read from them succeeds.
+	for kind, value := range map[string]string{shareReadClientNet: network, shareReadClientAgent: agent} {
+		client := ShareReadClient{ID: uuid.NewString(), Username: account.Username, AuthProvider: account.AuthProvider, Kind: kind, Value: value, LastSeenAt: now}
+		if err := db.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "username"}, {Name: "auth_provider"}, {Name: "kind"}, {Name: "value"}},
+			DoUpdates: clause.Assignments(map[string]any{"last_seen_at": now, "updated_at": now}),
+		}).Create(&client).Error; err != nil {
+			slog.Warn(fmt.Sprintf("failed to record share read client: %v", err))
+		}
+	}
+	return nil
+}
+
+// checkShareReadHolds refuses the read while one of keys is locked or owes a
+// step-up. A step-up is passed by a token authenticated after it was
+// required, which lifts it; stepUpPassed then reports that the caller has
+// just proven themselves.
+func checkShareReadHolds(ctx context.Context, claims jwt.MapClaims, now time.Time, keys ...string) (bool, error) {
+	var holds []ShareReadHold
+	if err := db.WithContext(ctx).Where("key IN ?", keys).Find(&holds).Error; err != nil {
+		return false, databaseError(fmt.Errorf("failed to read share read holds: %w", err))
+	}
+	stepUpPassed := false
+	var refusal error
+	for _, hold := range holds {
+		switch hold.Kind {
+		case anomalyActionLock:
+			if hold.Until != nil && now.Before(*hold.Until) {
+				refusal = &shareReadRefusal{RetryAfter: hold.Until.Sub(now)}
+			}
+		case anomalyActionStepUp:
+			if passesShareReadStepUp(claims, hold.UpdatedAt) {
+				if err := db.WithContext(ctx).Unscoped().Delete(&hold).Error; err != nil {
+					slog.Warn(fmt.Sprintf("failed to lift step-up: %v", err))
+				}
+				stepUpPassed = true
+				continue
+			}
+			if refusal == nil {
+				refusal = &stepUpRefusal{MaxAge: now.Sub(hold.UpdatedAt), ACRValues: shareAnomaly.StepUpACR, AMRValues: shareAnomaly.StepUpAMR}
+			}
+		}
+	}
+	if refusal != nil {
+		return false, refusal
+	}
+	return stepUpPassed, nil
+}
+
+// passesShareReadStepUp reports whether the token shows the user signed in
+// again after a step-up was required of them: by an auth_time after it, or by
+// an acr or amr of SHARE_ANOMALY_STEP_UP_ACR or _AMR on a token issued after
+// it. iat alone proves nothing, since a silently refreshed token has a new one.
+func passesShareReadStepUp(claims jwt.MapClaims, requiredAt time.Time) bool {
+	if authTime, ok := timeClaim(claims, "auth_time"); ok {
+		return authTime.After(requiredAt)
+	}
+	if !hasACR(claims, shareAnomaly.StepUpACR) && !hasAMR(claims, shareAnomaly.StepUpAMR) {
+		return false
+	}
+	iat, ok := timeClaim(claims, "iat")
+	return ok && iat.After(requiredAt)
+}
+
+// placeShareReadHold locks key until until, or requires a step-up of it.
+// A later hold of the same kind replaces the earlier one.
+func placeShareReadHold(ctx context.Context, key, kind, signal string, until time.Time) error {
+	hold := ShareReadHold{ID: uuid.NewString(), Key: key, Kind: kind, Signal: signal}
+	if !until.IsZero() {
+		hold.Until = &until
+	}
+	if err := db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}, {Name: "kind"}},
+		DoUpdates: clause.Assignments(map[string]any{"signal": signal, "until": hold.Until, "updated_at": time.Now()}),
+	}).Create(&hold).Error; err != nil {
+		return databaseError(fmt.Errorf("failed to hold share reads: %w", err))
+	}
+	return nil
+}
+
+// isNewShareReadClient reports whether value was never seen on a successful
+// share read of the user, among at least one value of that kind that was.
+// The first read of a user is not new: there is nothing to compare it with.
+func isNewShareReadClient(ctx context.Context, account Account, kind, value string) (bool, error) {
+	var clients []ShareReadClient
+	err := db.WithContext(ctx).Select("value").
+		Where("username = ? AND auth_provider = ? AND kind = ?", account.Username, account.AuthProvider, kind).
+		Limit(1000).Find(&clients).Error
+	if err != nil {
+		return false, databaseError(fmt.Errorf("failed to read share read clients: %w", err))
+	}
+	if len(clients) == 0 {
+		return false, nil
+	}
+	for _, client := range clients {
+		if client.Value == value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// refuseShareRead answers a share read refused by checkShareRead. Any other
+// error was logged where it happened and is not passed on.
+func refuseShareRead(w http.ResponseWriter, err error) {
+	var stepUp *stepUpRefusal
+	if errors.As(err, &stepUp) {
+		refuseStepUp(w, stepUp)
+		return
+	}
+	var refusal *shareReadRefusal
+	if !errors.As(err, &refusal) {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	retryAfter := int(math.Ceil(refusal.RetryAfter.Seconds()))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusLocked)
+	json.NewEncoder(w).Encode(ShareReadErrorResponse{Error: errShareReadsLocked, RetryAfter: retryAfter})
+}
+
+// authenticatedAt returns when the user authenticated: the auth_time claim,
+// or iat when the token has none.
+func authenticatedAt(claims jwt.MapClaims) (time.Time, bool) {
+	if at, ok := timeClaim(claims, "auth_time"); ok {
+		return at, true
+	}
+	return timeClaim(claims, "iat")
+}
+
+// timeClaim returns the NumericDate claim name.
+func timeClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// networkOf returns the /24 of an IPv4 address or the /48 of an IPv6 one,
+// standing in for the client's network.
+func networkOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func hashShareReadClient(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// shareReadWindows keeps recent share reads per key, for the burst signals.
+type shareReadWindows struct {
+	mu      sync.Mutex
+	maxKeys int
+	events  map[string][]shareReadEvent
+}
+
+type shareReadEvent struct {
+	at    time.Time
+	value string
+}
+
+// add records value under key and returns the number of distinct values seen
+// under key within window.
+func (s *shareReadWindows) add(key, value string, now time.Time, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.recordLocked(key, value, now, window)
+	distinct := make(map[string]bool, len(events))
+	for _, event := range events {
+		distinct[event.value] = true
+	}
+	return len(distinct)
+}
+
+// count records a read under key and returns the reads within window.
+func (s *shareReadWindows) count(key string, now time.Time, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.recordLocked(key, "", now, window))
+}
+
+func (s *shareReadWindows) reset(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.events, key)
+	}
+}
+
+// recordLocked appends an event and drops those older than window. Callers
+// hold mu.
+func (s *shareReadWindows) recordLocked(key, value string, now time.Time, window time.Duration) []shareReadEvent {
+	events, ok := s.events[key]
+	if !ok && len(s.events) >= s.maxKeys {
+		for k, e := range s.events {
+			if now.Sub(e[len(e)-1].at) > window {
+				delete(s.events, k)
+			}
+		}
+		for k := range s.events {
+			if len(s.events) < s.maxKeys {
+				break
+			}
+			delete(s.events, k)
+		}
+	}
+	kept := events[:0]
+	for _, event := range events {
+		if now.Sub(event.at) <= window {
+			kept = append(kept, event)
+		}
+	}
+	kept = append(kept, shareReadEvent{at: now, value: value})
+	s.events[key] = kept
+	return kept
+}
+
+// handleAdminShareReadHolds lifts the locks and step-ups of a user (DELETE
+// with userId and authProvider query parameters) or of an IP (DELETE with ip).
+func handleAdminShareReadHolds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var key string
+	switch {
+	case query.Get(fieldUserId) != "" && query.Get(fieldAuthProvider) != "":
+		key = "user:" + query.Get(fieldAuthProvider) + ":" + query.Get(fieldUserId)
+	case query.Get("ip") != "":
+		key = "ip:" + query.Get("ip")
+	default:
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := db.Unscoped().Where("key = ?", key).Delete(&ShareReadHold{}).Error; err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("share read holds lifted")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// useShareAnomaly applies change to the anomaly settings and starts from
+// empty burst counters, restoring both when the test ends.
+func useShareAnomaly(t *testing.T, change func(*shareAnomalyConfig)) {
+	t.Helper()
+	prevConfig, prevReads := shareAnomaly, shareReads
+	t.Cleanup(func() { shareAnomaly, shareReads = prevConfig, prevReads })
+	shareAnomaly.Actions = maps.Clone(shareAnomaly.Actions)
+	for signal := range shareAnomaly.Actions {
+		shareAnomaly.Actions[signal] = anomalyActionOff
+	}
+	change(&shareAnomaly)
+	shareReads = &shareReadWindows{maxKeys: 100, events: make(map[string][]shareReadEvent)}
+}
+
+func shareReadRequest(claims jwt.MapClaims) *http.Request {
+	r := withIdentity(httptest.NewRequest(http.MethodPost, "/v2/devices/recover", nil), "alice", authProviderDefault, claims)
+	r.RemoteAddr = "192.0.2.1:1234"
+	return r
+}
+
+func testAccount(userId string) Account {
+	return Account{ID: uuid.NewString(), Username: userId, AuthProvider: authProviderDefault}
+}
+
+func TestShareReadLock(t *testing.T) {
+	newTestDB(t)
+	useShareAnomaly(t, func(c *shareAnomalyConfig) {
+		c.Actions[anomalyAccountBurst] = anomalyActionLock
+		c.MaxAccounts = 2
+	})
+	claims := freshClaims()
+
+	for i := range 2 {
+		if err := checkShareRead(shareReadRequest(claims), shareEndpointRecover, testAccount("alice"), "device"); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	err := checkShareRead(shareReadRequest(claims), shareEndpointRecover, testAccount("alice"), "device")
+	var refusal *shareReadRefusal
+	if !errors.As(err, &refusal) || refusal.RetryAfter != shareAnomaly.LockDuration {
+		t.Fatalf("third account: err = %v, want a lock", err)
+	}
+
+	// The lock is stored, so it holds for the next read, which is not a burst.
+	err = checkShareRead(shareReadRequest(claims), shareEndpointRecover, testAccount("alice"), "device")
+	if !errors.As(err, &refusal) {
+		t.Fatalf("read while locked: err = %v, want a lock", err)
+	}
+	w := httptest.NewRecorder()
+	refuseShareRead(w, err)
+	retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	if w.Code != http.StatusLocked || retryAfter <= 0 || retryAfter > int(shareAnomaly.LockDuration.Seconds()) {
+		t.Errorf("response: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if err := checkShareRead(shareReadRequest(claims), shareEndpointRecover, testAccount("bob"), "device"); err != nil {
+		t.Errorf("another user: %v", err)
+	}
+
+	// Once the lock has ended, the reads that caused it do not lock again.
+	if err := db.Model(&ShareReadHold{}).Where("kind = ?", anomalyActionLock).Update("until", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := checkShareRead(shareReadRequest(claims), shareEndpointRecover, testAccount("alice"), "device"); err != nil {
+		t.Errorf("read after the lock: %v", err)
+	}
+}
+
+func TestShareReadStepUpHold(t *testing.T) {
+	newTestDB(t)
+	useShareAnomaly(t, func(c *shareAnomalyConfig) {
+		c.Actions[anomalyDeviceBurst] = anomalyActionStepUp
+		c.MaxDeviceReads = 2
+	})
+	account := testAccount("alice")
+	stale := jwt.MapClaims{"auth_time": float64(time.Now().Add(-time.Hour).Unix()), "iat": float64(time.Now().Unix())}
+
+	for i := range 2 {
+		if err := checkShareRead(shareReadRequest(stale), shareEndpointRecover, account, "device"); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	var stepUp *stepUpRefusal
+	if err := checkShareRead(shareReadRequest(stale), shareEndpointRecover, account, "device"); !errors.As(err, &stepUp) {
+		t.Fatalf("third read: err = %v, want a step-up", err)
+	}
+	if n := countRows(t, &ShareReadHold{}, "kind = ?", anomalyActionStepUp); n != 1 {
+		t.Fatalf("%d step-up holds, want 1", n)
+	}
+
+	// A refreshed token has a new iat but the same auth_time.
+	refreshed := jwt.MapClaims{"auth_time": stale["auth_time"], "iat": float64(time.Now().Add(time.Minute).Unix())}
+	err := checkShareRead(shareReadRequest(refreshed), shareEndpointRecover, account, "device")
+	if !errors.As(err, &stepUp) {
+		t.Fatalf("refreshed token: err = %v, want a step-up", err)
+	}
+	w := httptest.NewRecorder()
+	refuseShareRead(w, err)
+	if w.Code != http.StatusUnauthorized || w.Header().Get(headerWWWAuthenticate) == "" {
+		t.Errorf("response: status %d, WWW-Authenticate %q", w.Code, w.Header().Get(headerWWWAuthenticate))
+	}
+
+	// Signing in again lifts the hold and clears the burst that raised it.
+	signedIn := jwt.MapClaims{"auth_time": float64(time.Now().Add(2 * time.Second).Unix())}
+	if err := checkShareRead(shareReadRequest(signedIn), shareEndpointRecover, account, "device"); err != nil {
+		t.Fatalf("after signing in again: %v", err)
+	}
+	if n := countRows(t, &ShareReadHold{}, "1 = 1"); n != 0 {
+		t.Errorf("%d holds left after the step-up", n)
+	}
+	if err := checkShareRead(shareReadRequest(signedIn), shareEndpointRecover, account, "device"); err != nil {
+		t.Errorf("next read: %v", err)
+	}
+}
+
+func TestPassesShareReadStepUp(t *testing.T) {
+	useShareAnomaly(t, func(c *shareAnomalyConfig) {
+		c.StepUpACR = []string{"mfa"}
+	})
+	requiredAt := time.Unix(1_700_000_000, 0)
+	after, before := float64(requiredAt.Add(time.Minute).Unix()), float64(requiredAt.Add(-time.Minute).Unix())
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{"auth_time after", jwt.MapClaims{"auth_time": after}, true},
+		{"auth_time before", jwt.MapClaims{"auth_time": before, "iat": after, "acr": "mfa"}, false},
+		{"iat alone", jwt.MapClaims{"iat": after}, false},
+		{"acr on new token", jwt.MapClaims{"iat": after, "acr": "mfa"}, true},
+		{"acr on old token", jwt.MapClaims{"iat": before, "acr": "mfa"}, false},
+		{"other acr", jwt.MapClaims{"iat": after, "acr": "pwd"}, false},
+	}
+	for _, test := range tests {
+		if got := passesShareReadStepUp(test.claims, requiredAt); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestShareReadWindows(t *testing.T) {
+	windows := &shareReadWindows{maxKeys: 3, events: make(map[string][]shareReadEvent)}
+	now := time.Unix(1_700_000_000, 0)
+	window := time.Minute
+
+	if n := windows.add("accounts", "a", now, window); n != 1 {
+		t.Errorf("first account: %d", n)
+	}
+	windows.add("accounts", "a", now.Add(time.Second), window)
+	if n := windows.add("accounts", "b", now.Add(2*time.Second), window); n != 2 {
+		t.Errorf("distinct accounts = %d, want 2", n)
+	}
+	// Reads older than the window no longer count.
+	if n := windows.add("accounts", "c", now.Add(window+1500*time.Millisecond), window); n != 2 {
+		t.Errorf("distinct accounts after the window = %d, want b and c", n)
+	}
+
+	for i := range 3 {
+		if n := windows.count("device", now.Add(time.Duration(i)*time.Second), window); n != i+1 {
+			t.Errorf("device read %d counted %d", i, n)
+		}
+	}
+	windows.reset("device")
+	if n := windows.count("device", now.Add(3*time.Second), window); n != 1 {
+		t.Errorf("device reads after reset = %d, want 1", n)
+	}
+
+	// A full store drops idle keys first, then any key, to make room.
+	windows.count("idle", now.Add(-time.Hour), window)
+	for i := range 4 {
+		windows.count(fmt.Sprintf("key-%d", i), now, window)
+	}
+	if len(windows.events) > 3 {
+		t.Errorf("%d keys kept, want at most 3", len(windows.events))
+	}
+	if _, ok := windows.events["idle"]; ok {
+		t.Error("idle key kept while the store was full")
+	}
+}
+
+func TestRefuseShareReadHidesErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	refuseShareRead(w, fmt.Errorf("failed to read share read holds: relation \"share_read_holds\" does not exist"))
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "database error\n" {
+		t.Errorf("status %d: %q", w.Code, w.Body)
+	}
+}
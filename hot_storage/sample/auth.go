@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 const (
@@ -34,47 +37,117 @@ var (
 	}
 )
 
-func validateAuth(r *http.Request) (string, string, error) {
+// authIdentity is the caller of an authenticated request.
+type authIdentity struct {
+	UserID       string
+	AuthProvider string
+	Tenant       string
+	Claims       jwt.MapClaims
+
+	// Service is the service identity that made the request for UserID, or
+	// "" for a user token.
+	Service string
+
+	// SenderConstrained is false when the provider requires DPoP-bound
+	// tokens to read shares and the token is a plain bearer token.
+	SenderConstrained bool
+}
+
+func validateAuth(r *http.Request) (*authIdentity, error) {
 	token, err := getToken(r)
+	if errors.Is(err, ErrMissingToken) {
+		// Without a token, a verified client certificate can stand for a
+		// service identity.
+		if service := clientService(r); service != nil {
+			return authenticateService(r.Context(), r, service)
+		}
+	}
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	authProvider := r.Header.Get(headerAuthProvider)
 	if authProvider == "" {
 		authProvider = authProviderDefault
 	}
+	identity, err := authenticateToken(r.Context(), token, authProvider)
+	if err != nil {
+		return nil, err
+	}
+	jkt, err := verifyDPoP(r, token, identity.Claims)
+	if err != nil {
+		logAuthFailure(authProvider, err)
+		return nil, err
+	}
+	identity.SenderConstrained = jkt != "" || !dpopRequired(authProvider)
+	if err := resolveLinkedIdentity(r.Context(), identity); err != nil {
+		return nil, err
+	}
+	identity.Tenant, err = resolveTenant(identity)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// authenticateToken validates token with the named auth provider, or the
+// default one when authProvider is empty, and checks it was not revoked.
+func authenticateToken(ctx context.Context, token, authProvider string) (*authIdentity, error) {
+	if authProvider == "" {
+		authProvider = authProviderDefault
+	}
 
 	var userId string
+	var claims jwt.MapClaims
+	var err error
 	switch authProvider {
 	case authProviderDefault:
-		userId, err = validateDefaultAuth(token)
+		userId, claims, err = validateDefaultAuth(ctx, token)
 	default:
-		userId, err = validateThirdPartyAuth(token, authProvider)
+		userId, claims, err = validateThirdPartyAuth(ctx, token, authProvider)
+	}
+	if err != nil {
+		logAuthFailure(authProvider, err)
+		return nil, err
+	}
+
+	identity := &authIdentity{UserID: userId, AuthProvider: authProvider, Claims: claims}
+	if scoped, ok := authProviders[authProvider].(accountScopedProvider); ok {
+		identity.AuthProvider = scoped.AccountProvider(claims)
 	}
-	return userId, authProvider, err
+	if err := checkRevocation(ctx, identity); err != nil {
+		logAuthFailure(authProvider, err)
+		return nil, err
+	}
+	return identity, nil
 }
 
-func validateThirdPartyAuth(token string, authProvider string) (string, error) {
-	switch authProvider {
-	case authProviderGoogle:
-		return validate(token, authProviderGoogleUrl)
-	case authProviderPlayFab:
-		return "", errors.New("playfab third party authentication is unimplemented")
-	default:
-		return "", errors.New("unsupported auth provider")
+func validateThirdPartyAuth(ctx context.Context, token string, authProvider string) (string, jwt.MapClaims, error) {
+	provider, ok := authProviders[authProvider]
+	if !ok {
+		return "", nil, reject(rejectUnknownProvider)
 	}
+	return provider.Validate(ctx, token)
 }
 
-func validateDefaultAuth(token string) (string, error) {
-	jwkUrl := fmt.Sprintf("%s/.well-known/jwks.json", authServerURL)
-	userId, err := validate(token, jwkUrl)
+func validateDefaultAuth(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	userId, claims, err := defaultAuthProvider.Validate(ctx, token)
 	if err != nil {
-		slog.Info(fmt.Sprintf("failed to authenticate user: '%v'", err))
-		return "", err
+		return "", nil, err
 	}
 	slog.Info("authenticated user", slog.String("externalUserId", userId))
-	return userId, nil
+	return userId, claims, nil
+}
+
+// logAuthFailure logs why a token was refused. The client only ever sees
+// "unauthorized".
+func logAuthFailure(authProvider string, err error) {
+	var rejection *authRejection
+	if errors.As(err, &rejection) {
+		slog.Info("token rejected", slog.String("authProvider", authProvider), slog.String("reason", rejection.Reason))
+		return
+	}
+	slog.Info(fmt.Sprintf("failed to authenticate user: '%v'", err), slog.String("authProvider", authProvider))
 }
 
 func unauthorized(w http.ResponseWriter) {
@@ -113,6 +186,7 @@ func getToken(r *http.Request) (string, error) {
 func getTokenFromHeader(r *http.Request) (string, error) {
 	token := r.Header.Get(headerAuth)
 	token = strings.TrimPrefix(token, headerAuthPrefix)
+	token = strings.TrimPrefix(token, headerAuthDPoPPrefix)
 	if token == "" {
 		return "", ErrMissingToken
 	}
@@ -1,5 +1,49 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var authServerURL = os.Getenv("AUTH_SERVER_URL") // e.g. "https://auth.example.com/validate"
+
+// envInt reads an integer environment variable, returning def when it is unset.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", name, err)
+	}
+	return n, nil
+}
+
+// envDuration reads a time.ParseDuration-formatted environment variable,
+// returning def when it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration (e.g. 30s, 1h): %w", name, err)
+	}
+	return d, nil
+}
+
+// envList reads a comma-separated environment variable, dropping empty items.
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsRule is the CORS policy of the paths it covers.
+type corsRule struct {
+	// Path is the request path the rule covers, or every path under it when
+	// it ends in "/".
+	Path           string
+	Origins        []originPattern
+	Methods        string
+	Headers        string
+	ExposedHeaders string
+	// MaxAge is how long browsers may cache a preflight. Zero leaves it to
+	// the browser.
+	MaxAge time.Duration
+}
+
+// originPattern matches an origin such as https://app.example.com, or every
+// subdomain of example.com for https://*.example.com.
+type originPattern struct {
+	scheme   string
+	host     string
+	port     string
+	wildcard bool
+}
+
+var (
+	// corsDefault applies to paths no entry of corsRules covers.
+	corsDefault corsRule
+
+	// corsRules is CORS_RULES, longest path first.
+	corsRules []corsRule
+
+	// corsStrict refuses preflight requests from origins that are not
+	// allowed with 403 instead of answering them without the allow headers.
+	corsStrict bool
+)
+
+// initCORS reads the CORS policy:
+//
+//	ALLOWED_ORIGINS       comma-separated origins, "*." allowed as the first host label
+//	CORS_ALLOWED_METHODS  comma-separated methods allowed in preflight
+//	CORS_ALLOWED_HEADERS  comma-separated request headers allowed in preflight
+//	CORS_EXPOSED_HEADERS  comma-separated response headers scripts may read
+//	CORS_MAX_AGE          how long browsers may cache a preflight
+//	CORS_STRICT           "true" refuses preflight from other origins with 403
+//	CORS_RULES            JSON array of per-path rules (or CORS_RULES_FILE)
+func initCORS() error {
+	origins := envList("ALLOWED_ORIGINS")
+	if len(origins) == 0 {
+		origins = []string{"http://localhost:7050", "http://localhost:7051"}
+	}
+	patterns, err := parseOriginPatterns(origins)
+	if err != nil {
+		return fmt.Errorf("ALLOWED_ORIGINS: %w", err)
+	}
+	maxAge, err := envDuration("CORS_MAX_AGE", 0)
+	if err != nil {
+		return err
+	}
+	if maxAge < 0 {
+		return fmt.Errorf("CORS_MAX_AGE must not be negative")
+	}
+	corsDefault = corsRule{
+		Origins:        patterns,
+		Methods:        corsHeaderList(envList("CORS_ALLOWED_METHODS"), "GET, POST, PUT, DELETE, OPTIONS"),
+		Headers:        corsHeaderList(envList("CORS_ALLOWED_HEADERS"), "Content-Type, Authorization, x-auth-provider, x-request-id, x-player-token, x-cookie-field, dpop"),
+		ExposedHeaders: corsHeaderList(envList("CORS_EXPOSED_HEADERS"), "WWW-Authenticate, Retry-After"),
+		MaxAge:         maxAge,
+	}
+	corsStrict = os.Getenv("CORS_STRICT") == "true"
+
+	corsRules = nil
+	inline := os.Getenv("CORS_RULES")
+	path := os.Getenv("CORS_RULES_FILE")
+	var data []byte
+	switch {
+	case inline != "" && path != "":
+		return fmt.Errorf("set only one of CORS_RULES and CORS_RULES_FILE")
+	case inline != "":
+		data = []byte(inline)
+	case path != "":
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CORS_RULES_FILE: %w", err)
+		}
+	default:
+		return nil
+	}
+
+	// Settings a rule leaves out keep the values above.
+	var configs []struct {
+		Path           string   `json:"path"`
+		Origins        []string `json:"origins"`
+		Methods        []string `json:"methods"`
+		Headers        []string `json:"headers"`
+		ExposedHeaders []string `json:"exposedHeaders"`
+		MaxAge         string   `json:"maxAge"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("failed to parse CORS rules: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		if !strings.HasPrefix(config.Path, "/") {
+			return fmt.Errorf("CORS rule path %q must start with /", config.Path)
+		}
+		if seen[config.Path] {
+			return fmt.Errorf("duplicate CORS rule for %q", config.Path)
+		}
+		seen[config.Path] = true
+		rule := corsDefault
+		rule.Path = config.Path
+		if config.Origins != nil {
+			if rule.Origins, err = parseOriginPatterns(config.Origins); err != nil {
+				return fmt.Errorf("CORS rule %q: %w", config.Path, err)
+			}
+		}
+		rule.Methods = corsHeaderList(config.Methods, rule.Methods)
+		rule.Headers = corsHeaderList(config.Headers, rule.Headers)
+		rule.ExposedHeaders = corsHeaderList(config.ExposedHeaders, rule.ExposedHeaders)
+		if config.MaxAge != "" {
+			if rule.MaxAge, err = time.ParseDuration(config.MaxAge); err != nil || rule.MaxAge < 0 {
+				return fmt.Errorf("CORS rule %q: maxAge must be a duration", config.Path)
+			}
+		}
+		corsRules = append(corsRules, rule)
+	}
+	slices.SortFunc(corsRules, func(a, b corsRule) int { return len(b.Path) - len(a.Path) })
+	return nil
+}
+
+// corsHeaderList joins items into a header value, or returns def when there
+// are none.
+func corsHeaderList(items []string, def string) string {
+	if len(items) == 0 {
+		return def
+	}
+	return strings.Join(items, ", ")
+}
+
+func parseOriginPatterns(origins []string) ([]originPattern, error) {
+	patterns := make([]originPattern, 0, len(origins))
+	for _, origin := range origins {
+		pattern, err := parseOriginPattern(strings.TrimSpace(origin))
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func parseOriginPattern(origin string) (originPattern, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return originPattern{}, fmt.Errorf("invalid origin %q", origin)
+	}
+	pattern := originPattern{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+	if rest, ok := strings.CutPrefix(pattern.host, "*."); ok {
+		pattern.host, pattern.wildcard = rest, true
+	}
+	if pattern.host == "" || strings.Contains(pattern.host, "*") {
+		return originPattern{}, fmt.Errorf("invalid origin %q: * may only be the first label of the host", origin)
+	}
+	return pattern, nil
+}
+
+// matches reports whether origin is allowed by p. A wildcard matches
+// subdomains at any depth but not the domain itself.
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Path != "" || u.User != nil || u.RawQuery != "" ||
+		strings.ToLower(u.Scheme) != p.scheme || u.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if !p.wildcard {
+		return host == p.host
+	}
+	sub, ok := strings.CutSuffix(host, "."+p.host)
+	return ok && sub != ""
+}
+
+// corsRuleFor returns the rule of the longest path covering path, or
+// corsDefault.
+func corsRuleFor(path string) *corsRule {
+	for i := range corsRules {
+		rule := &corsRules[i]
+		if path == rule.Path || (strings.HasSuffix(rule.Path, "/") && strings.HasPrefix(path, rule.Path)) {
+			return rule
+		}
+	}
+	return &corsDefault
+}
+
+// allows reports whether origin may call the paths of the rule.
+func (rule *corsRule) allows(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	return slices.ContainsFunc(rule.Origins, func(p originPattern) bool { return p.matches(origin) })
+}
+
+// maxAgeHeader returns the Access-Control-Max-Age value of the rule.
+func (rule *corsRule) maxAgeHeader() string {
+	return strconv.Itoa(int(rule.MaxAge.Seconds()))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useCORS reads the CORS policy from env for the length of the test.
+func useCORS(t *testing.T, env map[string]string) {
+	t.Helper()
+	prevDefault, prevRules, prevStrict := corsDefault, corsRules, corsStrict
+	t.Cleanup(func() { corsDefault, corsRules, corsStrict = prevDefault, prevRules, prevStrict })
+	for _, name := range []string{"ALLOWED_ORIGINS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_HEADERS", "CORS_EXPOSED_HEADERS", "CORS_MAX_AGE", "CORS_STRICT", "CORS_RULES", "CORS_RULES_FILE"} {
+		t.Setenv(name, env[name])
+	}
+	if err := initCORS(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOriginPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://APP.example.com", true},
+		{"https://app.example.com", "https://other.example.com", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://app.example.com.evil.com", false},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"https://*.example.com", "https://app.example.com:8443", false},
+		{"https://app.example.com:8443", "https://app.example.com:8443", true},
+		{"https://app.example.com:8443", "https://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com/path", false},
+		{"https://app.example.com", "null", false},
+	}
+	for _, test := range tests {
+		pattern, err := parseOriginPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("parseOriginPattern(%q): %v", test.pattern, err)
+		}
+		if got := pattern.matches(test.origin); got != test.want {
+			t.Errorf("%s matches %s = %v, want %v", test.pattern, test.origin, got, test.want)
+		}
+	}
+}
+
+func TestParseOriginPatternRejects(t *testing.T) {
+	for _, origin := range []string{"app.example.com", "https://", "https://*", "https://app.*.com", "https://**.example.com", "https://app.example.com/path", "https://user@app.example.com"} {
+		if _, err := parseOriginPattern(origin); err == nil {
+			t.Errorf("parseOriginPattern(%q) succeeded", origin)
+		}
+	}
+}
+
+func TestCORSRuleFor(t *testing.T) {
+	useCORS(t, map[string]string{
+		"ALLOWED_ORIGINS": "https://app.example.com",
+		"CORS_RULES": `[
+			{"path": "/v2/", "origins": ["https://v2.example.com"]},
+			{"path": "/v2/accounts/", "origins": ["https://accounts.example.com"], "maxAge": "10m"},
+			{"path": "/v2/accounts", "methods": ["GET"]}
+		]`,
+	})
+
+	tests := []struct {
+		path   string
+		origin string
+	}{
+		{"/v2/accounts/123", "https://accounts.example.com"},
+		{"/v2/devices", "https://v2.example.com"},
+		{"/v2/accounts", "https://app.example.com"},
+		{"/v2", "https://app.example.com"},
+		{"/admin/keys", "https://app.example.com"},
+	}
+	for _, test := range tests {
+		if rule := corsRuleFor(test.path); !rule.allows(test.origin) {
+			t.Errorf("%s: rule %q does not allow %s", test.path, rule.Path, test.origin)
+		}
+	}
+	if rule := corsRuleFor("/v2/accounts"); rule.Methods != "GET" {
+		t.Errorf("exact rule methods = %q, want GET", rule.Methods)
+	}
+	if rule := corsRuleFor("/v2/accounts/123"); rule.maxAgeHeader() != "600" || rule.Methods != corsDefault.Methods {
+		t.Errorf("prefix rule: max age %s, methods %q", rule.maxAgeHeader(), rule.Methods)
+	}
+}
+
+func TestInitCORSRejects(t *testing.T) {
+	useCORS(t, nil)
+	for _, rules := range []string{
+		`[{"path": "v2/"}]`,
+		`[{"path": "/v2/"}, {"path": "/v2/"}]`,
+		`[{"path": "/v2/", "origins": ["https://*"]}]`,
+		`[{"path": "/v2/", "maxAge": "-1m"}]`,
+		`{"path": "/v2/"}`,
+	} {
+		t.Setenv("CORS_RULES", rules)
+		if err := initCORS(); err == nil {
+			t.Errorf("CORS_RULES=%s accepted", rules)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	var reached bool
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/v2/accounts", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	useCORS(t, map[string]string{"ALLOWED_ORIGINS": "https://*.example.com", "CORS_MAX_AGE": "1h"})
+	w := preflight("https://app.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("allowed origin: status %d, headers %v", w.Code, w.Header())
+	}
+	w = preflight("https://example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("other origin: status %d, headers %v", w.Code, w.Header())
+	}
+
+	useCORS(t, map[string]string{"ALLOWED_ORIGINS": "https://*.example.com", "CORS_STRICT": "true"})
+	if w := preflight("https://example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("other origin in strict mode: status %d, want 403", w.Code)
+	}
+	if w := preflight("https://app.example.com"); w.Code != http.StatusOK {
+		t.Errorf("allowed origin in strict mode: status %d", w.Code)
+	}
+	if reached {
+		t.Error("a preflight reached the handler")
+	}
+}
@@ -1,83 +1,347 @@
 package main
 
 import (
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sharePrefix marks ciphertexts that carry a header. Shares written before
+// key versioning are bare base64 and never start with '$'.
+const sharePrefix = "$share$"
+
+// Share AEAD algorithms, as recorded in the a= header parameter.
+const (
+	algorithmAESGCM  = "aes-256-gcm"
+	algorithmXChaCha = "xchacha20-poly1305"
 )
 
-var shareEncryptionKey []byte
+// ErrUnboundShare is returned by decryptShare for a share sealed without a
+// shareBinding while SHARE_REQUIRE_BINDING is enabled.
+var ErrUnboundShare = errors.New("share is not bound to its owner")
+
+// requireShareBinding rejects shares that predate shareBinding. Enable it
+// once the rotation job has re-sealed every legacy row.
+var requireShareBinding = os.Getenv("SHARE_REQUIRE_BINDING") == "true"
+
+// shareAlgorithm seals new shares and wraps data keys in local key rings.
+// AES-256-GCM draws 96-bit random nonces, which approach their birthday bound
+// after about 2^32 encryptions under one key; XChaCha20-Poly1305 draws 192-bit
+// nonces and has no practical limit.
+var shareAlgorithm = algorithmAESGCM
+
+// initShareAlgorithm reads SHARE_CIPHER, "aes-256-gcm" (default) or
+// "xchacha20-poly1305".
+func initShareAlgorithm() error {
+	algorithm := os.Getenv("SHARE_CIPHER")
+	if algorithm == "" {
+		return nil
+	}
+	if _, err := newAEAD(algorithm, make([]byte, 32)); err != nil {
+		return err
+	}
+	shareAlgorithm = algorithm
+	return nil
+}
+
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case algorithmAESGCM:
+		return newGCM(key)
+	case algorithmXChaCha:
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %w", err)
+		}
+		return aead, nil
+	default:
+		return nil, fmt.Errorf("unsupported share cipher %q", algorithm)
+	}
+}
+
+// shareBinding identifies the row a share belongs to. It is authenticated as
+// associated data, so a ciphertext copied into another device, signer
+// or account fails to decrypt.
+type shareBinding struct {
+	DeviceID     string
+	SignerID     string
+	Username     string
+	AuthProvider string
+	Tenant       string
+}
+
+// newShareBinding binds a device share to the account that owns its signer.
+func newShareBinding(deviceId string, account Account) shareBinding {
+	return shareBinding{
+		DeviceID:     deviceId,
+		SignerID:     account.SignerId,
+		Username:     account.Username,
+		AuthProvider: account.AuthProvider,
+		Tenant:       account.Tenant,
+	}
+}
+
+// associatedData encodes the binding as length-prefixed fields so that no two
+// distinct bindings share an encoding. The tenant is only appended when set,
+// which keeps shares bound before tenant keys existed readable.
+func (b shareBinding) associatedData() []byte {
+	fields := []string{"opensigner-share-v1", b.DeviceID, b.SignerID, b.Username, b.AuthProvider}
+	if b.Tenant != "" {
+		fields = append(fields, b.Tenant)
+	}
+	var ad []byte
+	for _, field := range fields {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(field)))
+		ad = append(ad, field...)
+	}
+	return ad
+}
+
+// sealedShare is the decoded form of a value stored in devices.share:
+//
+//	$share$k=<key id>[,dek=<wrapped data key>][,w=<algorithm>][,aad=1][,a=<algorithm>]$base64(nonce || ciphertext || tag)
+//
+// With dek, the share is sealed with a random data key that the key provider
+// wrapped under KEK k, with AEAD w when the provider wrapped it locally.
+// Without it, the share is sealed directly with version k of shareKeys. With
+// aad=1, the ciphertext authenticates its shareBinding. a names the AEAD and
+// defaults to AES-256-GCM. Headerless values are direct, unbound AES-256-GCM
+// ciphertexts sealed with legacyKeyVersion.
+type sealedShare struct {
+	KeyID         string
+	WrappedKey    []byte
+	WrapAlgorithm string
+	Bound         bool
+	Algorithm     string
+	Payload       []byte
+}
+
+func (s sealedShare) encode() string {
+	header := "k=" + url.QueryEscape(s.KeyID)
+	if s.WrappedKey != nil {
+		header += ",dek=" + base64.RawURLEncoding.EncodeToString(s.WrappedKey)
+	}
+	if s.WrapAlgorithm != "" {
+		header += ",w=" + s.WrapAlgorithm
+	}
+	if s.Bound {
+		header += ",aad=1"
+	}
+	if s.Algorithm != "" {
+		header += ",a=" + s.Algorithm
+	}
+	return sharePrefix + header + "$" + base64.StdEncoding.EncodeToString(s.Payload)
+}
 
-func initEncryptionKey() error {
-	keyHex := os.Getenv("SHARE_ENCRYPTION_KEY")
-	if keyHex == "" {
-		return fmt.Errorf("SHARE_ENCRYPTION_KEY environment variable must be set (64 hex chars = 32 bytes)")
+func decodeSealedShare(encoded string) (sealedShare, error) {
+	if !strings.HasPrefix(encoded, sharePrefix) {
+		payload, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return sealedShare{}, fmt.Errorf("failed to decode base64: %w", err)
+		}
+		return sealedShare{KeyID: legacyKeyVersion, Algorithm: algorithmAESGCM, Payload: payload}, nil
 	}
-	key, err := hex.DecodeString(keyHex)
+
+	header, body, ok := strings.Cut(strings.TrimPrefix(encoded, sharePrefix), "$")
+	if !ok {
+		return sealedShare{}, fmt.Errorf("malformed share header")
+	}
+
+	s := sealedShare{Algorithm: algorithmAESGCM}
+	for _, param := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "k":
+			keyId, err := url.QueryUnescape(value)
+			if err != nil {
+				return sealedShare{}, fmt.Errorf("malformed share key id: %w", err)
+			}
+			s.KeyID = keyId
+		case "dek":
+			wrapped, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil {
+				return sealedShare{}, fmt.Errorf("malformed wrapped data key: %w", err)
+			}
+			s.WrappedKey = wrapped
+		case "w":
+			if value != algorithmAESGCM && value != algorithmXChaCha {
+				return sealedShare{}, fmt.Errorf("unsupported data key wrap algorithm %q", value)
+			}
+			s.WrapAlgorithm = value
+		case "aad":
+			if value != "1" {
+				return sealedShare{}, fmt.Errorf("unsupported share aad version %q", value)
+			}
+			s.Bound = true
+		case "a":
+			if value != algorithmAESGCM && value != algorithmXChaCha {
+				return sealedShare{}, fmt.Errorf("unsupported share algorithm %q", value)
+			}
+			s.Algorithm = value
+		default:
+			return sealedShare{}, fmt.Errorf("unsupported share header parameter %q", name)
+		}
+	}
+	if s.KeyID == "" {
+		return sealedShare{}, fmt.Errorf("share header is missing the key id")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(body)
 	if err != nil {
-		return fmt.Errorf("SHARE_ENCRYPTION_KEY must be valid hex: %w", err)
+		return sealedShare{}, fmt.Errorf("failed to decode base64: %w", err)
 	}
-	if len(key) != 32 {
-		return fmt.Errorf("SHARE_ENCRYPTION_KEY must be 32 bytes (64 hex chars), got %d bytes", len(key))
+	s.Payload = payload
+	return s, nil
+}
+
+// shareCipher seals shares under data keys wrapped by provider. direct, when
+// set, opens shares sealed directly with a ring key before envelope
+// encryption.
+type shareCipher struct {
+	provider keyProvider
+	direct   *keyRing
+}
+
+// currentShareCipher returns the cipher configured by initEncryptionKey.
+func currentShareCipher() shareCipher {
+	return shareCipher{provider: shareKeyProvider, direct: shareKeys}
+}
+
+// encryptShare seals a share with the cipher cipherFor selects.
+func encryptShare(ctx context.Context, plaintext []byte, binding shareBinding) (string, error) {
+	c, err := cipherFor(ctx, binding)
+	if err != nil {
+		return "", err
 	}
-	shareEncryptionKey = key
-	return nil
+	return c.encrypt(ctx, plaintext, binding)
 }
 
-// encryptShare encrypts a share using AES-256-GCM.
-// Returns base64-encoded nonce+ciphertext.
-func encryptShare(plaintext string) (string, error) {
-	block, err := aes.NewCipher(shareEncryptionKey)
+// decryptShare opens a share with the cipher cipherFor selects. The caller
+// owns the returned secret and must Wipe it.
+func decryptShare(ctx context.Context, encoded string, binding shareBinding) (secret, error) {
+	c, err := cipherFor(ctx, binding)
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
+		return secret{}, err
 	}
+	return c.decrypt(ctx, encoded, binding)
+}
 
-	gcm, err := cipher.NewGCM(block)
+// shareNeedsRotation reports whether a share should be re-sealed with the
+// cipher cipherFor selects.
+func shareNeedsRotation(ctx context.Context, encoded string, binding shareBinding) (bool, error) {
+	c, err := cipherFor(ctx, binding)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return false, err
 	}
+	return c.needsRotation(encoded)
+}
 
-	nonce := make([]byte, gcm.NonceSize())
+// needsRotation reports whether an encoded share should be re-sealed: it
+// predates envelope encryption or shareBinding, it or its locally wrapped
+// data key uses another algorithm than shareAlgorithm, or its data key is
+// wrapped under a KEK other than the provider's active one.
+func (c shareCipher) needsRotation(encoded string) (bool, error) {
+	s, err := decodeSealedShare(encoded)
+	if err != nil {
+		return false, err
+	}
+	if s.WrappedKey == nil || !s.Bound || s.Algorithm != shareAlgorithm {
+		return true, nil
+	}
+	if s.WrapAlgorithm != "" && s.WrapAlgorithm != shareAlgorithm {
+		return true, nil
+	}
+	active := c.provider.ActiveKeyID()
+	return active != "" && s.KeyID != active, nil
+}
+
+// encrypt encrypts a share using shareAlgorithm under a fresh data key,
+// authenticating binding as associated data, and wraps that key with the
+// provider. Returns the encoded sealedShare.
+func (c shareCipher) encrypt(ctx context.Context, plaintext []byte, binding shareBinding) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	defer clear(dek)
+
+	aead, err := newAEAD(shareAlgorithm, dek)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
+	ciphertext := aead.Seal(nonce, nonce, plaintext, binding.associatedData())
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	keyId, wrapAlgorithm, wrapped, err := c.provider.WrapKey(ctx, dek)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return sealedShare{KeyID: keyId, WrappedKey: wrapped, WrapAlgorithm: wrapAlgorithm, Bound: true, Algorithm: shareAlgorithm, Payload: ciphertext}.encode(), nil
 }
 
-// decryptShare decrypts a base64-encoded AES-256-GCM ciphertext.
-func decryptShare(encoded string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(encoded)
+// decrypt decrypts an encoded sealedShare, unwrapping its data key through
+// the provider or, for direct ciphertexts, using the direct key ring. Bound
+// shares only open under the binding of the row they were written to.
+func (c shareCipher) decrypt(ctx context.Context, encoded string, binding shareBinding) (secret, error) {
+	s, err := decodeSealedShare(encoded)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode base64: %w", err)
+		return secret{}, err
+	}
+	if !s.Bound && requireShareBinding {
+		return secret{}, ErrUnboundShare
 	}
 
-	block, err := aes.NewCipher(shareEncryptionKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
+	var key []byte
+	if s.WrappedKey != nil {
+		key, err = c.provider.UnwrapKey(ctx, s.KeyID, s.WrapAlgorithm, s.WrappedKey)
+		if err != nil {
+			return secret{}, err
+		}
+		defer clear(key)
+	} else {
+		if c.direct == nil {
+			return secret{}, fmt.Errorf("share was sealed with key version %q but no direct key ring is configured", s.KeyID)
+		}
+		key, err = c.direct.key(s.KeyID)
+		if err != nil {
+			return secret{}, err
+		}
+		defer clear(key)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	aead, err := newAEAD(s.Algorithm, key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return secret{}, err
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+	nonceSize := aead.NonceSize()
+	if len(s.Payload) < nonceSize {
+		return secret{}, fmt.Errorf("ciphertext too short")
 	}
 
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	var ad []byte
+	if s.Bound {
+		ad = binding.associatedData()
+	}
+	nonce, ciphertext := s.Payload[:nonceSize], s.Payload[nonceSize:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt share: %w", err)
+		return secret{}, fmt.Errorf("failed to decrypt share: %w", err)
 	}
 
-	return string(plaintext), nil
+	return newSecret(plaintext), nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestKeyRing(t *testing.T) *keyRing {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &keyRing{active: "1", keys: map[string]secret{"1": newSecret(key)}}
+}
+
+func TestShareRecordsWrapAlgorithm(t *testing.T) {
+	ring := newTestKeyRing(t)
+	c := shareCipher{provider: ring}
+	binding := shareBinding{DeviceID: "device-1", SignerID: "signer-1"}
+
+	for _, algorithm := range []string{algorithmAESGCM, algorithmXChaCha} {
+		t.Run(algorithm, func(t *testing.T) {
+			t.Cleanup(func() { shareAlgorithm = algorithmAESGCM })
+			shareAlgorithm = algorithm
+
+			encoded, err := c.encrypt(context.Background(), []byte("share"), binding)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			s, err := decodeSealedShare(encoded)
+			if err != nil {
+				t.Fatalf("decodeSealedShare: %v", err)
+			}
+			if s.WrapAlgorithm != algorithm || !strings.Contains(encoded, ",w="+algorithm) {
+				t.Errorf("header %q does not record wrap algorithm %s", encoded, algorithm)
+			}
+			plaintext, err := c.decrypt(context.Background(), encoded, binding)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if string(plaintext.Bytes()) != "share" {
+				t.Errorf("decrypt = %q", plaintext.Bytes())
+			}
+
+			// The recorded algorithm is used as is, so a wrong one fails.
+			other := algorithmXChaCha
+			if algorithm == algorithmXChaCha {
+				other = algorithmAESGCM
+			}
+			s.WrapAlgorithm = other
+			if _, err := c.decrypt(context.Background(), s.encode(), binding); err == nil {
+				t.Errorf("decrypt succeeded with wrap algorithm %s", other)
+			}
+		})
+	}
+}
+
+func TestShareWithoutWrapAlgorithm(t *testing.T) {
+	ring := newTestKeyRing(t)
+	c := shareCipher{provider: ring}
+	binding := shareBinding{DeviceID: "device-1", SignerID: "signer-1"}
+
+	encoded, err := c.encrypt(context.Background(), []byte("share"), binding)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	s, _ := decodeSealedShare(encoded)
+	s.WrapAlgorithm = ""
+	legacy := s.encode()
+	if strings.Contains(legacy, ",w=") {
+		t.Fatalf("header %q still has w=", legacy)
+	}
+	if _, err := c.decrypt(context.Background(), legacy, binding); err != nil {
+		t.Errorf("decrypt of a share without w=: %v", err)
+	}
+
+	if _, err := decodeSealedShare(strings.Replace(encoded, ",w="+algorithmAESGCM, ",w=rot13", 1)); err == nil {
+		t.Error("decodeSealedShare accepted an unknown wrap algorithm")
+	}
+}
+
+func TestShareNeedsRotationForWrapAlgorithm(t *testing.T) {
+	c := shareCipher{provider: newTestKeyRing(t)}
+	t.Cleanup(func() { shareAlgorithm = algorithmAESGCM })
+
+	encoded, err := c.encrypt(context.Background(), []byte("share"), shareBinding{DeviceID: "device-1"})
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	s, _ := decodeSealedShare(encoded)
+	s.WrapAlgorithm = algorithmXChaCha
+	if rotate, err := c.needsRotation(s.encode()); err != nil || !rotate {
+		t.Errorf("needsRotation = %v, %v for a data key wrapped with another algorithm", rotate, err)
+	}
+	if rotate, err := c.needsRotation(encoded); err != nil || rotate {
+		t.Errorf("needsRotation = %v, %v for a current share", rotate, err)
+	}
+}
+
+func TestShareBindingRejectsSwap(t *testing.T) {
+	c := shareCipher{provider: newTestKeyRing(t)}
+	ctx := context.Background()
+	binding := shareBinding{DeviceID: "device-1", SignerID: "signer-1", Username: "alice", AuthProvider: authProviderDefault}
+	encoded, err := c.encrypt(ctx, []byte("share"), binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swaps := map[string]func(*shareBinding){
+		"device":        func(b *shareBinding) { b.DeviceID = "device-2" },
+		"signer":        func(b *shareBinding) { b.SignerID = "signer-2" },
+		"user":          func(b *shareBinding) { b.Username = "mallory" },
+		"auth provider": func(b *shareBinding) { b.AuthProvider = authProviderGoogle },
+		"tenant":        func(b *shareBinding) { b.Tenant = "acme" },
+	}
+	for name, swap := range swaps {
+		other := binding
+		swap(&other)
+		if _, err := c.decrypt(ctx, encoded, other); err == nil {
+			t.Errorf("share of %s opened under another %s", binding.DeviceID, name)
+		}
+	}
+
+	// Unbinding the ciphertext by editing its header does not help either.
+	s, _ := decodeSealedShare(encoded)
+	s.Bound = false
+	if _, err := c.decrypt(ctx, s.encode(), binding); err == nil {
+		t.Error("bound share opened without its binding")
+	}
+}
+
+func TestShareBindingAssociatedDataIsUnambiguous(t *testing.T) {
+	a := shareBinding{DeviceID: "ab", SignerID: "c"}
+	b := shareBinding{DeviceID: "a", SignerID: "bc"}
+	if string(a.associatedData()) == string(b.associatedData()) {
+		t.Error("bindings with shifted fields share an encoding")
+	}
+	withTenant := a
+	withTenant.Tenant = "acme"
+	if string(a.associatedData()) == string(withTenant.associatedData()) {
+		t.Error("tenant is not part of the associated data")
+	}
+}
+
+func TestRequireShareBinding(t *testing.T) {
+	ring := newTestKeyRing(t)
+	ring.keys[legacyKeyVersion] = newTestKeyRing(t).keys["1"]
+	c := shareCipher{provider: ring, direct: ring}
+	legacy := sealLegacyShare(t, ring, "share")
+
+	if _, err := c.decrypt(context.Background(), legacy, shareBinding{DeviceID: "device-1"}); err != nil {
+		t.Fatalf("unbound share: %v", err)
+	}
+	t.Cleanup(func() { requireShareBinding = false })
+	requireShareBinding = true
+	if _, err := c.decrypt(context.Background(), legacy, shareBinding{DeviceID: "device-1"}); !errors.Is(err, ErrUnboundShare) {
+		t.Errorf("unbound share with SHARE_REQUIRE_BINDING: err = %v, want ErrUnboundShare", err)
+	}
+}
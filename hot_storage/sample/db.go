@@ -48,6 +48,36 @@ func initDB() error {
 	if err := newDB.AutoMigrate(&MigratedAccountData{}); err != nil {
 		return err
 	}
+	if err := newDB.AutoMigrate(&KeyCheck{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&TenantKey{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&DeletionReceipt{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&LinkedIdentity{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&RevokedToken{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&RevocationCutoff{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&RateLimitCounter{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&UserQuota{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&ShareReadClient{}); err != nil {
+		return err
+	}
+	if err := newDB.AutoMigrate(&ShareReadHold{}); err != nil {
+		return err
+	}
 
 	db = newDB
 	slog.Info("DB initialized")
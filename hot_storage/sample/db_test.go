@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// openTestDB sets db for a test that needs a database. It connects like
+// initDB, so DB_HOST and the other DB_ variables must name a database the
+// tests may empty; without DB_HOST the test is skipped.
+var openTestDB = func(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	if err := initDB(); err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+}
+
+// newTestDB opens the test database with all of its tables emptied, and
+// restores db when the test ends.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	prev := db
+	t.Cleanup(func() { db = prev })
+	openTestDB(t)
+
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		t.Fatalf("GetTables: %v", err)
+	}
+	for _, table := range tables {
+		if err := db.Exec(fmt.Sprintf("DELETE FROM %q", table)).Error; err != nil {
+			t.Fatalf("failed to empty %s: %v", table, err)
+		}
+	}
+}
+
+// requirePostgres skips a test that relies on Postgres-only SQL, such as
+// advisory locks or row locks.
+func requirePostgres(t *testing.T) {
+	t.Helper()
+	if name := db.Dialector.Name(); name != "postgres" {
+		t.Skipf("needs postgres, not %s", name)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	headerDPoP            = "DPoP"
+	headerAuthDPoPPrefix  = "DPoP "
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	dpopProofType = "dpop+jwt"
+
+	rejectDPoPMissing     = "dpop_proof_missing"
+	rejectDPoPInvalid     = "dpop_proof_invalid"
+	rejectDPoPKeyMismatch = "dpop_key_mismatch"
+	rejectDPoPMethod      = "dpop_htm_mismatch"
+	rejectDPoPURL         = "dpop_htu_mismatch"
+	rejectDPoPIssuedAt    = "dpop_iat_out_of_range"
+	rejectDPoPTokenHash   = "dpop_ath_mismatch"
+	rejectDPoPReplay      = "dpop_replay"
+	rejectDPoPUnbound     = "dpop_token_not_bound"
+	rejectDPoPScheme      = "dpop_bearer_scheme"
+)
+
+// dpopAlgorithms are the asymmetric algorithms accepted for DPoP proofs.
+var dpopAlgorithms = []string{"ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"}
+
+var (
+	// dpopRequiredProviders is DPOP_REQUIRED_PROVIDERS: auth providers whose
+	// tokens must be sender-constrained to read shares.
+	dpopRequiredProviders []string
+
+	// dpopPublicURL is DPOP_PUBLIC_URL, the scheme, host and path prefix
+	// clients use to reach the service, for checking htu behind a proxy.
+	dpopPublicURL *url.URL
+
+	dpopProofMaxAge = time.Minute
+	dpopProofs      = &dpopReplayCache{maxEntries: 100000, seen: make(map[[sha256.Size]byte]time.Time)}
+)
+
+// initDPoP reads the DPoP settings:
+//
+//	DPOP_REQUIRED_PROVIDERS  auth providers whose tokens must be DPoP-bound on share-reading routes
+//	DPOP_PUBLIC_URL          external base URL used to check htu, default taken from the request
+//	DPOP_PROOF_MAX_AGE       how far a proof's iat may be from now, default 1m
+//	DPOP_REPLAY_CACHE_SIZE   maximum remembered proof jtis, default 100000
+func initDPoP() error {
+	dpopRequiredProviders = envList("DPOP_REQUIRED_PROVIDERS")
+	if v := os.Getenv("DPOP_PUBLIC_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("DPOP_PUBLIC_URL must be an absolute http(s) URL without query or fragment")
+		}
+		dpopPublicURL = u
+	}
+	maxAge, err := envDuration("DPOP_PROOF_MAX_AGE", dpopProofMaxAge)
+	if err != nil {
+		return err
+	}
+	if maxAge <= 0 {
+		return fmt.Errorf("DPOP_PROOF_MAX_AGE must be positive")
+	}
+	dpopProofMaxAge = maxAge
+	size, err := envInt("DPOP_REPLAY_CACHE_SIZE", dpopProofs.maxEntries)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("DPOP_REPLAY_CACHE_SIZE must be positive")
+	}
+	dpopProofs.maxEntries = size
+	return nil
+}
+
+// verifyDPoP checks the DPoP proof of a request (RFC 9449). A token bound to
+// a key through cnf.jkt must be sent with the DPoP scheme and a proof signed
+// by that key; a token sent with the DPoP scheme must be bound. It returns the
+// key thumbprint when the request is sender-constrained, and "" for a plain
+// bearer token.
+func verifyDPoP(r *http.Request, token string, claims jwt.MapClaims) (string, error) {
+	jkt := boundKeyThumbprint(claims)
+	dpopScheme := strings.HasPrefix(r.Header.Get(headerAuth), headerAuthDPoPPrefix)
+	if jkt == "" {
+		if dpopScheme {
+			return "", reject(rejectDPoPUnbound)
+		}
+		return "", nil
+	}
+	// RFC 9449 section 7.1: a bound token sent as a bearer token is refused,
+	// so it cannot pass through code paths that never look at the proof.
+	if !dpopScheme {
+		return "", reject(rejectDPoPScheme)
+	}
+
+	proofs := r.Header.Values(headerDPoP)
+	if len(proofs) != 1 {
+		return "", reject(rejectDPoPMissing)
+	}
+	proofJkt, proof, err := parseDPoPProof(proofs[0])
+	if err != nil {
+		return "", err
+	}
+	if proofJkt != jkt {
+		return "", reject(rejectDPoPKeyMismatch)
+	}
+
+	if htm, _ := proof["htm"].(string); htm != r.Method {
+		return "", reject(rejectDPoPMethod)
+	}
+	if htu, _ := proof["htu"].(string); !dpopURLMatches(htu, r) {
+		return "", reject(rejectDPoPURL)
+	}
+	iat, err := proof.GetIssuedAt()
+	if err != nil || iat == nil {
+		return "", reject(rejectDPoPInvalid)
+	}
+	now := time.Now()
+	if iat.Before(now.Add(-dpopProofMaxAge)) || iat.After(now.Add(dpopProofMaxAge)) {
+		return "", reject(rejectDPoPIssuedAt)
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	if ath, _ := proof["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(tokenHash[:]) {
+		return "", reject(rejectDPoPTokenHash)
+	}
+	jti, _ := proof["jti"].(string)
+	if jti == "" {
+		return "", reject(rejectDPoPInvalid)
+	}
+	// A proof stays acceptable until iat+maxAge, so it is remembered that long.
+	if !dpopProofs.add(jkt+"."+jti, iat.Add(dpopProofMaxAge)) {
+		return "", reject(rejectDPoPReplay)
+	}
+	return jkt, nil
+}
+
+// parseDPoPProof verifies the proof's signature against the public key in its
+// jwk header and returns that key's RFC 7638 thumbprint and the proof claims.
+func parseDPoPProof(proof string) (string, jwt.MapClaims, error) {
+	var jkt string
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("unexpected typ %q", typ)
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		var marshal jwkset.JWKMarshal
+		if err := json.Unmarshal(raw, &marshal); err != nil {
+			return nil, err
+		}
+		if marshal.D != "" || marshal.P != "" {
+			return nil, fmt.Errorf("jwk holds private key material")
+		}
+		jwk, err := jwkset.NewJWKFromMarshal(marshal, jwkset.JWKMarshalOptions{}, jwkset.JWKValidateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if jkt, err = jwkThumbprint(marshal); err != nil {
+			return nil, err
+		}
+		return jwk.Key(), nil
+	}, jwt.WithValidMethods(dpopAlgorithms), jwt.WithoutClaimsValidation())
+	if err != nil {
+		return "", nil, reject(rejectDPoPInvalid)
+	}
+	return jkt, claims, nil
+}
+
+// jwkThumbprint computes the RFC 7638 SHA-256 thumbprint of a public key: the
+// hash of its required members in lexicographic order.
+func jwkThumbprint(k jwkset.JWKMarshal) (string, error) {
+	var members string
+	switch k.KTY {
+	case jwkset.KtyEC:
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.CRV, k.X, k.Y)
+	case jwkset.KtyRSA:
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case jwkset.KtyOKP:
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.CRV, k.X)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.KTY)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// boundKeyThumbprint returns the cnf.jkt claim of a sender-constrained token.
+func boundKeyThumbprint(claims jwt.MapClaims) string {
+	cnf, _ := claims["cnf"].(map[string]any)
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// dpopURLMatches compares htu with the URL the client used for the request:
+// the request URL, or its path under DPOP_PUBLIC_URL when that is set. Both
+// are normalized and compared without query and fragment, as RFC 9449
+// section 4.3 requires.
+func dpopURLMatches(htu string, r *http.Request) bool {
+	u, err := url.Parse(htu)
+	if err != nil || !u.IsAbs() || u.Opaque != "" || u.User != nil {
+		return false
+	}
+	expected := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path}
+	if r.TLS != nil {
+		expected.Scheme = "https"
+	}
+	if dpopPublicURL != nil {
+		expected.Scheme, expected.Host = dpopPublicURL.Scheme, dpopPublicURL.Host
+		expected.Path = strings.TrimSuffix(dpopPublicURL.Path, "/") + r.URL.Path
+	}
+	return normalizedHTU(u) == normalizedHTU(expected)
+}
+
+// normalizedHTU applies the syntax- and scheme-based normalization of RFC
+// 3986 section 6.2: case of scheme and host, percent-encoding, dot segments,
+// default port and empty path.
+func normalizedHTU(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(scheme == "https" && port == "443") && !(scheme == "http" && port == "80") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && p != "/" {
+		p += "/"
+	}
+	return scheme + "://" + host + (&url.URL{Path: p}).EscapedPath()
+}
+
+// dpopRequired reports whether tokens of authProvider must be DPoP-bound on
+// share-reading routes.
+func dpopRequired(authProvider string) bool {
+	return slices.Contains(dpopRequiredProviders, authProvider)
+}
+
+// dpopChallenge sets the WWW-Authenticate header of a 401 caused by DPoP.
+func dpopChallenge(w http.ResponseWriter, errorCode string) {
+	w.Header().Set(headerWWWAuthenticate, fmt.Sprintf(`DPoP error=%q, algs=%q`, errorCode, strings.Join(dpopAlgorithms, " ")))
+}
+
+// senderConstrainedMiddleware refuses share-reading requests made with a
+// bearer token of a provider listed in DPOP_REQUIRED_PROVIDERS.
+func senderConstrainedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if constrained, _ := r.Context().Value(fieldSenderConstrained).(bool); !constrained {
+			dpopChallenge(w, "invalid_token")
+			unauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dpopReplayCache remembers proof jtis until the proof could no longer be
+// accepted anyway. It only protects one replica; behind a load balancer a
+// proof can be replayed once per replica within DPOP_PROOF_MAX_AGE.
+type dpopReplayCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	seen       map[[sha256.Size]byte]time.Time
+}
+
+// add records key and reports whether it was new. When the cache is full of
+// live entries, it refuses the proof rather than forget one.
+func (c *dpopReplayCache) add(key string, expires time.Time) bool {
+	k := sha256.Sum256([]byte(key))
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp, ok := c.seen[k]; ok && now.Before(exp) {
+		return false
+	}
+	if len(c.seen) >= c.maxEntries {
+		for key, exp := range c.seen {
+			if !now.Before(exp) {
+				delete(c.seen, key)
+			}
+		}
+		if len(c.seen) >= c.maxEntries {
+			return false
+		}
+	}
+	c.seen[k] = expires
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyDPoPBoundTokenNeedsDPoPScheme(t *testing.T) {
+	claims := jwt.MapClaims{"sub": "user-1", "cnf": map[string]any{"jkt": "thumbprint"}}
+	r := httptest.NewRequest(http.MethodGet, "/v1/devices/primary", nil)
+	r.Header.Set(headerAuth, headerAuthPrefix+"token")
+	r.Header.Set(headerDPoP, "proof")
+
+	if _, err := verifyDPoP(r, "token", claims); rejectionReason(err) != rejectDPoPScheme {
+		t.Errorf("bound token with the Bearer scheme: err = %v, want %q", err, rejectDPoPScheme)
+	}
+}
+
+func TestDPoPURLMatches(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		publicURL string
+		htu       string
+		tls       bool
+		want      bool
+	}{
+		{"request URL", "", "http://hot-storage.local/v1/devices/primary", false, true},
+		{"query and fragment ignored", "", "http://hot-storage.local/v1/devices/primary?x=1#y", false, true},
+		{"scheme and host case", "", "HTTP://Hot-Storage.Local/v1/devices/primary", false, true},
+		{"default port", "", "http://hot-storage.local:80/v1/devices/primary", false, true},
+		{"other port", "", "http://hot-storage.local:8080/v1/devices/primary", false, false},
+		{"TLS scheme", "", "https://hot-storage.local/v1/devices/primary", true, true},
+		{"wrong scheme", "", "https://hot-storage.local/v1/devices/primary", false, false},
+		{"percent-encoding", "", "http://hot-storage.local/v1/%64evices/primary", false, true},
+		{"dot segments", "", "http://hot-storage.local/v1/shares/../devices/primary", false, true},
+		{"other path", "", "http://hot-storage.local/v1/devices/other", false, false},
+		{"relative", "", "/v1/devices/primary", false, false},
+		{"public URL", "https://api.example.com", "https://api.example.com/v1/devices/primary", false, true},
+		{"public URL default port", "https://api.example.com:443", "https://api.example.com/v1/devices/primary", false, true},
+		{"public URL prefix", "https://api.example.com/hot-storage/", "https://api.example.com/hot-storage/v1/devices/primary", false, true},
+		{"public URL prefix missing", "https://api.example.com/hot-storage", "https://api.example.com/v1/devices/primary", false, false},
+		{"public URL other host", "https://api.example.com", "https://hot-storage.local/v1/devices/primary", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dpopPublicURL = nil
+			if tc.publicURL != "" {
+				dpopPublicURL, _ = url.Parse(tc.publicURL)
+			}
+			t.Cleanup(func() { dpopPublicURL = nil })
+			r := httptest.NewRequest(http.MethodGet, "http://hot-storage.local/v1/devices/primary?x=2", nil)
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := dpopURLMatches(tc.htu, r); got != tc.want {
+				t.Errorf("dpopURLMatches(%q) = %v, want %v", tc.htu, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	authProviderFirebase = "firebase"
+
+	firebaseJWKSURL      = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+	firebaseIssuerPrefix = "https://securetoken.google.com/"
+
+	rejectAuthTimeInFuture = "auth_time_in_future"
+	rejectSignInProvider   = "sign_in_provider_not_allowed"
+)
+
+// accountScopedProvider is implemented by providers whose accounts are
+// stored under a different AuthProvider than the X-Auth-Provider value.
+type accountScopedProvider interface {
+	AccountProvider(claims jwt.MapClaims) string
+}
+
+// firebaseProvider validates Firebase Auth (Google Identity Platform) ID
+// tokens for any of several projects. A token's aud names its project, and
+// accounts are stored under "firebase:<project id>" because Firebase user ids
+// are only unique within a project.
+type firebaseProvider struct {
+	projects        map[string]*oidcProvider
+	signInProviders []string
+}
+
+// newFirebaseProvider configures one oidcProvider per project id, with the
+// issuer and audience Firebase assigns to that project. A non-empty
+// signInProviders restricts the accepted firebase.sign_in_provider values.
+func newFirebaseProvider(defaults oidcProviderConfig, projectIds, signInProviders []string) (*firebaseProvider, error) {
+	p := &firebaseProvider{projects: make(map[string]*oidcProvider, len(projectIds)), signInProviders: signInProviders}
+	for _, projectId := range projectIds {
+		config := defaults
+		config.Name = authProviderFirebase
+		config.JWKSURL = firebaseJWKSURL
+		config.Issuers = []string{firebaseIssuerPrefix + projectId}
+		config.Audiences = []string{projectId}
+		config.Algorithms = []string{"RS256"}
+		project, err := newOIDCProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		p.projects[projectId] = project
+	}
+	return p, nil
+}
+
+func (p *firebaseProvider) Validate(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	// Pick the project from the unverified aud; the project's provider then
+	// verifies the signature and every claim, aud included.
+	unverified := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, unverified); err != nil {
+		return "", nil, reject(rejectMalformed)
+	}
+	aud, err := unverified.GetAudience()
+	if err != nil || len(aud) != 1 {
+		return "", nil, reject(rejectAudience)
+	}
+	project, ok := p.projects[aud[0]]
+	if !ok {
+		return "", nil, reject(rejectAudience)
+	}
+
+	userId, claims, err := project.Validate(ctx, token)
+	if err != nil {
+		return "", nil, err
+	}
+	if authTime, ok := claims["auth_time"].(float64); ok && time.Unix(int64(authTime), 0).After(time.Now().Add(project.clockSkew)) {
+		return "", nil, reject(rejectAuthTimeInFuture)
+	}
+	if len(p.signInProviders) > 0 && !slices.Contains(p.signInProviders, firebaseSignInProvider(claims)) {
+		return "", nil, reject(rejectSignInProvider)
+	}
+	return userId, claims, nil
+}
+
+func (p *firebaseProvider) prefetchJWKS(ctx context.Context) error {
+	// Every project uses the same key set.
+	for _, project := range p.projects {
+		return project.prefetchJWKS(ctx)
+	}
+	return nil
+}
+
+func (p *firebaseProvider) AccountProvider(claims jwt.MapClaims) string {
+	aud, _ := claims.GetAudience()
+	return fmt.Sprintf("%s:%s", authProviderFirebase, aud[0])
+}
+
+// firebaseSignInProvider returns the firebase.sign_in_provider claim, such as
+// "password" or "google.com".
+func firebaseSignInProvider(claims jwt.MapClaims) string {
+	firebase, _ := claims["firebase"].(map[string]any)
+	signInProvider, _ := firebase["sign_in_provider"].(string)
+	return signInProvider
+}
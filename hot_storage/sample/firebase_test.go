@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestFirebaseProvider returns a provider for projectIds whose key set is
+// served locally, and a function that signs tokens with its key.
+func newTestFirebaseProvider(t *testing.T, signInProviders []string, projectIds ...string) (*firebaseProvider, func(jwt.MapClaims) string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: "firebase-test", ALG: jwkset.AlgRS256}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(jwk.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []json.RawMessage{raw}})
+	}))
+	t.Cleanup(server.Close)
+
+	p, err := newFirebaseProvider(oidcProviderConfig{}, projectIds, signInProviders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, project := range p.projects {
+		project.jwksURL = server.URL
+	}
+	return p, func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "firebase-test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+}
+
+// firebaseClaims returns the claims of a fresh ID token of project.
+func firebaseClaims(project, signInProvider string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":       firebaseIssuerPrefix + project,
+		"aud":       project,
+		"sub":       "firebase-user",
+		"iat":       float64(now.Unix()),
+		"exp":       float64(now.Add(time.Hour).Unix()),
+		"auth_time": float64(now.Add(-time.Minute).Unix()),
+		"firebase":  map[string]any{"sign_in_provider": signInProvider},
+	}
+}
+
+func TestFirebaseProjectSelection(t *testing.T) {
+	p, sign := newTestFirebaseProvider(t, nil, "project-a", "project-b")
+	ctx := context.Background()
+
+	for _, project := range []string{"project-a", "project-b"} {
+		userId, claims, err := p.Validate(ctx, sign(firebaseClaims(project, "password")))
+		if err != nil {
+			t.Fatalf("token of %s: %v", project, err)
+		}
+		if userId != "firebase-user" || p.AccountProvider(claims) != "firebase:"+project {
+			t.Errorf("token of %s: user %s, account provider %s", project, userId, p.AccountProvider(claims))
+		}
+	}
+
+	unknown := firebaseClaims("project-c", "password")
+	crossed := firebaseClaims("project-a", "password")
+	crossed["iss"] = firebaseIssuerPrefix + "project-b"
+	twoAudiences := firebaseClaims("project-a", "password")
+	twoAudiences["aud"] = []any{"project-a", "project-b"}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		reason string
+	}{
+		{"unknown project", unknown, rejectAudience},
+		{"issuer of another project", crossed, rejectIssuer},
+		{"two audiences", twoAudiences, rejectAudience},
+	}
+	for _, test := range tests {
+		if _, _, err := p.Validate(ctx, sign(test.claims)); rejectionReason(err) != test.reason {
+			t.Errorf("%s: err = %v, want %s", test.name, err, test.reason)
+		}
+	}
+	if _, _, err := p.Validate(ctx, "not-a-token"); rejectionReason(err) != rejectMalformed {
+		t.Errorf("malformed token: err = %v", err)
+	}
+}
+
+func TestFirebaseClaimChecks(t *testing.T) {
+	p, sign := newTestFirebaseProvider(t, []string{"password", "google.com"}, "project-a")
+	ctx := context.Background()
+
+	if _, _, err := p.Validate(ctx, sign(firebaseClaims("project-a", "google.com"))); err != nil {
+		t.Errorf("allowed sign-in provider: %v", err)
+	}
+	if _, _, err := p.Validate(ctx, sign(firebaseClaims("project-a", "anonymous"))); rejectionReason(err) != rejectSignInProvider {
+		t.Errorf("other sign-in provider: err = %v, want %s", err, rejectSignInProvider)
+	}
+	future := firebaseClaims("project-a", "password")
+	future["auth_time"] = float64(time.Now().Add(time.Hour).Unix())
+	if _, _, err := p.Validate(ctx, sign(future)); rejectionReason(err) != rejectAuthTimeInFuture {
+		t.Errorf("auth_time in the future: err = %v, want %s", err, rejectAuthTimeInFuture)
+	}
+}
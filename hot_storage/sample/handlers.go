@@ -1,32 +1,54 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 const (
-	contentTypeHeader = "Content-Type"
-	contentTypeJSON   = "application/json"
-	fieldUserId       = "userId"
-	fieldAuthProvider = "authProvider"
-	fieldDeviceId     = "deviceId"
-	fieldAddress      = "address"
-	actionRegister    = "REGISTER"
-	actionRecover     = "RECOVER"
+	contentTypeHeader      = "Content-Type"
+	contentTypeJSON        = "application/json"
+	fieldUserId            = "userId"
+	fieldAuthProvider      = "authProvider"
+	fieldTenant            = "tenant"
+	fieldSenderConstrained = "senderConstrained"
+	fieldClaims            = "claims"
+	fieldDeviceId          = "deviceId"
+	fieldAddress           = "address"
+	actionRegister         = "REGISTER"
+	actionRecover          = "RECOVER"
 
 	errNotFound = "resource not found"
 	errConflict = "resource already exists"
 )
 
+var (
+	// ErrAccountNotFound is returned when the account to delete does not
+	// exist or belongs to another user or tenant.
+	ErrAccountNotFound = errors.New(errNotFound)
+
+	// ErrSignerShared is returned when deleting an account whose signer is
+	// used by an account of another user.
+	ErrSignerShared = errors.New("signer is shared with another user")
+)
+
 // contentTypeMiddleware validates that POST/PUT/PATCH requests have a JSON Content-Type.
 func contentTypeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -43,30 +65,99 @@ func contentTypeMiddleware(next http.Handler) http.Handler {
 
 func listenAndServe(addr string) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/devices/init", handleInitDevice)
-	mux.HandleFunc("/v1/devices/register", handleRegisterDevice)
-	mux.HandleFunc("/v1/devices/{deviceId}", handleGetDevice)
-	mux.HandleFunc("/v1/devices", handleGetDevices)
+	mux.Handle("/v1/devices/init", shareReadHandler(handleInitDevice))
+	mux.Handle("/v1/devices/register", writeHandler(handleRegisterDevice))
+	mux.Handle("/v1/devices/{deviceId}", shareReadHandler(handleGetDevice))
+	mux.HandleFunc("GET /v1/devices", handleListDevices)
+	mux.Handle("POST /v1/devices", writeHandler(handleCreateDevice))
 
-	mux.HandleFunc("/v2/devices/create", handleCreateDeviceV2)
+	mux.Handle("/v2/devices/create", writeHandler(handleCreateDeviceV2))
 	mux.HandleFunc("/v2/accounts", handleListAccountsV2)
 	mux.HandleFunc("/v2/accounts/signer", handleGetSignerV2)
-	mux.HandleFunc("/v2/devices/recover", handleRecoverDeviceV2)
-	mux.HandleFunc("/v2/devices/register", handleRegisterDeviceV2)
-	mux.HandleFunc("/v2/accounts/import-share", handleImportShare)
+	mux.Handle("/v2/devices/recover", shareReadHandler(handleRecoverDeviceV2))
+	mux.Handle("/v2/devices/register", writeHandler(handleRegisterDeviceV2))
+	mux.Handle("/v2/accounts/import-share", writeHandler(handleImportShare))
 	mux.HandleFunc("/v2/accounts/migrated-data", handleGetMigratedAccountData)
-
-	handler := contentTypeMiddleware(authMiddleware(mux))
+	mux.Handle("DELETE /v2/accounts/{accountId}", writeHandler(handleDeleteAccountV2))
+	mux.HandleFunc("/v2/identities", handleListIdentities)
+	mux.Handle("/v2/identities/link", writeHandler(handleLinkIdentity))
+	mux.Handle("/v2/identities/{identityId}", writeHandler(handleUnlinkIdentity))
+
+	handler := contentTypeMiddleware(authMiddleware(userRateLimitMiddleware(rateLimitPolicyDefault, mux)))
+	handler = ipRateLimitMiddleware(rateLimitPolicyDefault, handler)
+	handler = sealedMiddleware(handler)
 	handler = corsMiddleware(handler)
 
 	// Health endpoint outside auth middleware
 	root := http.NewServeMux()
 	root.HandleFunc("/health", handleHealth)
+	root.HandleFunc("/v1/revocations", handleRevocationWebhook)
 	root.Handle("/", handler)
 
-	if err := http.ListenAndServe(addr, root); err != nil {
+	server := &http.Server{Addr: addr, Handler: root}
+	servers := []*http.Server{server}
+	// METRICS_ADDR serves expvar metrics at /debug/vars. Bind it to a private
+	// interface: the metrics name the auth servers in use.
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		metrics := http.NewServeMux()
+		metrics.Handle("/debug/vars", expvar.Handler())
+		metricsServer := &http.Server{Addr: metricsAddr, Handler: metrics}
+		servers = append(servers, metricsServer)
+		go func() {
+			slog.Info(fmt.Sprintf("Metrics server running on %s", metricsAddr))
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	if adminServer := newAdminServer(); adminServer != nil {
+		servers = append(servers, adminServer)
+		go func() {
+			slog.Info(fmt.Sprintf("Admin server running on %s", adminServer.Addr))
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("admin server failed: %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, s := range servers {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				slog.Error(fmt.Sprintf("failed to shut down server: %v", err))
+			}
+		}
+	}()
+
+	var err error
+	if serverTLS != nil {
+		server.TLSConfig = serverTLS
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %v", err)
 	}
+	jwks.close()
+	slog.Info("Server stopped")
+}
+
+// shareReadHandler wraps the handlers that can return a decrypted share with
+// the policies that guard share reads.
+func shareReadHandler(handler http.HandlerFunc) http.Handler {
+	return rateLimitMiddleware(rateLimitPolicyShare, senderConstrainedMiddleware(handler))
+}
+
+// writeHandler wraps the handlers that create accounts or devices, or link
+// identities to them.
+func writeHandler(handler http.HandlerFunc) http.Handler {
+	return rateLimitMiddleware(rateLimitPolicyWrite, handler)
 }
 
 func handleRegisterDeviceV2(w http.ResponseWriter, r *http.Request) {
@@ -100,19 +191,31 @@ func handleRegisterDeviceV2(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	encryptedShare, err := encryptShare(req.Share)
+	deviceId := uuid.NewString()
+	encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), newShareBinding(deviceId, account))
 	if err != nil {
 		http.Error(w, "failed to encrypt share", http.StatusInternalServerError)
 		return
 	}
 
 	device := Device{
-		ID:        uuid.NewString(),
+		ID:        deviceId,
 		Share:     encryptedShare,
 		IsPrimary: false, // with this endpoint we save only "secondary" shares
 		SignerId:  account.SignerId,
 	}
-	if err := db.Create(&device).Error; err != nil {
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkDeviceQuota(tx, account); err != nil {
+			return err
+		}
+		return tx.Create(&device).Error
+	})
+	var quotaErr *quotaError
+	if errors.As(txErr, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
+	if txErr != nil {
 		http.Error(w, "failed to register device", http.StatusInternalServerError)
 		return
 	}
@@ -174,24 +277,28 @@ func handleRecoverDeviceV2(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	decryptedShare, err := decryptShare(device.Share)
+	if err := checkShareRead(r, shareEndpointRecover, account, device.ID); err != nil {
+		refuseShareRead(w, err)
+		return
+	}
+
+	decryptedShare, err := decryptShare(r.Context(), device.Share, newShareBinding(device.ID, account))
 	if err != nil {
 		http.Error(w, "failed to decrypt share", http.StatusInternalServerError)
 		return
 	}
+	defer decryptedShare.Wipe()
 
 	resp := RecoverResponseV2{
 		Id:            device.ID,
 		Account:       account.ID,
 		SignerAddress: account.Address,
 		Signer:        fmt.Sprintf("sig_%s", account.SignerId),
-		Share:         decryptedShare,
 		IsPrimary:     device.IsPrimary,
 		User:          userId,
 	}
 
-	w.Header().Set(contentTypeHeader, contentTypeJSON)
-	json.NewEncoder(w).Encode(resp)
+	writeShareJSON(w, resp, decryptedShare)
 }
 
 func handleListAccountsV2(w http.ResponseWriter, r *http.Request) {
@@ -296,6 +403,7 @@ func handleCreateDeviceV2(w http.ResponseWriter, r *http.Request) {
 	}
 	userId := r.Context().Value(fieldUserId).(string)
 	authProvider := r.Context().Value(fieldAuthProvider).(string)
+	tenant := r.Context().Value(fieldTenant).(string)
 
 	var resp EmbeddedResponse
 	txErr := db.Transaction(func(tx *gorm.DB) error {
@@ -310,6 +418,10 @@ func handleCreateDeviceV2(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("conflict")
 		}
 
+		if err := checkAccountQuota(tx, userId, authProvider, req.ChainId); err != nil {
+			return err
+		}
+
 		var signerUuid string
 		if req.SignerUuid != nil {
 			signerUuid = *req.SignerUuid
@@ -322,13 +434,24 @@ func handleCreateDeviceV2(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("failed to create a signer")
 		}
 
-		encryptedShare, err := encryptShare(req.Share)
+		newAccount := Account{
+			ID:           uuid.NewString(),
+			Address:      req.Address,
+			Username:     userId,
+			ChainId:      req.ChainId,
+			AuthProvider: authProvider,
+			SignerId:     signer.ID,
+			Tenant:       tenant,
+		}
+
+		deviceId := uuid.NewString()
+		encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), newShareBinding(deviceId, newAccount))
 		if err != nil {
 			return fmt.Errorf("failed to encrypt share")
 		}
 
 		device := Device{
-			ID:        uuid.NewString(),
+			ID:        deviceId,
 			Share:     encryptedShare,
 			IsPrimary: true,
 			SignerId:  signer.ID,
@@ -337,14 +460,6 @@ func handleCreateDeviceV2(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("failed to register device")
 		}
 
-		newAccount := Account{
-			ID:           uuid.NewString(),
-			Address:      req.Address,
-			Username:     userId,
-			ChainId:      req.ChainId,
-			AuthProvider: authProvider,
-			SignerId:     signer.ID,
-		}
 		if err := tx.Create(&newAccount).Error; err != nil {
 			return fmt.Errorf("failed to create an account")
 		}
@@ -362,6 +477,11 @@ func handleCreateDeviceV2(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	var quotaErr *quotaError
+	if errors.As(txErr, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
 	if txErr != nil {
 		if txErr.Error() == "conflict" {
 			http.Error(w, errConflict, http.StatusConflict)
@@ -419,11 +539,17 @@ func handleInitDevice(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		decryptedShare, err := decryptShare(device.Share)
+		if err := checkShareRead(r, shareEndpointInitRecover, account, device.ID); err != nil {
+			refuseShareRead(w, err)
+			return
+		}
+
+		decryptedShare, err := decryptShare(r.Context(), device.Share, newShareBinding(device.ID, account))
 		if err != nil {
 			http.Error(w, "failed to decrypt share", http.StatusInternalServerError)
 			return
 		}
+		defer decryptedShare.Wipe()
 
 		nextAction = NextAction{
 			NextAction: actionRecover,
@@ -431,9 +557,11 @@ func handleInitDevice(w http.ResponseWriter, r *http.Request) {
 			Embedded: &Embedded{
 				ChainID: req.ChainID,
 				Address: &account.Address,
-				Share:   &decryptedShare,
+				Share:   &secret{},
 			},
 		}
+		writeShareJSON(w, nextAction, decryptedShare)
+		return
 	}
 
 	w.Header().Set(contentTypeHeader, contentTypeJSON)
@@ -449,6 +577,7 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 
 	userId := r.Context().Value(fieldUserId).(string)
 	authProvider := r.Context().Value(fieldAuthProvider).(string)
+	tenant := r.Context().Value(fieldTenant).(string)
 
 	var req RegisterEmbeddedRequest
 	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
@@ -468,13 +597,18 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !isPrimary {
-			encryptedShare, err := encryptShare(req.Share)
+			if err := checkDeviceQuota(tx, account); err != nil {
+				return err
+			}
+
+			deviceId := uuid.NewString()
+			encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), newShareBinding(deviceId, account))
 			if err != nil {
 				return fmt.Errorf("failed to encrypt share")
 			}
 
 			device := Device{
-				ID:        uuid.NewString(),
+				ID:        deviceId,
 				Share:     encryptedShare,
 				IsPrimary: false,
 				SignerId:  account.SignerId,
@@ -491,6 +625,10 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 				Account:  account.ID,
 			}
 		} else {
+			if err := checkAccountQuota(tx, userId, authProvider, req.ChainID); err != nil {
+				return err
+			}
+
 			var signerUuid string
 			if req.SignerUuid != nil {
 				signerUuid = *req.SignerUuid
@@ -503,13 +641,24 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 				return fmt.Errorf("failed to save signer")
 			}
 
-			encryptedShare, err := encryptShare(req.Share)
+			account := Account{
+				ID:           uuid.NewString(),
+				Address:      req.Address,
+				Username:     userId,
+				ChainId:      req.ChainID,
+				AuthProvider: authProvider,
+				SignerId:     signer.ID,
+				Tenant:       tenant,
+			}
+
+			deviceId := uuid.NewString()
+			encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), newShareBinding(deviceId, account))
 			if err != nil {
 				return fmt.Errorf("failed to encrypt share")
 			}
 
 			device := Device{
-				ID:        uuid.NewString(),
+				ID:        deviceId,
 				Share:     encryptedShare,
 				IsPrimary: true,
 				SignerId:  signer.ID,
@@ -518,14 +667,6 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 				return fmt.Errorf("failed to register device")
 			}
 
-			account := Account{
-				ID:           uuid.NewString(),
-				Address:      req.Address,
-				Username:     userId,
-				ChainId:      req.ChainID,
-				AuthProvider: authProvider,
-				SignerId:     signer.ID,
-			}
 			if err := tx.Create(&account).Error; err != nil {
 				return fmt.Errorf("failed to save account")
 			}
@@ -542,6 +683,11 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	var quotaErr *quotaError
+	if errors.As(txErr, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
 	if txErr != nil {
 		http.Error(w, txErr.Error(), http.StatusInternalServerError)
 		return
@@ -554,7 +700,7 @@ func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
 func handleGetDevice(w http.ResponseWriter, r *http.Request) {
 	deviceId := r.PathValue(fieldDeviceId)
 	if deviceId == "" {
-		handleGetDevices(w, r)
+		http.NotFound(w, r)
 		return
 	}
 
@@ -578,22 +724,32 @@ func handleGetDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	decryptedShare, err := decryptShare(device.Share)
+	var account Account
+	if err := db.First(&account, "signer_id = ? AND username = ? AND auth_provider = ?", device.SignerId, userId, authProvider).Error; err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := checkShareRead(r, shareEndpointGetDevice, account, device.ID); err != nil {
+		refuseShareRead(w, err)
+		return
+	}
+
+	decryptedShare, err := decryptShare(r.Context(), device.Share, newShareBinding(device.ID, account))
 	if err != nil {
 		http.Error(w, "failed to decrypt share", http.StatusInternalServerError)
 		return
 	}
+	defer decryptedShare.Wipe()
 
 	resp := DeviceResponse{
 		ID:        device.ID,
 		Object:    "device",
 		CreatedAt: device.CreatedAt.Unix(),
-		Share:     decryptedShare,
 		IsPrimary: device.IsPrimary,
 	}
 
-	w.Header().Set(contentTypeHeader, contentTypeJSON)
-	json.NewEncoder(w).Encode(resp)
+	writeShareJSON(w, resp, decryptedShare)
 }
 
 func handleGetPrimaryDevice(w http.ResponseWriter, r *http.Request) {
@@ -617,42 +773,40 @@ func handleGetPrimaryDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	decryptedShare, err := decryptShare(device.Share)
+	if err := checkShareRead(r, shareEndpointGetPrimaryDevice, account, device.ID); err != nil {
+		refuseShareRead(w, err)
+		return
+	}
+
+	decryptedShare, err := decryptShare(r.Context(), device.Share, newShareBinding(device.ID, account))
 	if err != nil {
 		http.Error(w, "failed to decrypt share", http.StatusInternalServerError)
 		return
 	}
+	defer decryptedShare.Wipe()
 
 	resp := DeviceResponse{
 		ID:        device.ID,
 		Object:    "device",
 		CreatedAt: device.CreatedAt.Unix(),
 		Address:   account.Address,
-		Share:     decryptedShare,
 		IsPrimary: device.IsPrimary,
 	}
 
-	w.Header().Set(contentTypeHeader, contentTypeJSON)
-	json.NewEncoder(w).Encode(resp)
+	writeShareJSON(w, resp, decryptedShare)
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	if isSealed() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"sealed"}`))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"ok"}`))
 }
 
-func handleGetDevices(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		handleListDevices(w, r)
-	case http.MethodPost:
-		handleCreateDevice(w, r)
-	default:
-		http.NotFound(w, r)
-	}
-}
-
 func handleListDevices(w http.ResponseWriter, r *http.Request) {
 	userId := r.Context().Value(fieldUserId).(string)
 	authProvider := r.Context().Value(fieldAuthProvider).(string)
@@ -730,6 +884,7 @@ func handleImportShare(w http.ResponseWriter, r *http.Request) {
 
 	userId := r.Context().Value(fieldUserId).(string)
 	authProvider := r.Context().Value(fieldAuthProvider).(string)
+	tenant := r.Context().Value(fieldTenant).(string)
 
 	var resp ImportShareResponse
 	txErr := db.Transaction(func(tx *gorm.DB) error {
@@ -739,6 +894,10 @@ func handleImportShare(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("conflict")
 		}
 
+		if err := checkAccountQuota(tx, userId, authProvider, req.ChainId); err != nil {
+			return err
+		}
+
 		signerId := strings.TrimPrefix(req.SignerId, "sig_")
 		if signerId == "" {
 			signerId = uuid.NewString()
@@ -749,13 +908,15 @@ func handleImportShare(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("failed to create signer")
 		}
 
-		encryptedShare, err := encryptShare(req.Share)
+		deviceId := uuid.NewString()
+		binding := shareBinding{DeviceID: deviceId, SignerID: signer.ID, Username: userId, AuthProvider: authProvider, Tenant: tenant}
+		encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), binding)
 		if err != nil {
 			return fmt.Errorf("failed to encrypt share")
 		}
 
 		device := Device{
-			ID:        uuid.NewString(),
+			ID:        deviceId,
 			Share:     encryptedShare,
 			IsPrimary: true,
 			SignerId:  signer.ID,
@@ -787,6 +948,7 @@ func handleImportShare(w http.ResponseWriter, r *http.Request) {
 			ChainId:      req.ChainId,
 			SignerId:     signer.ID,
 			AuthProvider: authProvider,
+			Tenant:       tenant,
 		}
 		if err := tx.Create(&newAccount).Error; err != nil {
 			return fmt.Errorf("failed to create account")
@@ -810,6 +972,11 @@ func handleImportShare(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	var quotaErr *quotaError
+	if errors.As(txErr, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
 	if txErr != nil {
 		if txErr.Error() == "conflict" {
 			http.Error(w, errConflict, http.StatusConflict)
@@ -863,6 +1030,113 @@ func handleGetMigratedAccountData(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// handleDeleteAccountV2 erases an account together with its signer: every
+// device share of the signer, every account using it and their migrated data
+// are hard-deleted, so the shares cannot be recovered through the service.
+// A signer shared with another user's account is refused.
+func handleDeleteAccountV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _ := r.Context().Value(fieldClaims).(jwt.MapClaims)
+	if refusal := checkStepUp(claims, stepUpDeleteAccount, time.Now()); refusal != nil {
+		refuseStepUp(w, refusal)
+		return
+	}
+
+	accountId := r.PathValue("accountId")
+	userId := r.Context().Value(fieldUserId).(string)
+	authProvider := r.Context().Value(fieldAuthProvider).(string)
+	tenant := r.Context().Value(fieldTenant).(string)
+
+	var resp DeletionReceiptResponse
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		var account Account
+		if err := tx.First(&account, "id = ? AND username = ? AND auth_provider = ?", accountId, userId, authProvider).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrAccountNotFound
+			}
+			return fmt.Errorf("failed to select account: %w", err)
+		}
+		if account.Tenant != "" && account.Tenant != tenant {
+			return ErrAccountNotFound
+		}
+
+		var signerAccounts []Account
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Find(&signerAccounts, "signer_id = ?", account.SignerId).Error; err != nil {
+			return fmt.Errorf("failed to lock accounts of signer: %w", err)
+		}
+		for _, other := range signerAccounts {
+			if other.Username != userId || other.AuthProvider != authProvider {
+				return ErrSignerShared
+			}
+		}
+
+		var devices []Device
+		if err := tx.Unscoped().Clauses(clause.Returning{}).Where("signer_id = ?", account.SignerId).Delete(&devices).Error; err != nil {
+			return fmt.Errorf("failed to delete devices: %w", err)
+		}
+		var accounts []Account
+		if err := tx.Unscoped().Clauses(clause.Returning{}).Where("signer_id = ?", account.SignerId).Delete(&accounts).Error; err != nil {
+			return fmt.Errorf("failed to delete accounts: %w", err)
+		}
+
+		accountIds := make([]string, 0, len(accounts))
+		for _, acc := range accounts {
+			accountIds = append(accountIds, acc.ID)
+		}
+		deviceIds := make([]string, 0, len(devices))
+		for _, device := range devices {
+			deviceIds = append(deviceIds, device.ID)
+		}
+
+		if err := tx.Unscoped().Where("id IN ?", accountIds).Delete(&MigratedAccountData{}).Error; err != nil {
+			return fmt.Errorf("failed to delete migrated account data: %w", err)
+		}
+		if err := tx.Unscoped().Delete(&Signer{}, "id = ?", account.SignerId).Error; err != nil {
+			return fmt.Errorf("failed to delete signer: %w", err)
+		}
+
+		receipt := DeletionReceipt{
+			ID:         uuid.NewString(),
+			SignerId:   account.SignerId,
+			AccountIds: strings.Join(accountIds, ","),
+			DeviceIds:  strings.Join(deviceIds, ","),
+		}
+		if err := tx.Create(&receipt).Error; err != nil {
+			return fmt.Errorf("failed to record deletion receipt: %w", err)
+		}
+
+		resp = DeletionReceiptResponse{
+			ID:        receipt.ID,
+			Object:    "deletion_receipt",
+			Signer:    fmt.Sprintf("sig_%s", receipt.SignerId),
+			Accounts:  accountIds,
+			Devices:   deviceIds,
+			DeletedAt: receipt.CreatedAt.Unix(),
+		}
+		return nil
+	})
+
+	switch {
+	case errors.Is(txErr, ErrAccountNotFound):
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	case errors.Is(txErr, ErrSignerShared):
+		http.Error(w, ErrSignerShared.Error(), http.StatusConflict)
+		return
+	case txErr != nil:
+		slog.Error(fmt.Sprintf("failed to delete account: %v", txErr))
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("account deleted", slog.String("receiptId", resp.ID), slog.String("signerId", resp.Signer), slog.Int("devices", len(resp.Devices)))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func handleCreateDevice(w http.ResponseWriter, r *http.Request) {
 	var req CreateDeviceRequest
 	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
@@ -883,19 +1157,31 @@ func handleCreateDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptedShare, err := encryptShare(req.Share)
+	deviceId := uuid.NewString()
+	encryptedShare, err := encryptShare(r.Context(), []byte(req.Share), newShareBinding(deviceId, account))
 	if err != nil {
 		http.Error(w, "failed to encrypt share", http.StatusInternalServerError)
 		return
 	}
 
 	device := Device{
-		ID:        uuid.NewString(),
+		ID:        deviceId,
 		Share:     encryptedShare,
 		IsPrimary: false,
 		SignerId:  account.SignerId,
 	}
-	if err := db.Create(&device).Error; err != nil {
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkDeviceQuota(tx, account); err != nil {
+			return err
+		}
+		return tx.Create(&device).Error
+	})
+	var quotaErr *quotaError
+	if errors.As(txErr, &quotaErr) {
+		writeQuotaError(w, quotaErr)
+		return
+	}
+	if txErr != nil {
 		http.Error(w, "failed to create device", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// createTestAccount stores an account of userId on signerId, with a signer
+// and a device share when the signer is new.
+func createTestAccount(t *testing.T, userId, signerId string) Account {
+	t.Helper()
+	if err := db.FirstOrCreate(&Signer{ID: signerId}).Error; err != nil {
+		t.Fatal(err)
+	}
+	device := Device{ID: uuid.NewString(), Share: "sealed-share", IsPrimary: true, SignerId: signerId}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	account := Account{ID: uuid.NewString(), Address: uuid.NewString(), Username: userId, AuthProvider: authProviderDefault, ChainId: 1, SignerId: signerId}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&MigratedAccountData{ID: account.ID, Wallet: "wallet", FormerOwnerUser: userId}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func deleteAccount(userId, accountId string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/v2/accounts/"+accountId, nil)
+	r.SetPathValue("accountId", accountId)
+	w := httptest.NewRecorder()
+	handleDeleteAccountV2(w, withIdentity(r, userId, authProviderDefault, freshClaims()))
+	return w
+}
+
+func countRows(t *testing.T, model any, query string, args ...any) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Unscoped().Model(model).Where(query, args...).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDeleteAccount(t *testing.T) {
+	newTestDB(t)
+	account := createTestAccount(t, "alice", "signer-1")
+	sibling := createTestAccount(t, "alice", "signer-1")
+	kept := createTestAccount(t, "alice", "signer-2")
+
+	w := deleteAccount("alice", account.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp DeletionReceiptResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Accounts) != 2 || len(resp.Devices) != 2 {
+		t.Errorf("receipt lists %d accounts and %d devices, want 2 and 2", len(resp.Accounts), len(resp.Devices))
+	}
+
+	if n := countRows(t, &Device{}, "signer_id = ?", "signer-1"); n != 0 {
+		t.Errorf("%d devices of the signer remain", n)
+	}
+	if n := countRows(t, &Account{}, "signer_id = ?", "signer-1"); n != 0 {
+		t.Errorf("%d accounts of the signer remain", n)
+	}
+	if n := countRows(t, &Signer{}, "id = ?", "signer-1"); n != 0 {
+		t.Errorf("signer remains")
+	}
+	if n := countRows(t, &MigratedAccountData{}, "id IN ?", []string{account.ID, sibling.ID}); n != 0 {
+		t.Errorf("%d migrated data rows remain", n)
+	}
+	if n := countRows(t, &DeletionReceipt{}, "id = ? AND signer_id = ?", resp.ID, "signer-1"); n != 1 {
+		t.Errorf("no deletion receipt %s", resp.ID)
+	}
+
+	if n := countRows(t, &Account{}, "id = ?", kept.ID); n != 1 {
+		t.Errorf("account on another signer was deleted")
+	}
+	if n := countRows(t, &Device{}, "signer_id = ?", "signer-2"); n != 1 {
+		t.Errorf("device of another signer was deleted")
+	}
+}
+
+func TestDeleteAccountRefusals(t *testing.T) {
+	newTestDB(t)
+	account := createTestAccount(t, "alice", "shared-signer")
+	createTestAccount(t, "bob", "shared-signer")
+
+	w := deleteAccount("alice", account.ID)
+	if w.Code != http.StatusConflict || w.Body.String() != ErrSignerShared.Error()+"\n" {
+		t.Errorf("shared signer: status %d: %q, want 409 %q", w.Code, w.Body, ErrSignerShared)
+	}
+	if n := countRows(t, &Device{}, "signer_id = ?", "shared-signer"); n != 2 {
+		t.Errorf("%d devices left after a refused delete, want 2", n)
+	}
+	if n := countRows(t, &DeletionReceipt{}, "1 = 1"); n != 0 {
+		t.Errorf("receipt recorded for a refused delete")
+	}
+
+	if w := deleteAccount("bob", account.ID); w.Code != http.StatusNotFound {
+		t.Errorf("another user's account: status %d, want 404", w.Code)
+	}
+	if w := deleteAccount("alice", uuid.NewString()); w.Code != http.StatusNotFound {
+		t.Errorf("unknown account: status %d, want 404", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/v2/accounts/"+account.ID, nil)
+	r.SetPathValue("accountId", account.ID)
+	w = httptest.NewRecorder()
+	handleDeleteAccountV2(w, withIdentity(r, "alice", authProviderDefault, nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get(headerWWWAuthenticate) == "" {
+		t.Errorf("without a recent sign-in: status %d, want 401 with a challenge", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrIdentityHasAccounts is returned when linking an identity that owns
+	// accounts of its own.
+	ErrIdentityHasAccounts = errors.New("identity already owns accounts")
+
+	// ErrIdentityLinked is returned when linking an identity that is linked
+	// to another user or has identities linked to it.
+	ErrIdentityLinked = errors.New("identity is already linked")
+)
+
+// resolveLinkedIdentity replaces a linked identity by the owner it is linked
+// to, so that every account lookup in the handlers finds the owner's accounts.
+func resolveLinkedIdentity(ctx context.Context, identity *authIdentity) error {
+	var link LinkedIdentity
+	err := db.WithContext(ctx).First(&link, "username = ? AND auth_provider = ?", identity.UserID, identity.AuthProvider).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve linked identity: %w", err)
+	}
+	slog.Debug("resolved linked identity", slog.String("identityId", link.ID))
+	identity.UserID, identity.AuthProvider = link.OwnerUsername, link.OwnerAuthProvider
+	return nil
+}
+
+// handleLinkIdentity links a second auth provider identity to the caller. The
+// request is authenticated as the owner; the body carries a token of the
+// identity to link, which must be valid too. An identity that already owns
+// accounts or is linked elsewhere cannot be linked.
+func handleLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _ := r.Context().Value(fieldClaims).(jwt.MapClaims)
+	if refusal := checkStepUp(claims, stepUpLinkIdentity, time.Now()); refusal != nil {
+		refuseStepUp(w, refusal)
+		return
+	}
+
+	var req LinkIdentityRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userId := r.Context().Value(fieldUserId).(string)
+	authProvider := r.Context().Value(fieldAuthProvider).(string)
+	tenant := r.Context().Value(fieldTenant).(string)
+
+	linked, err := authenticateToken(r.Context(), req.Token, req.AuthProvider)
+	if err != nil {
+		http.Error(w, "invalid identity token", http.StatusBadRequest)
+		return
+	}
+	if linked.UserID == "" || (linked.UserID == userId && linked.AuthProvider == authProvider) {
+		http.Error(w, "invalid identity token", http.StatusBadRequest)
+		return
+	}
+	// Once linked, requests of the identity carry the owner's tenant, unless
+	// the tenant comes from a claim of its token.
+	linkedTenant, err := resolveTenant(&authIdentity{UserID: userId, AuthProvider: authProvider, Claims: linked.Claims})
+	if err != nil || linkedTenant != tenant {
+		http.Error(w, "identity belongs to another tenant", http.StatusForbidden)
+		return
+	}
+
+	link := LinkedIdentity{
+		ID:                uuid.NewString(),
+		Username:          linked.UserID,
+		AuthProvider:      linked.AuthProvider,
+		OwnerUsername:     userId,
+		OwnerAuthProvider: authProvider,
+	}
+	txErr := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Account{}).Where("username = ? AND auth_provider = ?", link.Username, link.AuthProvider).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to count accounts of identity: %w", err)
+		}
+		if count > 0 {
+			return ErrIdentityHasAccounts
+		}
+		if err := tx.Model(&LinkedIdentity{}).Where("(username = ? AND auth_provider = ?) OR (owner_username = ? AND owner_auth_provider = ?)",
+			link.Username, link.AuthProvider, link.Username, link.AuthProvider).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to count links of identity: %w", err)
+		}
+		if count > 0 {
+			return ErrIdentityLinked
+		}
+		// The unique index on the identity refuses a concurrent link.
+		if err := tx.Create(&link).Error; err != nil {
+			return fmt.Errorf("%w: %v", ErrIdentityLinked, err)
+		}
+		return nil
+	})
+
+	switch {
+	case errors.Is(txErr, ErrIdentityHasAccounts):
+		http.Error(w, ErrIdentityHasAccounts.Error(), http.StatusConflict)
+		return
+	case errors.Is(txErr, ErrIdentityLinked):
+		http.Error(w, ErrIdentityLinked.Error(), http.StatusConflict)
+		return
+	case txErr != nil:
+		slog.Error(fmt.Sprintf("failed to link identity: %v", txErr))
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("identity linked", slog.String("identityId", link.ID), slog.String("authProvider", link.AuthProvider))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(newLinkedIdentityResponse(link))
+}
+
+// handleUnlinkIdentity removes one of the caller's linked identities. Its
+// tokens then authenticate as a separate user again.
+func handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _ := r.Context().Value(fieldClaims).(jwt.MapClaims)
+	if refusal := checkStepUp(claims, stepUpUnlinkIdentity, time.Now()); refusal != nil {
+		refuseStepUp(w, refusal)
+		return
+	}
+
+	identityId := r.PathValue("identityId")
+	userId := r.Context().Value(fieldUserId).(string)
+	authProvider := r.Context().Value(fieldAuthProvider).(string)
+
+	var link LinkedIdentity
+	if err := db.First(&link, "id = ? AND owner_username = ? AND owner_auth_provider = ?", identityId, userId, authProvider).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, errNotFound, http.StatusNotFound)
+			return
+		} else {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Hard-deleted so that the identity can be linked again.
+	if err := db.Unscoped().Delete(&link).Error; err != nil {
+		http.Error(w, "failed to unlink identity", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("identity unlinked", slog.String("identityId", link.ID), slog.String("authProvider", link.AuthProvider))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(newLinkedIdentityResponse(link))
+}
+
+func handleListIdentities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userId := r.Context().Value(fieldUserId).(string)
+	authProvider := r.Context().Value(fieldAuthProvider).(string)
+
+	var links []LinkedIdentity
+	if err := db.Where("owner_username = ? AND owner_auth_provider = ?", userId, authProvider).Order("created_at").Find(&links).Error; err != nil {
+		http.Error(w, "failed to select linked identities", http.StatusInternalServerError)
+		return
+	}
+
+	data := make([]LinkedIdentityResponse, 0, len(links))
+	for _, link := range links {
+		data = append(data, newLinkedIdentityResponse(link))
+	}
+
+	resp := LinkedIdentityListResponse{
+		Object: "list",
+		URL:    "/v2/identities",
+		Data:   data,
+		Start:  0,
+		End:    len(data) - 1,
+		Total:  len(data),
+	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newLinkedIdentityResponse(link LinkedIdentity) LinkedIdentityResponse {
+	return LinkedIdentityResponse{
+		ID:           link.ID,
+		Object:       "linked_identity",
+		Username:     link.Username,
+		AuthProvider: link.AuthProvider,
+		CreatedAt:    link.CreatedAt.Unix(),
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const authProviderTest = "test"
+
+// staticTokenValidator accepts the tokens it maps to a user id.
+type staticTokenValidator map[string]string
+
+func (v staticTokenValidator) Validate(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	userId, ok := v[token]
+	if !ok {
+		return "", nil, reject(rejectSignature)
+	}
+	return userId, jwt.MapClaims{"sub": userId, "iat": float64(time.Now().Unix())}, nil
+}
+
+// useTestProvider registers tokens under the "test" auth provider for the
+// length of the test.
+func useTestProvider(t *testing.T, tokens staticTokenValidator) {
+	t.Helper()
+	authProviders[authProviderTest] = tokens
+	t.Cleanup(func() { delete(authProviders, authProviderTest) })
+}
+
+// withIdentity returns r as authMiddleware passes it on for the user.
+func withIdentity(r *http.Request, userId, authProvider string, claims jwt.MapClaims) *http.Request {
+	ctx := context.WithValue(r.Context(), fieldUserId, userId)
+	ctx = context.WithValue(ctx, fieldAuthProvider, authProvider)
+	ctx = context.WithValue(ctx, fieldTenant, "")
+	ctx = context.WithValue(ctx, fieldClaims, claims)
+	return r.WithContext(ctx)
+}
+
+// freshClaims are claims of a user who just authenticated.
+func freshClaims() jwt.MapClaims {
+	return jwt.MapClaims{"auth_time": float64(time.Now().Unix())}
+}
+
+func linkIdentity(t *testing.T, token string, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	t.Helper()
+	body := strings.NewReader(`{"token":"` + token + `","authProvider":"` + authProviderTest + `"}`)
+	r := withIdentity(httptest.NewRequest(http.MethodPost, "/v2/identities", body), "owner", authProviderDefault, claims)
+	w := httptest.NewRecorder()
+	handleLinkIdentity(w, r)
+	return w
+}
+
+func TestLinkIdentity(t *testing.T) {
+	newTestDB(t)
+	useTestProvider(t, staticTokenValidator{"second-token": "second"})
+
+	w := linkIdentity(t, "second-token", freshClaims())
+	if w.Code != http.StatusOK {
+		t.Fatalf("link: status %d: %s", w.Code, w.Body)
+	}
+	var resp LinkedIdentityResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Username != "second" || resp.AuthProvider != authProviderTest {
+		t.Errorf("linked %s/%s, want second/%s", resp.Username, resp.AuthProvider, authProviderTest)
+	}
+
+	identity := &authIdentity{UserID: "second", AuthProvider: authProviderTest}
+	if err := resolveLinkedIdentity(context.Background(), identity); err != nil {
+		t.Fatalf("resolveLinkedIdentity: %v", err)
+	}
+	if identity.UserID != "owner" || identity.AuthProvider != authProviderDefault {
+		t.Errorf("resolved to %s/%s, want owner/%s", identity.UserID, identity.AuthProvider, authProviderDefault)
+	}
+
+	other := &authIdentity{UserID: "third", AuthProvider: authProviderTest}
+	if err := resolveLinkedIdentity(context.Background(), other); err != nil {
+		t.Fatalf("resolveLinkedIdentity: %v", err)
+	}
+	if other.UserID != "third" || other.AuthProvider != authProviderTest {
+		t.Errorf("unlinked identity resolved to %s/%s", other.UserID, other.AuthProvider)
+	}
+}
+
+func TestLinkIdentityConflicts(t *testing.T) {
+	newTestDB(t)
+	useTestProvider(t, staticTokenValidator{"linked-token": "linked", "funded-token": "funded"})
+
+	if w := linkIdentity(t, "linked-token", freshClaims()); w.Code != http.StatusOK {
+		t.Fatalf("first link: status %d: %s", w.Code, w.Body)
+	}
+	w := linkIdentity(t, "linked-token", freshClaims())
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), ErrIdentityLinked.Error()) {
+		t.Errorf("second link: status %d: %s, want 409 %q", w.Code, w.Body, ErrIdentityLinked)
+	}
+
+	account := Account{ID: uuid.NewString(), Address: "0xfunded", Username: "funded", AuthProvider: authProviderTest, ChainId: 1}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	w = linkIdentity(t, "funded-token", freshClaims())
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), ErrIdentityHasAccounts.Error()) {
+		t.Errorf("link of identity with accounts: status %d: %s, want 409 %q", w.Code, w.Body, ErrIdentityHasAccounts)
+	}
+}
+
+func TestLinkIdentityRequiresStepUp(t *testing.T) {
+	newTestDB(t)
+	useTestProvider(t, staticTokenValidator{"second-token": "second"})
+
+	stale := jwt.MapClaims{"auth_time": float64(time.Now().Add(-time.Hour).Unix())}
+	w := linkIdentity(t, "second-token", stale)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", w.Code)
+	}
+	if challenge := w.Header().Get(headerWWWAuthenticate); !strings.Contains(challenge, `error="insufficient_user_authentication"`) || !strings.Contains(challenge, "max_age=600") {
+		t.Errorf("WWW-Authenticate = %q", challenge)
+	}
+	var resp StepUpErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != errStepUpRequired || resp.MaxAge != 600 {
+		t.Errorf("body = %+v", resp)
+	}
+
+	var count int64
+	db.Model(&LinkedIdentity{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d identities linked without step-up", count)
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	newTestDB(t)
+	useTestProvider(t, staticTokenValidator{"second-token": "second"})
+
+	w := linkIdentity(t, "second-token", freshClaims())
+	if w.Code != http.StatusOK {
+		t.Fatalf("link: status %d: %s", w.Code, w.Body)
+	}
+	var link LinkedIdentityResponse
+	if err := json.NewDecoder(w.Body).Decode(&link); err != nil {
+		t.Fatal(err)
+	}
+
+	unlink := func(userId string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/v2/identities/"+link.ID, nil)
+		r.SetPathValue("identityId", link.ID)
+		w := httptest.NewRecorder()
+		handleUnlinkIdentity(w, withIdentity(r, userId, authProviderDefault, freshClaims()))
+		return w
+	}
+	if w := unlink("someone-else"); w.Code != http.StatusNotFound {
+		t.Errorf("unlink by another user: status %d, want 404", w.Code)
+	}
+	if w := unlink("owner"); w.Code != http.StatusOK {
+		t.Fatalf("unlink: status %d: %s", w.Code, w.Body)
+	}
+
+	identity := &authIdentity{UserID: "second", AuthProvider: authProviderTest}
+	if err := resolveLinkedIdentity(context.Background(), identity); err != nil {
+		t.Fatalf("resolveLinkedIdentity: %v", err)
+	}
+	if identity.UserID != "second" {
+		t.Errorf("unlinked identity still resolves to %s", identity.UserID)
+	}
+	// Unlinking hard-deletes, so the identity can be linked again.
+	if w := linkIdentity(t, "second-token", freshClaims()); w.Code != http.StatusOK {
+		t.Errorf("link after unlink: status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	opaqueTokensIntrospection = "introspection"
+	opaqueTokensSession       = "session"
+
+	defaultSessionCookie = "better-auth.session_token"
+
+	rejectInactive = "inactive"
+)
+
+// opaqueTokenProvider validates the default provider's non-JWT tokens by
+// asking the auth service about them:
+//
+//	introspection  RFC 7662 POST to the introspection endpoint
+//	session        better-auth GET /api/auth/get-session with the session cookie
+//
+// Tokens that parse as a JWT still go to jwt. Validated tokens are cached for
+// cacheTTL (never past their expiry) and refused ones for negativeTTL, so a
+// client retrying a bad token does not hit the auth service on every call.
+type opaqueTokenProvider struct {
+	jwt          tokenValidator
+	mode         string
+	url          string
+	clientId     string
+	clientSecret string
+	cookieName   string
+	issuers      []string
+	audiences    []string
+	clockSkew    time.Duration
+	maxTokenAge  time.Duration
+	client       *http.Client
+	cache        *tokenCache
+	rejected     *tokenCache
+}
+
+type betterAuthSession struct {
+	Session *struct {
+		ID        string    `json:"id"`
+		UserID    string    `json:"userId"`
+		CreatedAt time.Time `json:"createdAt"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	} `json:"session"`
+	User *struct {
+		ID string `json:"id"`
+	} `json:"user"`
+}
+
+// newOpaqueTokenProvider wraps the default JWT provider when AUTH_OPAQUE_TOKENS
+// is set, and returns nil otherwise:
+//
+//	AUTH_OPAQUE_TOKENS                     "introspection" or "session"
+//	AUTH_INTROSPECTION_URL                 endpoint, default <AUTH_SERVER_URL>/oauth2/introspect
+//	                                       or <AUTH_SERVER_URL>/api/auth/get-session
+//	AUTH_INTROSPECTION_CLIENT_ID           client id for HTTP Basic auth (introspection)
+//	AUTH_INTROSPECTION_CLIENT_SECRET_FILE  file holding the client secret (or AUTH_INTROSPECTION_CLIENT_SECRET)
+//	AUTH_SESSION_COOKIE                    cookie the session token is sent in, default better-auth.session_token
+//	AUTH_INTROSPECTION_TIMEOUT             upstream request timeout, default 5s
+//	AUTH_INTROSPECTION_CACHE_TTL           how long an active token is reused, default 1m
+//	AUTH_INTROSPECTION_NEGATIVE_CACHE_TTL  how long a refused token is remembered, default 10s
+//	AUTH_INTROSPECTION_CACHE_SIZE          maximum entries in each cache, default 10000
+func newOpaqueTokenProvider(jwtProvider tokenValidator, defaults oidcProviderConfig) (*opaqueTokenProvider, error) {
+	mode := os.Getenv("AUTH_OPAQUE_TOKENS")
+	if mode == "" {
+		return nil, nil
+	}
+
+	endpoint := os.Getenv("AUTH_INTROSPECTION_URL")
+	switch mode {
+	case opaqueTokensIntrospection:
+		if endpoint == "" {
+			endpoint = authServerURL + "/oauth2/introspect"
+		}
+	case opaqueTokensSession:
+		if endpoint == "" {
+			endpoint = authServerURL + "/api/auth/get-session"
+		}
+	default:
+		return nil, fmt.Errorf("AUTH_OPAQUE_TOKENS must be %q or %q", opaqueTokensIntrospection, opaqueTokensSession)
+	}
+
+	clientSecret := os.Getenv("AUTH_INTROSPECTION_CLIENT_SECRET")
+	if path := os.Getenv("AUTH_INTROSPECTION_CLIENT_SECRET_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AUTH_INTROSPECTION_CLIENT_SECRET_FILE: %w", err)
+		}
+		clientSecret = strings.TrimSpace(string(data))
+	}
+	cookieName := os.Getenv("AUTH_SESSION_COOKIE")
+	if cookieName == "" {
+		cookieName = defaultSessionCookie
+	}
+
+	timeout, err := envDuration("AUTH_INTROSPECTION_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := envDuration("AUTH_INTROSPECTION_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	negativeTTL, err := envDuration("AUTH_INTROSPECTION_NEGATIVE_CACHE_TTL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cacheSize, err := envInt("AUTH_INTROSPECTION_CACHE_SIZE", 10000)
+	if err != nil {
+		return nil, err
+	}
+	clockSkew, err := time.ParseDuration(defaults.ClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	var maxTokenAge time.Duration
+	if defaults.MaxTokenAge != "" {
+		if maxTokenAge, err = time.ParseDuration(defaults.MaxTokenAge); err != nil {
+			return nil, err
+		}
+	}
+
+	return &opaqueTokenProvider{
+		jwt:          jwtProvider,
+		mode:         mode,
+		url:          endpoint,
+		clientId:     os.Getenv("AUTH_INTROSPECTION_CLIENT_ID"),
+		clientSecret: clientSecret,
+		cookieName:   cookieName,
+		issuers:      defaults.Issuers,
+		audiences:    defaults.Audiences,
+		clockSkew:    clockSkew,
+		maxTokenAge:  maxTokenAge,
+		client:       &http.Client{Timeout: timeout},
+		cache:        newTokenCache(cacheTTL, cacheSize),
+		rejected:     newTokenCache(negativeTTL, cacheSize),
+	}, nil
+}
+
+func (p *opaqueTokenProvider) Validate(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	if isJWT(token) {
+		return p.jwt.Validate(ctx, token)
+	}
+
+	if userId, claims, ok := p.cache.get(token); ok {
+		return userId, claims, nil
+	}
+	if _, _, ok := p.rejected.get(token); ok {
+		return "", nil, reject(rejectInactive)
+	}
+
+	var userId string
+	var claims jwt.MapClaims
+	var err error
+	switch p.mode {
+	case opaqueTokensSession:
+		userId, claims, err = p.lookupSession(ctx, token)
+	default:
+		userId, claims, err = p.introspect(ctx, token)
+	}
+	if err != nil {
+		// Only a definite answer from the auth service is remembered; an
+		// outage must not lock users out for negativeTTL.
+		var rejection *authRejection
+		if errors.As(err, &rejection) {
+			p.rejected.put(token, "", nil, time.Time{})
+		}
+		return "", nil, err
+	}
+
+	var notAfter time.Time
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		notAfter = exp.Time
+	}
+	// Nor is a token reused once it is older than maxTokenAge.
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil && p.maxTokenAge > 0 {
+		if tooOld := iat.Add(p.maxTokenAge + p.clockSkew); notAfter.IsZero() || tooOld.Before(notAfter) {
+			notAfter = tooOld
+		}
+	}
+	p.cache.put(token, userId, claims, notAfter)
+	return userId, claims, nil
+}
+
+func (p *opaqueTokenProvider) prefetchJWKS(ctx context.Context) error {
+	if prefetcher, ok := p.jwt.(jwksPrefetcher); ok {
+		return prefetcher.prefetchJWKS(ctx)
+	}
+	return nil
+}
+
+func (p *opaqueTokenProvider) introspect(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", contentTypeJSON)
+	if p.clientId != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	// The whole RFC 7662 response becomes the token's claims.
+	var claims jwt.MapClaims
+	if err := p.do(req, &claims); err != nil {
+		return "", nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return "", nil, reject(rejectInactive)
+	}
+	userId, _ := claims["sub"].(string)
+	if userId == "" {
+		return "", nil, reject(rejectMissingUserId)
+	}
+	if err := p.validateClaims(claims, time.Now()); err != nil {
+		return "", nil, err
+	}
+	return userId, claims, nil
+}
+
+func (p *opaqueTokenProvider) lookupSession(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", contentTypeJSON)
+	req.AddCookie(&http.Cookie{Name: p.cookieName, Value: token})
+
+	var result betterAuthSession
+	if err := p.do(req, &result); err != nil {
+		return "", nil, err
+	}
+	if result.Session == nil || result.User == nil {
+		return "", nil, reject(rejectInactive)
+	}
+	if result.User.ID == "" || result.Session.UserID != result.User.ID {
+		return "", nil, reject(rejectMissingUserId)
+	}
+	if result.Session.ExpiresAt.IsZero() {
+		return "", nil, reject(rejectMissingExpiry)
+	}
+	now := time.Now()
+	if now.After(result.Session.ExpiresAt.Add(p.clockSkew)) {
+		return "", nil, reject(rejectExpired)
+	}
+	if err := p.checkTokenAge(result.Session.CreatedAt, now); err != nil {
+		return "", nil, err
+	}
+	claims := jwt.MapClaims{"sub": result.User.ID, "sid": result.Session.ID, "exp": float64(result.Session.ExpiresAt.Unix())}
+	if !result.Session.CreatedAt.IsZero() {
+		claims["iat"] = float64(result.Session.CreatedAt.Unix())
+	}
+	return result.User.ID, claims, nil
+}
+
+// do sends req and decodes the JSON body into out. 401 and 403 mean the
+// token is not valid; any other failure is an error of the auth service.
+func (p *opaqueTokenProvider) do(req *http.Request, out any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", p.mode, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return reject(rejectInactive)
+	default:
+		return fmt.Errorf("%s request failed with status %d", p.mode, resp.StatusCode)
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<16)).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", p.mode, err)
+	}
+	return nil
+}
+
+// validateClaims checks the optional exp, nbf, iat, iss and aud members of an
+// introspection response the same way the default JWT provider does.
+func (p *opaqueTokenProvider) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	if exp != nil && now.After(exp.Add(p.clockSkew)) {
+		return reject(rejectExpired)
+	}
+	nbf, err := claims.GetNotBefore()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	if nbf != nil && now.Add(p.clockSkew).Before(nbf.Time) {
+		return reject(rejectNotYetValid)
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	var issuedAt time.Time
+	if iat != nil {
+		issuedAt = iat.Time
+	}
+	if err := p.checkTokenAge(issuedAt, now); err != nil {
+		return err
+	}
+	if len(p.issuers) > 0 {
+		iss, err := claims.GetIssuer()
+		if err != nil || !slices.Contains(p.issuers, iss) {
+			return reject(rejectIssuer)
+		}
+	}
+	if len(p.audiences) > 0 {
+		aud, err := claims.GetAudience()
+		if err != nil || !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(p.audiences, a) }) {
+			return reject(rejectAudience)
+		}
+	}
+	return nil
+}
+
+// checkTokenAge refuses a token issued more than maxTokenAge ago, or with no
+// issue time at all when maxTokenAge is set.
+func (p *opaqueTokenProvider) checkTokenAge(issuedAt, now time.Time) error {
+	if p.maxTokenAge <= 0 {
+		return nil
+	}
+	if issuedAt.IsZero() {
+		return reject(rejectMissingIssuedAt)
+	}
+	if now.Sub(issuedAt) > p.maxTokenAge+p.clockSkew {
+		return reject(rejectTooOld)
+	}
+	return nil
+}
+
+// isJWT reports whether token has the three base64url segments of a JWS.
+// better-auth session tokens, signed or not, have at most two.
+func isJWT(token string) bool {
+	_, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	return err == nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAuthService is a local stand-in for the auth service's introspection or
+// session endpoint. respond answers every call.
+type fakeAuthService struct {
+	*httptest.Server
+	calls atomic.Int32
+}
+
+func newFakeAuthService(t *testing.T, respond func(w http.ResponseWriter, r *http.Request)) *fakeAuthService {
+	t.Helper()
+	f := &fakeAuthService{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.calls.Add(1)
+		respond(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestOpaqueProvider(t *testing.T, mode, url, maxTokenAge string) *opaqueTokenProvider {
+	t.Helper()
+	t.Setenv("AUTH_OPAQUE_TOKENS", mode)
+	t.Setenv("AUTH_INTROSPECTION_URL", url)
+	t.Setenv("AUTH_INTROSPECTION_CLIENT_ID", "hot-storage")
+	t.Setenv("AUTH_INTROSPECTION_CLIENT_SECRET", "client-secret")
+	t.Setenv("AUTH_INTROSPECTION_CACHE_TTL", "1h")
+	t.Setenv("AUTH_INTROSPECTION_NEGATIVE_CACHE_TTL", "1h")
+	p, err := newOpaqueTokenProvider(nil, oidcProviderConfig{ClockSkew: "1m", MaxTokenAge: maxTokenAge})
+	if err != nil {
+		t.Fatalf("newOpaqueTokenProvider: %v", err)
+	}
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(v)
+}
+
+// introspectionResponder answers with the RFC 7662 response of the token in
+// the form, after checking the client credentials.
+func introspectionResponder(t *testing.T, responses map[string]map[string]any) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "hot-storage" || secret != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm: %v", err)
+		}
+		response, ok := responses[r.PostForm.Get("token")]
+		if !ok {
+			response = map[string]any{"active": false}
+		}
+		writeJSON(w, response)
+	}
+}
+
+func rejectionReason(err error) string {
+	var rejection *authRejection
+	if errors.As(err, &rejection) {
+		return rejection.Reason
+	}
+	return ""
+}
+
+func cachedUntil(c *tokenCache, token string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[sha256.Sum256([]byte(token))]
+	if !ok {
+		return time.Time{}, false
+	}
+	return elem.Value.(*cachedToken).expires, true
+}
+
+func TestIntrospectionActiveToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	f := newFakeAuthService(t, introspectionResponder(t, map[string]map[string]any{
+		"opaque-token": {"active": true, "sub": "user-1", "exp": exp, "scope": "openid"},
+	}))
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "")
+
+	for range 2 {
+		userId, claims, err := p.Validate(context.Background(), "opaque-token")
+		if err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		if userId != "user-1" || claims["scope"] != "openid" {
+			t.Fatalf("got user %q claims %v", userId, claims)
+		}
+	}
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("auth service was called %d times, want 1 with the second call cached", got)
+	}
+}
+
+func TestIntrospectionInactiveToken(t *testing.T) {
+	f := newFakeAuthService(t, introspectionResponder(t, nil))
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "")
+
+	_, _, err := p.Validate(context.Background(), "revoked-token")
+	if reason := rejectionReason(err); reason != rejectInactive {
+		t.Fatalf("Validate: err = %v (reason %q), want %q", err, reason, rejectInactive)
+	}
+	if _, _, ok := p.cache.get("revoked-token"); ok {
+		t.Error("inactive token was cached as valid")
+	}
+}
+
+func TestIntrospectionNegativeCache(t *testing.T) {
+	f := newFakeAuthService(t, introspectionResponder(t, nil))
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "")
+
+	for range 3 {
+		if _, _, err := p.Validate(context.Background(), "bad-token"); rejectionReason(err) != rejectInactive {
+			t.Fatalf("Validate: err = %v, want an inactive rejection", err)
+		}
+	}
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("auth service was called %d times, want 1 with the retries served from the negative cache", got)
+	}
+}
+
+func TestIntrospectionOutageNotCached(t *testing.T) {
+	f := newFakeAuthService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "")
+
+	for range 2 {
+		if _, _, err := p.Validate(context.Background(), "token"); err == nil || rejectionReason(err) != "" {
+			t.Fatalf("Validate: err = %v, want an upstream error", err)
+		}
+	}
+	if got := f.calls.Load(); got != 2 {
+		t.Errorf("auth service was called %d times, want 2: an outage must not be cached", got)
+	}
+}
+
+func TestIntrospectionCacheCappedByExp(t *testing.T) {
+	exp := time.Now().Add(30 * time.Second).Truncate(time.Second)
+	f := newFakeAuthService(t, introspectionResponder(t, map[string]map[string]any{
+		"short-lived": {"active": true, "sub": "user-1", "exp": exp.Unix()},
+	}))
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "")
+
+	if _, _, err := p.Validate(context.Background(), "short-lived"); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	until, ok := cachedUntil(p.cache, "short-lived")
+	if !ok {
+		t.Fatal("token was not cached")
+	}
+	if !until.Equal(exp) {
+		t.Errorf("cached until %v, want the token's exp %v rather than the 1h TTL", until, exp)
+	}
+}
+
+func TestIntrospectionMaxTokenAge(t *testing.T) {
+	now := time.Now()
+	f := newFakeAuthService(t, introspectionResponder(t, map[string]map[string]any{
+		"fresh":  {"active": true, "sub": "user-1", "iat": now.Add(-10 * time.Minute).Unix()},
+		"stale":  {"active": true, "sub": "user-1", "iat": now.Add(-2 * time.Hour).Unix()},
+		"no-iat": {"active": true, "sub": "user-1"},
+	}))
+	p := newTestOpaqueProvider(t, opaqueTokensIntrospection, f.URL, "1h")
+
+	if _, _, err := p.Validate(context.Background(), "fresh"); err != nil {
+		t.Errorf("Validate(fresh): %v", err)
+	}
+	if _, _, err := p.Validate(context.Background(), "stale"); rejectionReason(err) != rejectTooOld {
+		t.Errorf("Validate(stale): err = %v, want %q", err, rejectTooOld)
+	}
+	if _, _, err := p.Validate(context.Background(), "no-iat"); rejectionReason(err) != rejectMissingIssuedAt {
+		t.Errorf("Validate(no-iat): err = %v, want %q", err, rejectMissingIssuedAt)
+	}
+}
+
+// sessionResponder answers like better-auth's get-session for the session
+// tokens in sessions, created createdAgo before now.
+func sessionResponder(sessions map[string]time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(defaultSessionCookie)
+		if err != nil || r.Method != http.MethodGet {
+			writeJSON(w, nil)
+			return
+		}
+		createdAgo, ok := sessions[cookie.Value]
+		if !ok {
+			writeJSON(w, nil)
+			return
+		}
+		now := time.Now()
+		writeJSON(w, map[string]any{
+			"session": map[string]any{
+				"id":        "session-" + cookie.Value,
+				"userId":    "user-1",
+				"createdAt": now.Add(-createdAgo),
+				"expiresAt": now.Add(24 * time.Hour),
+			},
+			"user": map[string]any{"id": "user-1"},
+		})
+	}
+}
+
+func TestSessionLookup(t *testing.T) {
+	f := newFakeAuthService(t, sessionResponder(map[string]time.Duration{"session-token": time.Minute}))
+	p := newTestOpaqueProvider(t, opaqueTokensSession, f.URL, "")
+
+	userId, claims, err := p.Validate(context.Background(), "session-token")
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if userId != "user-1" || claims["sid"] != "session-session-token" {
+		t.Fatalf("got user %q claims %v", userId, claims)
+	}
+	if _, ok := claims["iat"]; !ok {
+		t.Error("claims have no iat from the session's createdAt")
+	}
+
+	if _, _, err := p.Validate(context.Background(), "unknown-session"); rejectionReason(err) != rejectInactive {
+		t.Errorf("Validate(unknown-session): err = %v, want %q", err, rejectInactive)
+	}
+}
+
+func TestSessionLookupMaxTokenAge(t *testing.T) {
+	f := newFakeAuthService(t, sessionResponder(map[string]time.Duration{
+		"fresh": 10 * time.Minute,
+		"stale": 2 * time.Hour,
+	}))
+	p := newTestOpaqueProvider(t, opaqueTokensSession, f.URL, "1h")
+
+	if _, _, err := p.Validate(context.Background(), "fresh"); err != nil {
+		t.Errorf("Validate(fresh): %v", err)
+	}
+	if _, _, err := p.Validate(context.Background(), "stale"); rejectionReason(err) != rejectTooOld {
+		t.Errorf("Validate(stale): err = %v, want %q", err, rejectTooOld)
+	}
+	until, ok := cachedUntil(p.cache, "fresh")
+	if !ok {
+		t.Fatal("fresh session was not cached")
+	}
+	if limit := time.Now().Add(51 * time.Minute); until.After(limit) {
+		t.Errorf("fresh session cached until %v, past the time it gets older than maxTokenAge", until)
+	}
+}
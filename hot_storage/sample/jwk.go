@@ -1,57 +1,360 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/MicahParks/jwkset"
 	"github.com/MicahParks/keyfunc/v3"
-	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/time/rate"
 )
 
-var (
-	jwkCache   = make(map[string]keyfunc.Keyfunc)
-	jwkCacheMu sync.RWMutex
-)
+// jwksRegistry holds the signing keys of every JWKS URL the auth providers
+// use. Each set is refreshed every refreshInterval and, when a token names an
+// unknown kid, at most once per unknownKIDInterval. Keys that do not parse are
+// skipped and counted. A failed refresh, or one without a usable key, keeps
+// the last keys that were fetched, so tokens keep validating while the
+// auth server is down. When more than maxSets URLs are in use, the least
+// recently used set is dropped and its refresh goroutine stopped.
+type jwksRegistry struct {
+	mu                 sync.Mutex
+	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+	sets               map[string]*jwksSet
+	maxSets            int
+	refreshInterval    time.Duration
+	unknownKIDInterval time.Duration
+	client             *http.Client
+	evictions          atomic.Int64
+}
 
-func getOrCreateKeyfunc(jwkURL string) (keyfunc.Keyfunc, error) {
-	jwkCacheMu.RLock()
-	k, ok := jwkCache[jwkURL]
-	jwkCacheMu.RUnlock()
-	if ok {
-		return k, nil
+// jwksSet is the jwkset.Storage behind one URL's keyfunc.
+type jwksSet struct {
+	*jwkset.MemoryJWKSet
+	url        string
+	registry   *jwksRegistry
+	cancel     context.CancelFunc
+	unknownKID *rate.Limiter
+	keyfunc    keyfunc.Keyfunc
+	refreshMu  sync.Mutex
+	lastUsed   atomic.Int64
+
+	keys                atomic.Int64
+	invalidKeys         atomic.Int64
+	refreshes           atomic.Int64
+	refreshErrors       atomic.Int64
+	unknownKIDRefreshes atomic.Int64
+	unknownKIDThrottled atomic.Int64
+	lastRefresh         atomic.Int64
+	lastError           atomic.Value // string
+}
+
+var jwks = newJWKSRegistry(64, time.Hour, time.Minute, 10*time.Second)
+
+func init() {
+	expvar.Publish("jwks", expvar.Func(func() any { return jwks.metrics() }))
+}
+
+func newJWKSRegistry(maxSets int, refreshInterval, unknownKIDInterval, timeout time.Duration) *jwksRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jwksRegistry{
+		ctx:                ctx,
+		cancel:             cancel,
+		sets:               make(map[string]*jwksSet),
+		maxSets:            maxSets,
+		refreshInterval:    refreshInterval,
+		unknownKIDInterval: unknownKIDInterval,
+		client:             &http.Client{Timeout: timeout},
 	}
+}
 
-	jwkCacheMu.Lock()
-	defer jwkCacheMu.Unlock()
+// initJWKS configures the registry before any provider uses it:
+//
+//	JWKS_REFRESH_INTERVAL      how often each key set is fetched, 1m to 24h, default 1h
+//	JWKS_UNKNOWN_KID_INTERVAL  minimum time between refreshes caused by an unknown kid, default 1m
+//	JWKS_FETCH_TIMEOUT         timeout of each fetch, default 10s
+//	JWKS_CACHE_SIZE            maximum number of key sets kept, default 64
+func initJWKS() error {
+	refreshInterval, err := envDuration("JWKS_REFRESH_INTERVAL", jwks.refreshInterval)
+	if err != nil {
+		return err
+	}
+	if refreshInterval < time.Minute || refreshInterval > 24*time.Hour {
+		return fmt.Errorf("JWKS_REFRESH_INTERVAL must be between 1m and 24h")
+	}
+	unknownKIDInterval, err := envDuration("JWKS_UNKNOWN_KID_INTERVAL", jwks.unknownKIDInterval)
+	if err != nil {
+		return err
+	}
+	if unknownKIDInterval <= 0 {
+		return fmt.Errorf("JWKS_UNKNOWN_KID_INTERVAL must be positive")
+	}
+	timeout, err := envDuration("JWKS_FETCH_TIMEOUT", jwks.client.Timeout)
+	if err != nil {
+		return err
+	}
+	maxSets, err := envInt("JWKS_CACHE_SIZE", jwks.maxSets)
+	if err != nil {
+		return err
+	}
+	if maxSets <= 0 {
+		return fmt.Errorf("JWKS_CACHE_SIZE must be positive")
+	}
+
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	jwks.refreshInterval = refreshInterval
+	jwks.unknownKIDInterval = unknownKIDInterval
+	jwks.client.Timeout = timeout
+	jwks.maxSets = maxSets
+	return nil
+}
 
-	// Double-check after acquiring write lock
-	if k, ok := jwkCache[jwkURL]; ok {
-		return k, nil
+// getOrCreateKeyfunc returns the keyfunc for jwkURL, fetching its keys on
+// first use.
+func getOrCreateKeyfunc(jwkURL string) (keyfunc.Keyfunc, error) {
+	return jwks.get(jwkURL)
+}
+
+func (r *jwksRegistry) get(jwkURL string) (keyfunc.Keyfunc, error) {
+	r.mu.Lock()
+	set, ok := r.sets[jwkURL]
+	if !ok {
+		if err := r.ctx.Err(); err != nil {
+			r.mu.Unlock()
+			return nil, fmt.Errorf("jwks registry is closed")
+		}
+		if len(r.sets) >= r.maxSets {
+			r.evictLocked()
+		}
+		var err error
+		set, err = r.newSet(jwkURL)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		r.sets[jwkURL] = set
 	}
+	r.mu.Unlock()
 
-	k, err := keyfunc.NewDefault([]string{jwkURL})
+	set.lastUsed.Store(time.Now().UnixNano())
+	if !ok {
+		// After a failed first fetch, the next unknown kid retries once
+		// unknownKIDInterval has passed.
+		if err := set.refresh(r.ctx); err != nil {
+			slog.Warn("failed to fetch jwks", slog.String("url", jwkURL), slog.String("error", err.Error()))
+		}
+	}
+	return set.keyfunc, nil
+}
+
+// newSet creates the set for jwkURL and starts its refresh goroutine. Callers
+// hold mu.
+func (r *jwksRegistry) newSet(jwkURL string) (*jwksSet, error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	set := &jwksSet{
+		MemoryJWKSet: jwkset.NewMemoryStorage(),
+		url:          jwkURL,
+		registry:     r,
+		cancel:       cancel,
+		unknownKID:   rate.NewLimiter(rate.Every(r.unknownKIDInterval), 1),
+	}
+	// The first fetch is the set's initial load, not an unknown-kid refresh.
+	set.unknownKID.Allow()
+	k, err := keyfunc.New(keyfunc.Options{Ctx: ctx, Storage: set})
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	jwkCache[jwkURL] = k
-	return k, nil
+	set.keyfunc = k
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := set.refresh(ctx); err != nil {
+					slog.Warn("failed to refresh jwks, keeping the previous keys", slog.String("url", jwkURL), slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+	return set, nil
+}
+
+// evictLocked drops the least recently used set. Callers hold mu.
+func (r *jwksRegistry) evictLocked() {
+	var oldest *jwksSet
+	for _, set := range r.sets {
+		if oldest == nil || set.lastUsed.Load() < oldest.lastUsed.Load() {
+			oldest = set
+		}
+	}
+	if oldest != nil {
+		oldest.cancel()
+		delete(r.sets, oldest.url)
+		r.evictions.Add(1)
+		slog.Info("evicted jwks", slog.String("url", oldest.url))
+	}
+}
+
+// warmUpJWKS fetches the keys of every auth provider that verifies JWTs, so
+// the first requests do not wait for them. Failures are logged; those sets are
+// fetched again on first use.
+func warmUpJWKS(ctx context.Context) {
+	providers := map[string]tokenValidator{authProviderDefault: defaultAuthProvider}
+	for name, provider := range authProviders {
+		providers[name] = provider
+	}
+	for name, provider := range providers {
+		prefetcher, ok := provider.(jwksPrefetcher)
+		if !ok {
+			continue
+		}
+		if err := prefetcher.prefetchJWKS(ctx); err != nil {
+			slog.Warn("failed to prefetch jwks", slog.String("authProvider", name), slog.String("error", err.Error()))
+		}
+	}
 }
 
-func validate(token, jwkURL string) (string, error) {
-	k, err := getOrCreateKeyfunc(jwkURL)
+// close stops every refresh goroutine and waits for them to return.
+func (r *jwksRegistry) close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *jwksRegistry) metrics() map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sets := make(map[string]any, len(r.sets))
+	for url, set := range r.sets {
+		lastError, _ := set.lastError.Load().(string)
+		sets[url] = map[string]any{
+			"keys":                  set.keys.Load(),
+			"invalid_keys":          set.invalidKeys.Load(),
+			"refreshes":             set.refreshes.Load(),
+			"refresh_errors":        set.refreshErrors.Load(),
+			"unknown_kid_refreshes": set.unknownKIDRefreshes.Load(),
+			"unknown_kid_throttled": set.unknownKIDThrottled.Load(),
+			"last_refresh":          set.lastRefresh.Load(),
+			"last_error":            lastError,
+		}
+	}
+	return map[string]any{"sets": sets, "evictions": r.evictions.Load()}
+}
+
+// jwksPrefetcher is implemented by providers that verify tokens with a JWKS.
+type jwksPrefetcher interface {
+	prefetchJWKS(ctx context.Context) error
+}
+
+// KeyRead looks kid up and, if it is unknown, refreshes the set once before
+// giving up. Further unknown kids within unknownKIDInterval fail without a
+// fetch, so a flood of forged kids cannot hammer the auth server.
+func (s *jwksSet) KeyRead(ctx context.Context, kid string) (jwkset.JWK, error) {
+	jwk, err := s.MemoryJWKSet.KeyRead(ctx, kid)
+	if !errors.Is(err, jwkset.ErrKeyNotFound) {
+		return jwk, err
+	}
+	if s.refreshes.Load() == 0 {
+		// Wait for a first fetch that may still be in flight.
+		s.refreshMu.Lock()
+		s.refreshMu.Unlock()
+		if jwk, err = s.MemoryJWKSet.KeyRead(ctx, kid); !errors.Is(err, jwkset.ErrKeyNotFound) {
+			return jwk, err
+		}
+	}
+	if !s.unknownKID.Allow() {
+		s.unknownKIDThrottled.Add(1)
+		return jwk, err
+	}
+	s.unknownKIDRefreshes.Add(1)
+	if err := s.refresh(ctx); err != nil {
+		slog.Warn("failed to refresh jwks for unknown kid", slog.String("url", s.url), slog.String("error", err.Error()))
+	}
+	return s.MemoryJWKSet.KeyRead(ctx, kid)
+}
+
+// refresh replaces the keys with those currently served at the URL. On any
+// error, including a set without usable keys, the previous keys stay in place.
+func (s *jwksSet) refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	keys, err := s.fetch(ctx)
 	if err != nil {
-		return "", err
+		s.refreshErrors.Add(1)
+		s.lastError.Store(err.Error())
+		return err
 	}
+	if err := s.KeyReplaceAll(ctx, keys); err != nil {
+		return err
+	}
+	s.refreshes.Add(1)
+	s.keys.Store(int64(len(keys)))
+	s.lastRefresh.Store(time.Now().Unix())
+	s.lastError.Store("")
+	return nil
+}
 
-	parsed, err := jwt.Parse(token, k.Keyfunc, jwt.WithValidMethods([]string{"EdDSA", "RS256", "ES256"}))
+func (s *jwksSet) fetch(ctx context.Context) ([]jwkset.JWK, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
 	if err != nil {
-		return "", errors.New("invalid token")
+		return nil, err
+	}
+	resp, err := s.registry.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwks request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks request failed with status %d", resp.StatusCode)
 	}
 
-	claims := parsed.Claims.(jwt.MapClaims)
-	sub, ok := claims["sub"].(string)
-	if !ok || sub == "" {
-		return "", errors.New("missing sub claim")
+	// Keys are decoded one by one, so a key of a type or shape this service
+	// does not know, such as a new algorithm the auth server starts
+	// publishing, does not take the other keys down with it.
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %w", err)
+	}
+	keys := make([]jwkset.JWK, 0, len(set.Keys))
+	invalid := 0
+	for _, raw := range set.Keys {
+		var marshal jwkset.JWKMarshal
+		err := json.Unmarshal(raw, &marshal)
+		if err == nil {
+			var jwk jwkset.JWK
+			if jwk, err = jwkset.NewJWKFromMarshal(marshal, jwkset.JWKMarshalOptions{}, jwkset.JWKValidateOptions{}); err == nil {
+				keys = append(keys, jwk)
+				continue
+			}
+		}
+		invalid++
+		slog.Warn("skipping invalid key in jwks", slog.String("url", s.url), slog.String("kid", marshal.KID), slog.String("error", err.Error()))
+	}
+	s.invalidKeys.Add(int64(invalid))
+	if len(keys) == 0 {
+		if invalid > 0 {
+			return nil, fmt.Errorf("jwks has no usable keys, %d invalid", invalid)
+		}
+		return nil, fmt.Errorf("jwks has no keys")
 	}
-	return sub, nil
+	return keys, nil
 }
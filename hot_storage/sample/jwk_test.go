@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+)
+
+func testJWK(t *testing.T, kid string) json.RawMessage {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: kid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(jwk.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// newTestJWKSSet serves the JSON Web Keys in keys and returns a set for it.
+func newTestJWKSSet(t *testing.T, keys *atomic.Value) *jwksSet {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": keys.Load()})
+	}))
+	t.Cleanup(server.Close)
+	r := newJWKSRegistry(4, time.Hour, time.Minute, 2*time.Second)
+	t.Cleanup(r.close)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set, err := r.newSet(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestJWKSSkipsInvalidKeys(t *testing.T) {
+	var keys atomic.Value
+	keys.Store([]json.RawMessage{
+		testJWK(t, "valid"),
+		json.RawMessage(`{"kty": "EC", "kid": "bad-curve", "crv": "P-0", "x": "AA", "y": "AA"}`),
+		json.RawMessage(`{"kty": "future-kty", "kid": "unknown-type"}`),
+		json.RawMessage(`{"kty": 7, "kid": ["wrong", "types"]}`),
+	})
+	set := newTestJWKSSet(t, &keys)
+
+	if err := set.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, err := set.MemoryJWKSet.KeyRead(context.Background(), "valid"); err != nil {
+		t.Errorf("valid key was not stored: %v", err)
+	}
+	if got := set.keys.Load(); got != 1 {
+		t.Errorf("keys = %d, want 1", got)
+	}
+	if got := set.invalidKeys.Load(); got != 3 {
+		t.Errorf("invalid_keys = %d, want 3", got)
+	}
+}
+
+func TestJWKSWithoutUsableKeysKeepsPreviousKeys(t *testing.T) {
+	var keys atomic.Value
+	keys.Store([]json.RawMessage{testJWK(t, "valid")})
+	set := newTestJWKSSet(t, &keys)
+	if err := set.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	keys.Store([]json.RawMessage{json.RawMessage(`{"kty": "future-kty", "kid": "unknown-type"}`)})
+	if err := set.refresh(context.Background()); err == nil {
+		t.Fatal("refresh succeeded without a usable key")
+	}
+	if _, err := set.MemoryJWKSet.KeyRead(context.Background(), "valid"); err != nil {
+		t.Errorf("previous key was dropped: %v", err)
+	}
+	if got := set.refreshErrors.Load(); got != 1 {
+		t.Errorf("refresh_errors = %d, want 1", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	keyCheckId        = "share-encryption"
+	keyCheckPlaintext = "opensigner hot storage key check"
+)
+
+var keyCheckBinding = shareBinding{DeviceID: keyCheckId}
+
+// ErrKeyMismatch means the configured share encryption key cannot open data
+// already stored in the database.
+var ErrKeyMismatch = errors.New("configured share encryption key does not match the database; check SHARE_ENCRYPTION_KEY (or the key provider) and the DB_* settings")
+
+// verifyKeyCheck confirms that the configured key provider can open the canary
+// stored in key_checks. On the first start against a database the canary is
+// created, after checking that the key also opens an existing share if there
+// is one. A canary sealed with a retired KEK is re-sealed with the active one.
+func verifyKeyCheck(ctx context.Context) error {
+	var check KeyCheck
+	err := db.WithContext(ctx).First(&check, "id = ?", keyCheckId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return createKeyCheck(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load key check: %w", err)
+	}
+
+	plaintext, err := decryptShare(ctx, check.Value, keyCheckBinding)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyMismatch, err)
+	}
+	defer plaintext.Wipe()
+	if subtle.ConstantTimeCompare(plaintext.Bytes(), []byte(keyCheckPlaintext)) != 1 {
+		return ErrKeyMismatch
+	}
+
+	stale, err := shareNeedsRotation(ctx, check.Value, keyCheckBinding)
+	if err != nil || !stale {
+		return err
+	}
+	sealed, err := encryptShare(ctx, []byte(keyCheckPlaintext), keyCheckBinding)
+	if err != nil {
+		return err
+	}
+	return db.WithContext(ctx).Model(&KeyCheck{}).
+		Where("id = ? AND value = ?", keyCheckId, check.Value).
+		Update("value", sealed).Error
+}
+
+func createKeyCheck(ctx context.Context) error {
+	var device Device
+	err := db.WithContext(ctx).Order("created_at DESC").First(&device).Error
+	if err == nil {
+		var account Account
+		if err := db.WithContext(ctx).Unscoped().Order("created_at").First(&account, "signer_id = ?", device.SignerId).Error; err != nil {
+			return fmt.Errorf("failed to load owner of device %s: %w", device.ID, err)
+		}
+		plaintext, err := decryptShare(ctx, device.Share, newShareBinding(device.ID, account))
+		if err != nil {
+			return fmt.Errorf("%w: device %s: %v", ErrKeyMismatch, device.ID, err)
+		}
+		plaintext.Wipe()
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to load a device: %w", err)
+	}
+
+	sealed, err := encryptShare(ctx, []byte(keyCheckPlaintext), keyCheckBinding)
+	if err != nil {
+		return err
+	}
+	check := KeyCheck{ID: keyCheckId, Value: sealed}
+	result := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&check)
+	if result.Error != nil {
+		return fmt.Errorf("failed to store key check: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Another replica stored its canary first; verify against that one.
+		return verifyKeyCheck(ctx)
+	}
+	slog.Info("stored share encryption key check")
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestVerifyKeyCheck(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	ring := newTestKeyRing(t)
+	useShareKeys(t, ring)
+
+	if err := verifyKeyCheck(ctx); err != nil {
+		t.Fatalf("first start: %v", err)
+	}
+	if n := countRows(t, &KeyCheck{}, "id = ?", keyCheckId); n != 1 {
+		t.Fatalf("%d key checks stored, want 1", n)
+	}
+	if err := verifyKeyCheck(ctx); err != nil {
+		t.Fatalf("restart with the same key: %v", err)
+	}
+
+	useShareKeys(t, newTestKeyRing(t))
+	if err := verifyKeyCheck(ctx); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("restart with another key: err = %v, want ErrKeyMismatch", err)
+	}
+
+	// A retired key still opens the canary, which is re-sealed with the
+	// active one.
+	var before KeyCheck
+	db.First(&before, "id = ?", keyCheckId)
+	useShareKeys(t, rotateKeyRing(ring, "2"))
+	if err := verifyKeyCheck(ctx); err != nil {
+		t.Fatalf("restart after a key rotation: %v", err)
+	}
+	var after KeyCheck
+	db.First(&after, "id = ?", keyCheckId)
+	if s, _ := decodeSealedShare(after.Value); s.KeyID != "2" || after.Value == before.Value {
+		t.Errorf("canary sealed under key %q after the rotation, want 2", s.KeyID)
+	}
+}
+
+func TestVerifyKeyCheckAgainstExistingShares(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	ring := newTestKeyRing(t)
+	useShareKeys(t, ring)
+	account := Account{ID: uuid.NewString(), Address: uuid.NewString(), Username: "alice", AuthProvider: authProviderDefault, ChainId: 1, SignerId: "signer-1"}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	device := Device{ID: uuid.NewString(), SignerId: account.SignerId}
+	share, err := encryptShare(ctx, []byte("share"), newShareBinding(device.ID, account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Share = share
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a canary, the newest share stands in for it.
+	useShareKeys(t, newTestKeyRing(t))
+	if err := verifyKeyCheck(ctx); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("first start with another key: err = %v, want ErrKeyMismatch", err)
+	}
+	if n := countRows(t, &KeyCheck{}, "1 = 1"); n != 0 {
+		t.Errorf("key check stored for the wrong key")
+	}
+
+	useShareKeys(t, ring)
+	if err := verifyKeyCheck(ctx); err != nil {
+		t.Errorf("first start with the key of the shares: %v", err)
+	}
+}
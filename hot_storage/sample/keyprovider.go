@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	keyProviderEnv  = "env"
+	keyProviderFile = "file"
+	keyProviderHTTP = "http"
+
+	// legacyKeyVersion is the version assigned to SHARE_ENCRYPTION_KEY and
+	// to every headerless ciphertext.
+	legacyKeyVersion = "0"
+)
+
+var keyVersionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// keyProvider wraps and unwraps per-share data keys with a key-encryption key
+// (KEK). Implementations decide where the KEK lives; callers only ever see
+// wrapped data keys, the identifier of the KEK that wrapped them and, for
+// keys wrapped locally, the wrap algorithm, which they store next to them.
+type keyProvider interface {
+	// ActiveKeyID returns the identifier WrapKey currently wraps under, or ""
+	// when the backend picks the key itself.
+	ActiveKeyID() string
+	// WrapKey returns wrapAlgorithm "" when the backend wraps the key itself.
+	WrapKey(ctx context.Context, dek []byte) (keyId, wrapAlgorithm string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyId, wrapAlgorithm string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	// shareKeyProvider wraps the data key of every new share.
+	shareKeyProvider keyProvider
+
+	// shareKeys opens shares sealed directly with a ring key, before envelope
+	// encryption. It is nil when no such key is configured.
+	shareKeys *keyRing
+)
+
+// initEncryptionKey configures the key provider selected by SHARE_KEY_PROVIDER:
+//
+//	env   key ring from SHARE_ENCRYPTION_KEY(S), see loadEnvKeyRing (default)
+//	file  key ring from the JSON file at SHARE_KEY_FILE
+//	http  remote KMS at KMS_URL, see newHTTPKeyProvider
+//
+// The environment key ring is loaded whenever it is set so shares written
+// before envelope encryption stay readable after moving to another provider.
+func initEncryptionKey() error {
+	ring, err := loadEnvKeyRing()
+	if err != nil {
+		return err
+	}
+	shareKeys = ring
+
+	provider := os.Getenv("SHARE_KEY_PROVIDER")
+	if provider == "" {
+		provider = keyProviderEnv
+	}
+
+	switch provider {
+	case keyProviderEnv:
+		if ring == nil {
+			return fmt.Errorf("SHARE_ENCRYPTION_KEY or SHARE_ENCRYPTION_KEYS environment variable must be set (64 hex chars = 32 bytes)")
+		}
+		// The environment of a process is visible to anyone who can inspect
+		// it or its container, and often ends up in logs and crash reports.
+		slog.Warn("SHARE_KEY_PROVIDER=env keeps the key-encryption key in the environment; use SHARE_KEY_PROVIDER=file or http outside development")
+		shareKeyProvider = ring
+	case keyProviderFile:
+		path := os.Getenv("SHARE_KEY_FILE")
+		if path == "" {
+			return fmt.Errorf("SHARE_KEY_FILE must be set when SHARE_KEY_PROVIDER=file")
+		}
+		fileRing, err := loadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		shareKeyProvider = fileRing
+	case keyProviderHTTP:
+		kms, err := newHTTPKeyProvider()
+		if err != nil {
+			return err
+		}
+		shareKeyProvider = kms
+	default:
+		return fmt.Errorf("unsupported SHARE_KEY_PROVIDER %q", provider)
+	}
+	return nil
+}
+
+// keyRing holds local key-encryption keys indexed by version. It wraps new
+// data keys with the active version and can unwrap with any version.
+type keyRing struct {
+	active string
+	keys   map[string]secret
+}
+
+// loadEnvKeyRing builds a key ring from the environment, returning nil if no
+// key is set:
+//
+//	SHARE_ENCRYPTION_KEY         legacy key, registered as version "0"
+//	SHARE_ENCRYPTION_KEYS        comma-separated "version:hex" pairs
+//	SHARE_ENCRYPTION_KEY_ACTIVE  version used for new writes
+func loadEnvKeyRing() (*keyRing, error) {
+	keys := make(map[string]string)
+	if keyHex := os.Getenv("SHARE_ENCRYPTION_KEY"); keyHex != "" {
+		keys[legacyKeyVersion] = keyHex
+	}
+	if entries := os.Getenv("SHARE_ENCRYPTION_KEYS"); entries != "" {
+		for _, entry := range strings.Split(entries, ",") {
+			version, keyHex, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok {
+				return nil, fmt.Errorf("SHARE_ENCRYPTION_KEYS entries must look like <version>:<64 hex chars>")
+			}
+			if _, exists := keys[version]; exists {
+				return nil, fmt.Errorf("SHARE_ENCRYPTION_KEYS declares key version %q more than once", version)
+			}
+			keys[version] = keyHex
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return newKeyRing("SHARE_ENCRYPTION_KEYS", os.Getenv("SHARE_ENCRYPTION_KEY_ACTIVE"), keys)
+}
+
+// keyFile is the on-disk format read by the file provider.
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// loadKeyFile reads a key ring from a JSON keyFile. The file must not be
+// readable by group or others.
+func loadKeyFile(path string) (*keyRing, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("key file %s must not be accessible by group or others (mode %s)", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+	return newKeyRing(path, kf.Active, kf.Keys)
+}
+
+func newKeyRing(source, active string, keysHex map[string]string) (*keyRing, error) {
+	ring := &keyRing{active: active, keys: make(map[string]secret, len(keysHex))}
+	for version, keyHex := range keysHex {
+		if !keyVersionPattern.MatchString(version) {
+			return nil, fmt.Errorf("%s: key version %q must match [A-Za-z0-9_-]+", source, version)
+		}
+		key, err := parseKeyHex(fmt.Sprintf("%s version %q", source, version), keyHex)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[version] = newSecret(key)
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys configured", source)
+	}
+
+	if ring.active == "" {
+		if len(ring.keys) > 1 {
+			return nil, fmt.Errorf("%s: the active key version must be set when more than one key is configured", source)
+		}
+		for version := range ring.keys {
+			ring.active = version
+		}
+	}
+	if _, ok := ring.keys[ring.active]; !ok {
+		return nil, fmt.Errorf("%s: active key version %q does not match any configured key", source, ring.active)
+	}
+	return ring, nil
+}
+
+func parseKeyHex(name, keyHex string) ([]byte, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be valid hex: %w", name, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes (64 hex chars), got %d bytes", name, len(key))
+	}
+	return key, nil
+}
+
+// versions returns the configured key versions in a stable order.
+func (k *keyRing) versions() []string {
+	versions := make([]string, 0, len(k.keys))
+	for v := range k.keys {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// key returns a copy of the key of version, which the caller must clear.
+func (k *keyRing) key(version string) ([]byte, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown share encryption key version %q", version)
+	}
+	return append([]byte(nil), key.Bytes()...), nil
+}
+
+// wipe zeroes every key in the ring. The ring is unusable afterwards.
+func (k *keyRing) wipe() {
+	for _, key := range k.keys {
+		key.Wipe()
+	}
+}
+
+func (k *keyRing) ActiveKeyID() string {
+	return k.active
+}
+
+// WrapKey seals dek with shareAlgorithm under the active key.
+func (k *keyRing) WrapKey(_ context.Context, dek []byte) (string, string, []byte, error) {
+	kek, err := k.key(k.active)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer clear(kek)
+	algorithm, wrapped, err := sealKey(kek, dek)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return k.active, algorithm, wrapped, nil
+}
+
+func (k *keyRing) UnwrapKey(_ context.Context, keyId, wrapAlgorithm string, wrapped []byte) ([]byte, error) {
+	kek, err := k.key(keyId)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	return openKey(kek, wrapAlgorithm, wrapped)
+}
+
+// sealKey wraps a 32-byte key under kek with shareAlgorithm, returning the
+// algorithm and nonce || ciphertext.
+func sealKey(kek, dek []byte) (string, []byte, error) {
+	if len(dek) != 32 {
+		return "", nil, fmt.Errorf("wrapped keys must be 32 bytes, got %d", len(dek))
+	}
+	aead, err := newAEAD(shareAlgorithm, kek)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return shareAlgorithm, aead.Seal(nonce, nonce, dek, nil), nil
+}
+
+// openKey unwraps a key sealed by sealKey with algorithm, which defaults to
+// AES-256-GCM for keys wrapped before the algorithm was recorded.
+func openKey(kek []byte, algorithm string, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(keyWrapAlgorithm(algorithm), kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dek, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dek, nil
+}
+
+// keyWrapAlgorithm returns the algorithm a key was wrapped with locally,
+// given the recorded one.
+func keyWrapAlgorithm(recorded string) string {
+	if recorded == "" {
+		return algorithmAESGCM
+	}
+	return recorded
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestKeyRingKeyReturnsCopy(t *testing.T) {
+	ring := newTestKeyRing(t)
+	want := bytes.Clone(ring.keys["1"].Bytes())
+
+	key, err := ring.key("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clear(key)
+	if !bytes.Equal(ring.keys["1"].Bytes(), want) {
+		t.Fatal("clearing the returned key cleared the ring's key")
+	}
+
+	dek := bytes.Repeat([]byte{7}, 32)
+	keyId, algorithm, wrapped, err := ring.WrapKey(context.Background(), dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := ring.UnwrapKey(context.Background(), keyId, algorithm, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Error("unwrapped key differs")
+	}
+	if !bytes.Equal(ring.keys["1"].Bytes(), want) {
+		t.Error("wrapping cleared the ring's key")
+	}
+
+	if _, err := ring.key("2"); err == nil {
+		t.Error("unknown version returned a key")
+	}
+}
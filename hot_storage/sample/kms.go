@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpKeyProvider wraps data keys through a remote KMS. The KEK never leaves
+// the KMS; the service only sends data keys to be wrapped or unwrapped:
+//
+//	POST {KMS_URL}/v1/keys/{keyId}/wrap    {"plaintext": b64}  -> {"keyId": "...", "ciphertext": b64}
+//	POST {KMS_URL}/v1/keys/{keyId}/unwrap  {"ciphertext": b64} -> {"plaintext": b64}
+//
+// The keyId returned by wrap is stored with the share and passed back on
+// unwrap, so the KMS can rotate its key versions independently.
+type httpKeyProvider struct {
+	baseURL string
+	keyId   string
+	token   string
+	client  *http.Client
+}
+
+type kmsWrapRequest struct {
+	Plaintext string `json:"plaintext"`
+}
+
+type kmsWrapResponse struct {
+	KeyID      string `json:"keyId"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type kmsUnwrapRequest struct {
+	Ciphertext string `json:"ciphertext"`
+}
+
+type kmsUnwrapResponse struct {
+	Plaintext string `json:"plaintext"`
+}
+
+// newHTTPKeyProvider configures the KMS client from KMS_URL, KMS_KEY_ID and,
+// optionally, KMS_TOKEN_FILE (a file holding a bearer token) and KMS_TIMEOUT.
+func newHTTPKeyProvider() (*httpKeyProvider, error) {
+	baseURL := strings.TrimSuffix(os.Getenv("KMS_URL"), "/")
+	keyId := os.Getenv("KMS_KEY_ID")
+	if baseURL == "" || keyId == "" {
+		return nil, fmt.Errorf("KMS_URL and KMS_KEY_ID must be set when SHARE_KEY_PROVIDER=http")
+	}
+	timeout, err := envDuration("KMS_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &httpKeyProvider{
+		baseURL: baseURL,
+		keyId:   keyId,
+		client:  &http.Client{Timeout: timeout},
+	}
+	if tokenFile := os.Getenv("KMS_TOKEN_FILE"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KMS_TOKEN_FILE: %w", err)
+		}
+		p.token = strings.TrimSpace(string(token))
+	}
+	return p, nil
+}
+
+func (p *httpKeyProvider) ActiveKeyID() string {
+	return ""
+}
+
+// WrapKey leaves the wrap algorithm to the KMS, so it reports none.
+func (p *httpKeyProvider) WrapKey(ctx context.Context, dek []byte) (string, string, []byte, error) {
+	var resp kmsWrapResponse
+	req := kmsWrapRequest{Plaintext: base64.StdEncoding.EncodeToString(dek)}
+	if err := p.call(ctx, p.keyId, "wrap", req, &resp); err != nil {
+		return "", "", nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil || len(wrapped) == 0 {
+		return "", "", nil, fmt.Errorf("kms returned an invalid wrapped key")
+	}
+	keyId := resp.KeyID
+	if keyId == "" {
+		keyId = p.keyId
+	}
+	return keyId, "", wrapped, nil
+}
+
+func (p *httpKeyProvider) UnwrapKey(ctx context.Context, keyId, wrapAlgorithm string, wrapped []byte) ([]byte, error) {
+	if wrapAlgorithm != "" {
+		return nil, fmt.Errorf("data key was wrapped locally with %s, not by the kms", wrapAlgorithm)
+	}
+	var resp kmsUnwrapResponse
+	req := kmsUnwrapRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrapped)}
+	if err := p.call(ctx, keyId, "unwrap", req, &resp); err != nil {
+		return nil, err
+	}
+	dek, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil || len(dek) == 0 {
+		return nil, fmt.Errorf("kms returned an invalid data key")
+	}
+	return dek, nil
+}
+
+func (p *httpKeyProvider) call(ctx context.Context, keyId, op string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v1/keys/%s/%s", p.baseURL, url.PathEscape(keyId), op)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeHeader, contentTypeJSON)
+	if p.token != "" {
+		req.Header.Set(headerAuth, headerAuthPrefix+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s request failed: %w", op, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kms %s request failed with status %d", op, resp.StatusCode)
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<16)).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode kms %s response: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKMSToken = "kms-token"
+
+// standInKMS is a local KMS holding one AES-256 key per key version. Wrap
+// under "kek" answers with the current version "kek-v2".
+type standInKMS struct {
+	keys map[string]cipher.AEAD
+}
+
+func newStandInKMS(t *testing.T) *httptest.Server {
+	t.Helper()
+	kms := &standInKMS{keys: make(map[string]cipher.AEAD)}
+	for _, version := range []string{"kek-v1", "kek-v2"} {
+		key := make([]byte, 32)
+		rand.Read(key)
+		block, _ := aes.NewCipher(key)
+		kms.keys[version], _ = cipher.NewGCM(block)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/keys/{keyId}/wrap", kms.wrap)
+	mux.HandleFunc("POST /v1/keys/{keyId}/unwrap", kms.unwrap)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerAuth) != headerAuthPrefix+testKMSToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (k *standInKMS) wrap(w http.ResponseWriter, r *http.Request) {
+	keyId := r.PathValue("keyId")
+	if keyId == "kek" {
+		keyId = "kek-v2"
+	}
+	aead, ok := k.keys[keyId]
+	var req kmsWrapRequest
+	if !ok || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(req.Plaintext)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	ciphertext := aead.Seal(nonce, nonce, plaintext, []byte(keyId))
+	writeJSON(w, kmsWrapResponse{KeyID: keyId, Ciphertext: base64.StdEncoding.EncodeToString(ciphertext)})
+}
+
+func (k *standInKMS) unwrap(w http.ResponseWriter, r *http.Request) {
+	keyId := r.PathValue("keyId")
+	aead, ok := k.keys[keyId]
+	var req kmsUnwrapRequest
+	if !ok || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(keyId))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, kmsUnwrapResponse{Plaintext: base64.StdEncoding.EncodeToString(plaintext)})
+}
+
+func newTestHTTPKeyProvider(t *testing.T, url string) *httpKeyProvider {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "kms-token")
+	if err := os.WriteFile(tokenFile, []byte(testKMSToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KMS_URL", url+"/")
+	t.Setenv("KMS_KEY_ID", "kek")
+	t.Setenv("KMS_TOKEN_FILE", tokenFile)
+	t.Setenv("KMS_TIMEOUT", "2s")
+	p, err := newHTTPKeyProvider()
+	if err != nil {
+		t.Fatalf("newHTTPKeyProvider: %v", err)
+	}
+	return p
+}
+
+func TestHTTPKeyProviderRoundTrip(t *testing.T) {
+	p := newTestHTTPKeyProvider(t, newStandInKMS(t).URL)
+	dek := make([]byte, 32)
+	rand.Read(dek)
+
+	keyId, wrapAlgorithm, wrapped, err := p.WrapKey(context.Background(), dek)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	if keyId != "kek-v2" {
+		t.Errorf("key id = %q, want the version the KMS wrapped under", keyId)
+	}
+	if wrapAlgorithm != "" {
+		t.Errorf("wrap algorithm = %q, want none for a key wrapped by the KMS", wrapAlgorithm)
+	}
+	if bytes.Contains(wrapped, dek) {
+		t.Error("wrapped key contains the data key")
+	}
+	unwrapped, err := p.UnwrapKey(context.Background(), keyId, "", wrapped)
+	if err != nil {
+		t.Fatalf("UnwrapKey: %v", err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Error("unwrapped key differs from the data key")
+	}
+}
+
+func TestHTTPKeyProviderWrongKeyID(t *testing.T) {
+	p := newTestHTTPKeyProvider(t, newStandInKMS(t).URL)
+	_, _, wrapped, err := p.WrapKey(context.Background(), make([]byte, 32))
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	for _, keyId := range []string{"kek-v1", "unknown"} {
+		if _, err := p.UnwrapKey(context.Background(), keyId, "", wrapped); err == nil {
+			t.Errorf("UnwrapKey under %q succeeded", keyId)
+		}
+	}
+}
+
+func TestHTTPKeyProviderErrorStatus(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			writeJSON(w, kmsWrapResponse{KeyID: "kek", Ciphertext: base64.StdEncoding.EncodeToString([]byte("x"))})
+		}))
+		p := newTestHTTPKeyProvider(t, server.URL)
+		if _, _, _, err := p.WrapKey(context.Background(), make([]byte, 32)); err == nil || !strings.Contains(err.Error(), "status") {
+			t.Errorf("WrapKey with status %d: err = %v", status, err)
+		}
+		if _, err := p.UnwrapKey(context.Background(), "kek", "", []byte("x")); err == nil {
+			t.Errorf("UnwrapKey with status %d succeeded", status)
+		}
+		server.Close()
+	}
+}
+
+func TestHTTPKeyProviderMalformedResponse(t *testing.T) {
+	for name, body := range map[string]string{
+		"not JSON":          `<html>bad gateway</html>`,
+		"invalid base64":    `{"keyId": "kek", "ciphertext": "%%%", "plaintext": "%%%"}`,
+		"empty values":      `{"keyId": "kek", "ciphertext": "", "plaintext": ""}`,
+		"truncated JSON":    `{"keyId": "kek", "ciphertext": "`,
+		"wrong field types": `{"keyId": 1, "ciphertext": [], "plaintext": {}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(contentTypeHeader, contentTypeJSON)
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+			p := newTestHTTPKeyProvider(t, server.URL)
+			if _, _, _, err := p.WrapKey(context.Background(), make([]byte, 32)); err == nil {
+				t.Error("WrapKey succeeded")
+			}
+			if _, err := p.UnwrapKey(context.Background(), "kek", "", []byte("x")); err == nil {
+				t.Error("UnwrapKey succeeded")
+			}
+		})
+	}
+}
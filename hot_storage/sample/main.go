@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -8,16 +9,111 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rekey":
+			os.Exit(runRekey(os.Args[2:]))
+		case "split-key":
+			os.Exit(runSplitKey(os.Args[2:]))
+		case "shred-tenant":
+			os.Exit(runShredTenant(os.Args[2:]))
+		default:
+			fmt.Printf("unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	if authServerURL == "" {
 		fmt.Println("AUTH_SERVER_URL environment variable is not set")
 		os.Exit(1)
 	}
 
-	if err := initEncryptionKey(); err != nil {
-		slog.Error(fmt.Sprintf("Failed to initialize encryption: %v", err))
+	if err := initUnseal(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize unseal: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initShareAlgorithm(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize share cipher: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initPlayFab(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize PlayFab auth: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initAdmin(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize admin endpoint: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initDPoP(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize DPoP: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initTLS(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize TLS: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initServiceIdentities(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize service identities: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initQuotas(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize quotas: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initCORS(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize CORS: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initStepUp(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize step-up policies: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initShareAnomaly(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize share read anomaly detection: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initRateLimits(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize rate limits: %v", err))
+		os.Exit(1)
+	}
+
+	if err := initJWKS(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize JWKS: %v", err))
 		os.Exit(1)
 	}
 
+	if err := initAuthProviders(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize auth providers: %v", err))
+		os.Exit(1)
+	}
+	warmUpJWKS(context.Background())
+
+	if err := initTenants(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize tenant keys: %v", err))
+		os.Exit(1)
+	}
+
+	if keyUnsealer == nil {
+		if err := initEncryptionKey(); err != nil {
+			slog.Error(fmt.Sprintf("Failed to initialize encryption: %v", err))
+			os.Exit(1)
+		}
+		if ring, ok := shareKeyProvider.(*keyRing); ok {
+			slog.Info("share encryption keys loaded", slog.String("active", ring.active), slog.Any("versions", ring.versions()))
+		}
+	}
+
 	err := initDB()
 	if err != nil {
 		slog.Error(fmt.Sprintf("Failed to initialize DB: %v", err))
@@ -25,6 +121,25 @@ func main() {
 	}
 
 	slog.Info("DB initialized")
+
+	if keyUnsealer != nil {
+		keyUnsealer.start(func() {
+			if err := startShareRotation(context.Background()); err != nil {
+				slog.Error(fmt.Sprintf("Failed to start share key rotation: %v", err))
+			}
+		})
+	} else {
+		if err := verifyKeyCheck(context.Background()); err != nil {
+			slog.Error(fmt.Sprintf("Refusing to start: %v", err))
+			os.Exit(1)
+		}
+
+		if err := startShareRotation(context.Background()); err != nil {
+			slog.Error(fmt.Sprintf("Failed to start share key rotation: %v", err))
+			os.Exit(1)
+		}
+	}
+
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
 	if port == "" {
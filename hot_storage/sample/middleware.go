@@ -2,65 +2,84 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net/http"
-	"os"
 	"strings"
 )
 
+// corsMiddleware answers preflight requests and sets the CORS headers of the
+// rule covering the request path.
 func corsMiddleware(next http.Handler) http.Handler {
-	allowedOrigins := getAllowedOrigins()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
-		if isOriginAllowed(origin, allowedOrigins) {
+		rule := corsRuleFor(r.URL.Path)
+		allowed := rule.allows(origin)
+		w.Header().Set("Vary", "Origin")
+		if allowed {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-auth-provider, x-request-id, x-player-token, x-cookie-field")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Vary", "Origin")
 		if r.Method == "OPTIONS" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", rule.Methods)
+				w.Header().Set("Access-Control-Allow-Headers", rule.Headers)
+				if rule.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", rule.maxAgeHeader())
+				}
+			} else if corsStrict && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				slog.Info("preflight refused", slog.String("origin", origin), slog.String("path", r.URL.Path))
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		if allowed && rule.ExposedHeaders != "" {
+			w.Header().Set("Access-Control-Expose-Headers", rule.ExposedHeaders)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func getAllowedOrigins() []string {
-	originsEnv := os.Getenv("ALLOWED_ORIGINS")
-	if originsEnv == "" {
-		return []string{"http://localhost:7050", "http://localhost:7051"}
-	}
-	return strings.Split(originsEnv, ",")
-}
-
-func isOriginAllowed(origin string, allowed []string) bool {
-	if origin == "" {
-		return false
-	}
-	for _, a := range allowed {
-		if strings.TrimSpace(a) == origin {
-			return true
+// sealedMiddleware refuses every request while the share encryption key is
+// still waiting to be unsealed.
+func sealedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSealed() {
+			w.Header().Set(contentTypeHeader, contentTypeJSON)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"sealed"}`))
+			return
 		}
-	}
-	return false
+		next.ServeHTTP(w, r)
+	})
 }
 
-// TODO(security): Add per-user rate limiting middleware before production deployment.
-// Recommended: golang.org/x/time/rate with a TokenBucket per userId (e.g., 10 req/sec burst 20).
-// Critical endpoints: /v2/devices/create, /v1/devices/register
-// Without rate limiting, authenticated users can create unbounded devices/accounts.
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userId, authProvider, err := validateAuth(r)
-		if err != nil || userId == "" {
+		identity, err := validateAuth(r)
+		if errors.Is(err, ErrServiceForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"forbidden"}`))
+			return
+		}
+		if err != nil || identity.UserID == "" {
+			var rejection *authRejection
+			if errors.As(err, &rejection) && rejection.Reason == rejectDPoPScheme {
+				dpopChallenge(w, "invalid_token")
+			} else if errors.As(err, &rejection) && strings.HasPrefix(rejection.Reason, "dpop_") {
+				dpopChallenge(w, "invalid_dpop_proof")
+			}
 			unauthorized(w)
 			return
 		}
-		slog.Debug("authenticated request", slog.String("userId", userId))
-		ctx := context.WithValue(r.Context(), fieldUserId, userId)
-		ctx = context.WithValue(ctx, fieldAuthProvider, authProvider)
+		slog.Debug("authenticated request", slog.String("userId", identity.UserID))
+		ctx := context.WithValue(r.Context(), fieldUserId, identity.UserID)
+		ctx = context.WithValue(ctx, fieldAuthProvider, identity.AuthProvider)
+		ctx = context.WithValue(ctx, fieldTenant, identity.Tenant)
+		ctx = context.WithValue(ctx, fieldSenderConstrained, identity.SenderConstrained)
+		ctx = context.WithValue(ctx, fieldClaims, identity.Claims)
 		authenticatedRequest := r.WithContext(ctx)
 		next.ServeHTTP(w, authenticatedRequest)
 	})
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -15,7 +17,7 @@ type NextAction struct {
 }
 
 type Embedded struct {
-	Share        *string `json:"share,omitempty"`
+	Share        *secret `json:"share,omitempty"`
 	OwnerAddress *string `json:"ownerAddress,omitempty"`
 	Address      *string `json:"address,omitempty"`
 	ChainID      int64   `json:"chainId"`
@@ -73,6 +75,7 @@ type Account struct {
 	ChainId      int64  `json:"chainId"`
 	AuthProvider string `json:"auth_provider"`
 	SignerId     string `json:"signerId"`
+	Tenant       string `json:"tenant"`
 }
 
 type MigratedAccountData struct {
@@ -82,12 +85,189 @@ type MigratedAccountData struct {
 	FormerOwnerUser string `json:"former_user"` // used as a PRF seed for passkeys at Openfort
 }
 
+// KeyCheck holds a canary sealed with the share encryption key, used at
+// startup to detect a misconfigured key or database.
+type KeyCheck struct {
+	gorm.Model
+	ID    string `gorm:"primaryKey" json:"id"`
+	Value string `json:"value"`
+}
+
+// TenantKey is a tenant's data key, wrapped by the share key provider.
+// Hard-deleting the row crypto-shreds every share of the tenant.
+type TenantKey struct {
+	gorm.Model
+	ID            string `gorm:"primaryKey" json:"id"`
+	KeyID         string `json:"keyId"`
+	WrapAlgorithm string `json:"wrapAlgorithm"`
+	WrappedKey    []byte `json:"-"`
+}
+
+// DeletionReceipt records an account erasure. It keeps only identifiers, no
+// share material or personal data.
+type DeletionReceipt struct {
+	gorm.Model
+	ID         string `gorm:"primaryKey" json:"id"`
+	SignerId   string `json:"signerId"`
+	AccountIds string `json:"accountIds"` // comma-separated
+	DeviceIds  string `json:"deviceIds"`  // comma-separated
+}
+
+type DeletionReceiptResponse struct {
+	ID        string   `json:"id"`
+	Object    string   `json:"object"`
+	Signer    string   `json:"signer"`
+	Accounts  []string `json:"accounts"`
+	Devices   []string `json:"devices"`
+	DeletedAt int64    `json:"deletedAt"`
+}
+
+// LinkedIdentity lets a second (Username, AuthProvider) pair act as the user
+// that owns the accounts. Requests made with it are resolved to the owner, so
+// account lookups and share bindings keep using the owner's identity.
+type LinkedIdentity struct {
+	gorm.Model
+	ID                string `gorm:"primaryKey" json:"id"`
+	Username          string `gorm:"uniqueIndex:idx_linked_identity" json:"username"`
+	AuthProvider      string `gorm:"uniqueIndex:idx_linked_identity" json:"auth_provider"`
+	OwnerUsername     string `gorm:"index:idx_linked_identity_owner" json:"owner_username"`
+	OwnerAuthProvider string `gorm:"index:idx_linked_identity_owner" json:"owner_auth_provider"`
+}
+
+// RevokedToken is a deny-listed jti or session id. Rows past ExpiresAt are
+// pruned; a nil ExpiresAt keeps the row.
+type RevokedToken struct {
+	gorm.Model
+	ID        string     `gorm:"primaryKey" json:"id"`
+	ExpiresAt *time.Time `gorm:"index" json:"expiresAt"`
+}
+
+// RevocationCutoff invalidates every token of a user issued at or before
+// IssuedBefore.
+type RevocationCutoff struct {
+	gorm.Model
+	ID           string    `gorm:"primaryKey" json:"id"`
+	Username     string    `gorm:"uniqueIndex:idx_revocation_cutoff" json:"username"`
+	AuthProvider string    `gorm:"uniqueIndex:idx_revocation_cutoff" json:"auth_provider"`
+	IssuedBefore time.Time `json:"issuedBefore"`
+}
+
+// ShareReadClient is a network or user agent, hashed, that a user has
+// successfully read shares from.
+type ShareReadClient struct {
+	gorm.Model
+	ID           string    `gorm:"primaryKey" json:"id"`
+	Username     string    `gorm:"uniqueIndex:idx_share_read_client" json:"username"`
+	AuthProvider string    `gorm:"uniqueIndex:idx_share_read_client" json:"auth_provider"`
+	Kind         string    `gorm:"uniqueIndex:idx_share_read_client" json:"kind"`
+	Value        string    `gorm:"uniqueIndex:idx_share_read_client" json:"value"`
+	LastSeenAt   time.Time `json:"lastSeenAt"`
+}
+
+// ShareReadHold locks the share reads of a user or IP until Until, or makes
+// them wait for a step-up, after an anomaly.
+type ShareReadHold struct {
+	gorm.Model
+	ID     string     `gorm:"primaryKey" json:"id"`
+	Key    string     `gorm:"uniqueIndex:idx_share_read_hold" json:"key"`
+	Kind   string     `gorm:"uniqueIndex:idx_share_read_hold" json:"kind"`
+	Signal string     `json:"signal"`
+	Until  *time.Time `json:"until"`
+}
+
+type ShareReadErrorResponse struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+type StepUpErrorResponse struct {
+	Error     string   `json:"error"`
+	MaxAge    int      `json:"maxAge,omitempty"`
+	AcrValues []string `json:"acrValues,omitempty"`
+	AmrValues []string `json:"amrValues,omitempty"`
+}
+
+// UserQuota overrides the quota of one user. Zero limits keep the quota of
+// the user's auth provider.
+type UserQuota struct {
+	gorm.Model
+	ID           string `gorm:"primaryKey" json:"id"`
+	Username     string `gorm:"uniqueIndex:idx_user_quota" json:"username"`
+	AuthProvider string `gorm:"uniqueIndex:idx_user_quota" json:"auth_provider"`
+	// A nil limit keeps the quota of the auth provider; 0 is unlimited.
+	MaxAccounts         *int `json:"maxAccounts"`
+	MaxAccountsPerChain *int `json:"maxAccountsPerChain"`
+	MaxDevices          *int `json:"maxDevices"`
+}
+
+type QuotaRequest struct {
+	UserId              string `json:"userId"`
+	AuthProvider        string `json:"authProvider"`
+	MaxAccounts         *int   `json:"maxAccounts"`
+	MaxAccountsPerChain *int   `json:"maxAccountsPerChain"`
+	MaxDevices          *int   `json:"maxDevices"`
+}
+
+type QuotaResponse struct {
+	UserId              string `json:"userId"`
+	AuthProvider        string `json:"authProvider"`
+	MaxAccounts         int    `json:"maxAccounts"`
+	MaxAccountsPerChain int    `json:"maxAccountsPerChain"`
+	MaxDevices          int    `json:"maxDevices"`
+}
+
+type QuotaErrorResponse struct {
+	Error string `json:"error"`
+	Quota string `json:"quota"`
+	Limit int    `json:"limit"`
+}
+
+// RateLimitCounter counts the requests of one rate limit key in one window.
+// Rows past ExpiresAt are pruned.
+type RateLimitCounter struct {
+	gorm.Model
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Count     int       `json:"count"`
+	ExpiresAt time.Time `gorm:"index" json:"expiresAt"`
+}
+
+type RevocationRequest struct {
+	Jti          string `json:"jti"`
+	SessionId    string `json:"sessionId"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	UserId       string `json:"userId"`
+	AuthProvider string `json:"authProvider"`
+	IssuedBefore int64  `json:"issuedBefore"`
+}
+
+type LinkIdentityRequest struct {
+	AuthProvider string `json:"authProvider"`
+	Token        string `json:"token"`
+}
+
+type LinkedIdentityResponse struct {
+	ID           string `json:"id"`
+	Object       string `json:"object"`
+	Username     string `json:"username"`
+	AuthProvider string `json:"authProvider"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+type LinkedIdentityListResponse struct {
+	Object string                   `json:"object"`
+	URL    string                   `json:"url"`
+	Data   []LinkedIdentityResponse `json:"data"`
+	Start  int                      `json:"start"`
+	End    int                      `json:"end"`
+	Total  int                      `json:"total"`
+}
+
 type DeviceResponse struct {
 	ID        string `json:"id"`
 	Object    string `json:"object"`
 	CreatedAt int64  `json:"createdAt"`
 	Address   string `json:"address"`
-	Share     string `json:"share"`
+	Share     secret `json:"share"`
 	IsPrimary bool   `json:"isPrimary"`
 }
 
@@ -147,7 +327,7 @@ type RecoverResponseV2 struct {
 	Account       string `json:"account"`
 	SignerAddress string `json:"signerAddress"`
 	Signer        string `json:"signer"`
-	Share         string `json:"share"`
+	Share         secret `json:"share"`
 	IsPrimary     bool   `json:"isPrimary"`
 	User          string `json:"user"`
 }
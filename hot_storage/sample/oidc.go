@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenValidator authenticates a bearer token for one auth provider and
+// returns the user id and claims it carries.
+type tokenValidator interface {
+	Validate(ctx context.Context, token string) (string, jwt.MapClaims, error)
+}
+
+// authProviders maps X-Auth-Provider values to their validator. It is filled
+// by initAuthProviders and read-only afterwards.
+var authProviders = make(map[string]tokenValidator)
+
+// defaultAuthProvider validates tokens of the auth service at AUTH_SERVER_URL.
+var defaultAuthProvider tokenValidator
+
+var supportedAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"EdDSA": true,
+}
+
+var defaultAlgorithms = []string{"EdDSA", "RS256", "ES256"}
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// Reasons a token is rejected. They are logged, never returned to the client.
+const (
+	rejectMalformed       = "malformed"
+	rejectAlgorithm       = "alg_not_allowed"
+	rejectUnknownKey      = "unknown_key"
+	rejectSignature       = "bad_signature"
+	rejectMissingExpiry   = "missing_exp"
+	rejectExpired         = "expired"
+	rejectNotYetValid     = "not_yet_valid"
+	rejectIssuedInFuture  = "issued_in_future"
+	rejectMissingIssuedAt = "missing_iat"
+	rejectTooOld          = "token_too_old"
+	rejectIssuer          = "issuer_mismatch"
+	rejectAudience        = "audience_mismatch"
+	rejectMissingUserId   = "missing_user_id"
+	rejectUnknownProvider = "unknown_provider"
+)
+
+// authRejection is returned for a token that failed validation. Its message
+// is deliberately generic; Reason says what failed.
+type authRejection struct {
+	Reason string
+}
+
+func (e *authRejection) Error() string {
+	return "invalid token"
+}
+
+func reject(reason string) error {
+	return &authRejection{Reason: reason}
+}
+
+// oidcProviderConfig describes a JWT-issuing auth provider. The keys come from
+// JWKSURL or, when it is empty, from the jwks_uri of the OIDC discovery
+// document at DiscoveryURL, which defaults to
+// <Issuer>/.well-known/openid-configuration.
+//
+// A token must carry one of Issuer or Issuers as iss, one of Audiences in aud,
+// and an exp. ClockSkew and MaxTokenAge are durations such as "30s"; they
+// default to AUTH_CLOCK_SKEW and AUTH_MAX_TOKEN_AGE.
+type oidcProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	Issuers      []string `json:"issuers"`
+	JWKSURL      string   `json:"jwksUrl"`
+	DiscoveryURL string   `json:"discoveryUrl"`
+	Audiences    []string `json:"audiences"`
+	Algorithms   []string `json:"algorithms"`
+	UserIDClaim  string   `json:"userIdClaim"`
+	ClockSkew    string   `json:"clockSkew"`
+	MaxTokenAge  string   `json:"maxTokenAge"`
+}
+
+type oidcProvider struct {
+	config      oidcProviderConfig
+	issuers     []string
+	clockSkew   time.Duration
+	maxTokenAge time.Duration
+
+	// jwksMu guards the fields below. Discovery runs without it, one request
+	// per provider at a time.
+	jwksMu  sync.Mutex
+	jwksURL string
+	// discovering is closed when the discovery in progress ends.
+	discovering chan struct{}
+	// discoveryErr is the last failed discovery, returned until
+	// discoveryRetry so that an unreachable provider is not asked again on
+	// every request. discoveryBackoff doubles with each failure.
+	discoveryErr     error
+	discoveryRetry   time.Time
+	discoveryBackoff time.Duration
+}
+
+const (
+	oidcDiscoveryMinBackoff = 5 * time.Second
+	oidcDiscoveryMaxBackoff = 5 * time.Minute
+)
+
+type oidcDiscoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// initAuthProviders registers the built-in providers and those configured in
+// AUTH_PROVIDERS (inline JSON) or AUTH_PROVIDERS_FILE (path to JSON), both a
+// list of oidcProviderConfig. A configured provider replaces a built-in one of
+// the same name.
+//
+// The default provider checks AUTH_ISSUERS and AUTH_AUDIENCES, which default to
+// the auth service's issuer (see defaultAuthServiceClaim), and also accepts
+// opaque tokens when AUTH_OPAQUE_TOKENS is set. The google provider is only
+// enabled with GOOGLE_CLIENT_IDS, the OAuth client ids whose ID tokens are
+// accepted, and the firebase provider with FIREBASE_PROJECT_IDS.
+func initAuthProviders() error {
+	skew, err := envDuration("AUTH_CLOCK_SKEW", time.Minute)
+	if err != nil {
+		return err
+	}
+	maxAge, err := envDuration("AUTH_MAX_TOKEN_AGE", 0)
+	if err != nil {
+		return err
+	}
+	defaults := oidcProviderConfig{ClockSkew: skew.String(), MaxTokenAge: maxAge.String()}
+
+	defaultConfig := defaults
+	defaultConfig.Name = authProviderDefault
+	defaultConfig.JWKSURL = fmt.Sprintf("%s/.well-known/jwks.json", authServerURL)
+	defaultConfig.Issuers = defaultAuthServiceClaim("AUTH_ISSUERS", "iss")
+	defaultConfig.Audiences = defaultAuthServiceClaim("AUTH_AUDIENCES", "aud")
+	defaultProvider, err := newOIDCProvider(defaultConfig)
+	if err != nil {
+		return err
+	}
+	defaultAuthProvider = defaultProvider
+	// Introspection responses need not carry iss and aud, so only configured
+	// values are checked on them.
+	opaqueConfig := defaultConfig
+	if len(envList("AUTH_ISSUERS")) == 0 {
+		opaqueConfig.Issuers = nil
+	}
+	if len(envList("AUTH_AUDIENCES")) == 0 {
+		opaqueConfig.Audiences = nil
+	}
+	opaque, err := newOpaqueTokenProvider(defaultProvider, opaqueConfig)
+	if err != nil {
+		return err
+	}
+	if opaque != nil {
+		defaultAuthProvider = opaque
+	}
+
+	if clientIds := envList("GOOGLE_CLIENT_IDS"); len(clientIds) > 0 {
+		googleConfig := defaults
+		googleConfig.Name = authProviderGoogle
+		googleConfig.JWKSURL = authProviderGoogleUrl
+		googleConfig.Issuers = googleIssuers
+		googleConfig.Audiences = clientIds
+		google, err := newOIDCProvider(googleConfig)
+		if err != nil {
+			return err
+		}
+		authProviders[authProviderGoogle] = google
+	} else {
+		slog.Error("google auth provider disabled: GOOGLE_CLIENT_IDS is not set, requests with X-Auth-Provider: google will be refused")
+	}
+	if projectIds := envList("FIREBASE_PROJECT_IDS"); len(projectIds) > 0 {
+		firebase, err := newFirebaseProvider(defaults, projectIds, envList("FIREBASE_SIGN_IN_PROVIDERS"))
+		if err != nil {
+			return err
+		}
+		authProviders[authProviderFirebase] = firebase
+	} else {
+		slog.Error("firebase auth provider disabled: FIREBASE_PROJECT_IDS is not set, requests with X-Auth-Provider: firebase will be refused")
+	}
+	if playFab != nil {
+		authProviders[authProviderPlayFab] = playFab
+	} else {
+		slog.Error("playfab auth provider disabled: PLAYFAB_TITLE_ID is not set, requests with X-Auth-Provider: playfab will be refused")
+	}
+
+	configs, err := loadAuthProviderConfigs()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		if config.Name == authProviderDefault {
+			return fmt.Errorf("auth provider name %q is reserved", authProviderDefault)
+		}
+		if seen[config.Name] {
+			return fmt.Errorf("auth provider %q is configured more than once", config.Name)
+		}
+		seen[config.Name] = true
+		if config.Issuer == "" && len(config.Issuers) == 0 {
+			return fmt.Errorf("auth provider %q must set issuer or issuers", config.Name)
+		}
+		if len(config.Audiences) == 0 {
+			return fmt.Errorf("auth provider %q must set audiences", config.Name)
+		}
+		if config.ClockSkew == "" {
+			config.ClockSkew = defaults.ClockSkew
+		}
+		if config.MaxTokenAge == "" {
+			config.MaxTokenAge = defaults.MaxTokenAge
+		}
+		provider, err := newOIDCProvider(config)
+		if err != nil {
+			return err
+		}
+		authProviders[config.Name] = provider
+	}
+	return nil
+}
+
+// defaultAuthServiceClaim reads the iss or aud values the default provider
+// accepts from the comma-separated variable name. When it is unset they default
+// to the auth service's issuer: better-auth signs its JWTs with its base URL as
+// both iss and aud, so BETTER_AUTH_BASE_URL is used, or else AUTH_SERVER_URL.
+// "*" accepts any value.
+//
+// Before these defaults, the default provider accepted any iss and aud. The
+// default in effect is logged, since tokens of an auth service reached under
+// another URL are now refused.
+func defaultAuthServiceClaim(name, claim string) []string {
+	values := envList(name)
+	switch {
+	case len(values) == 1 && values[0] == "*":
+		return nil
+	case len(values) > 0:
+		return values
+	}
+	value := os.Getenv("BETTER_AUTH_BASE_URL")
+	if value == "" {
+		value = authServerURL
+	}
+	if value == "" {
+		return nil
+	}
+	slog.Warn(fmt.Sprintf("%s is not set: the default provider only accepts tokens whose %s is %q; set %s=* to accept any", name, claim, value, name))
+	return []string{value}
+}
+
+func loadAuthProviderConfigs() ([]oidcProviderConfig, error) {
+	inline := os.Getenv("AUTH_PROVIDERS")
+	path := os.Getenv("AUTH_PROVIDERS_FILE")
+	var data []byte
+	switch {
+	case inline != "" && path != "":
+		return nil, fmt.Errorf("set only one of AUTH_PROVIDERS and AUTH_PROVIDERS_FILE")
+	case inline != "":
+		data = []byte(inline)
+	case path != "":
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AUTH_PROVIDERS_FILE: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	var configs []oidcProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse auth provider configuration: %w", err)
+	}
+	return configs, nil
+}
+
+func newOIDCProvider(config oidcProviderConfig) (*oidcProvider, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("auth provider name must be set")
+	}
+	if config.JWKSURL == "" && config.DiscoveryURL == "" {
+		if config.Issuer == "" {
+			return nil, fmt.Errorf("auth provider %q needs a jwksUrl, a discoveryUrl or an issuer", config.Name)
+		}
+		config.DiscoveryURL = strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = defaultAlgorithms
+	}
+	for _, alg := range config.Algorithms {
+		if !supportedAlgorithms[alg] {
+			return nil, fmt.Errorf("auth provider %q: unsupported algorithm %q", config.Name, alg)
+		}
+	}
+	if config.UserIDClaim == "" {
+		config.UserIDClaim = "sub"
+	}
+
+	p := &oidcProvider{config: config, jwksURL: config.JWKSURL}
+	p.issuers = append(p.issuers, config.Issuers...)
+	if config.Issuer != "" {
+		p.issuers = append(p.issuers, config.Issuer)
+	}
+	var err error
+	if config.ClockSkew != "" {
+		if p.clockSkew, err = time.ParseDuration(config.ClockSkew); err != nil || p.clockSkew < 0 {
+			return nil, fmt.Errorf("auth provider %q: invalid clockSkew %q", config.Name, config.ClockSkew)
+		}
+	}
+	if config.MaxTokenAge != "" {
+		if p.maxTokenAge, err = time.ParseDuration(config.MaxTokenAge); err != nil || p.maxTokenAge < 0 {
+			return nil, fmt.Errorf("auth provider %q: invalid maxTokenAge %q", config.Name, config.MaxTokenAge)
+		}
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) Validate(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	jwksURL, err := p.resolveJWKS(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	k, err := getOrCreateKeyfunc(jwksURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return "", nil, reject(rejectMalformed)
+	}
+	if !slices.Contains(p.config.Algorithms, unverified.Method.Alg()) {
+		return "", nil, reject(rejectAlgorithm)
+	}
+
+	// Claims are checked below so that each failure has its own reason.
+	parsed, err := jwt.Parse(token, k.Keyfunc, jwt.WithValidMethods(p.config.Algorithms), jwt.WithoutClaimsValidation())
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "", nil, reject(rejectMalformed)
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		return "", nil, reject(rejectUnknownKey)
+	case err != nil:
+		return "", nil, reject(rejectSignature)
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+	if err := p.validateClaims(claims, time.Now()); err != nil {
+		return "", nil, err
+	}
+	userId, ok := claims[p.config.UserIDClaim].(string)
+	if !ok || userId == "" {
+		return "", nil, reject(rejectMissingUserId)
+	}
+	return userId, claims, nil
+}
+
+func (p *oidcProvider) prefetchJWKS(ctx context.Context) error {
+	jwksURL, err := p.resolveJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = getOrCreateKeyfunc(jwksURL)
+	return err
+}
+
+// validateClaims checks the registered claims, allowing clockSkew on every
+// time comparison.
+func (p *oidcProvider) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	if exp == nil {
+		return reject(rejectMissingExpiry)
+	}
+	if now.After(exp.Add(p.clockSkew)) {
+		return reject(rejectExpired)
+	}
+
+	nbf, err := claims.GetNotBefore()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	if nbf != nil && now.Add(p.clockSkew).Before(nbf.Time) {
+		return reject(rejectNotYetValid)
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return reject(rejectMalformed)
+	}
+	if iat != nil && now.Add(p.clockSkew).Before(iat.Time) {
+		return reject(rejectIssuedInFuture)
+	}
+	if p.maxTokenAge > 0 {
+		if iat == nil {
+			return reject(rejectMissingIssuedAt)
+		}
+		if now.Sub(iat.Time) > p.maxTokenAge+p.clockSkew {
+			return reject(rejectTooOld)
+		}
+	}
+
+	if len(p.issuers) > 0 {
+		iss, err := claims.GetIssuer()
+		if err != nil || !slices.Contains(p.issuers, iss) {
+			return reject(rejectIssuer)
+		}
+	}
+	if len(p.config.Audiences) > 0 {
+		aud, err := claims.GetAudience()
+		if err != nil || !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(p.config.Audiences, a) }) {
+			return reject(rejectAudience)
+		}
+	}
+	return nil
+}
+
+// resolveJWKS returns the configured JWKS URL or, failing that, fetches it
+// from the discovery document. Concurrent callers wait for one fetch. A failed
+// fetch is returned again until its backoff has elapsed.
+func (p *oidcProvider) resolveJWKS(ctx context.Context) (string, error) {
+	for {
+		p.jwksMu.Lock()
+		if p.jwksURL != "" {
+			jwksURL := p.jwksURL
+			p.jwksMu.Unlock()
+			return jwksURL, nil
+		}
+		if p.discoveryErr != nil && time.Now().Before(p.discoveryRetry) {
+			err := p.discoveryErr
+			p.jwksMu.Unlock()
+			return "", err
+		}
+		done := p.discovering
+		if done == nil {
+			break
+		}
+		p.jwksMu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	p.discovering = done
+	p.jwksMu.Unlock()
+
+	jwksURL, err := p.discoverJWKS(ctx)
+
+	p.jwksMu.Lock()
+	p.discovering = nil
+	if err == nil {
+		p.jwksURL = jwksURL
+		p.discoveryErr, p.discoveryBackoff = nil, 0
+	} else {
+		p.discoveryBackoff = min(max(2*p.discoveryBackoff, oidcDiscoveryMinBackoff), oidcDiscoveryMaxBackoff)
+		p.discoveryErr, p.discoveryRetry = err, time.Now().Add(p.discoveryBackoff)
+	}
+	p.jwksMu.Unlock()
+	close(done)
+	return jwksURL, err
+}
+
+// discoverJWKS fetches the jwks_uri of the discovery document. Other requests
+// wait for it, so it does not end with the request that started it.
+func (p *oidcProvider) discoverJWKS(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.DiscoveryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc discovery for %s failed: %w", p.config.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc discovery for %s failed with status %d", p.config.Name, resp.StatusCode)
+	}
+
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return "", fmt.Errorf("failed to decode oidc discovery document for %s: %w", p.config.Name, err)
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("oidc discovery document for %s has no jwks_uri", p.config.Name)
+	}
+	if p.config.Issuer != "" && doc.Issuer != p.config.Issuer {
+		return "", fmt.Errorf("oidc discovery document for %s names issuer %q, expected %q", p.config.Name, doc.Issuer, p.config.Issuer)
+	}
+	return doc.JWKSURI, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// saveAuthProviders restores the provider registry when the test ends.
+func saveAuthProviders(t *testing.T) {
+	t.Helper()
+	providers, defaultProvider := maps.Clone(authProviders), defaultAuthProvider
+	t.Cleanup(func() { authProviders, defaultAuthProvider = providers, defaultProvider })
+}
+
+func TestInitAuthProviders(t *testing.T) {
+	saveAuthProviders(t)
+	t.Setenv("AUTH_CLOCK_SKEW", "30s")
+	t.Setenv("AUTH_PROVIDERS", `[
+		{"name": "corp", "issuer": "https://login.corp.example", "audiences": ["opensigner"], "maxTokenAge": "1h"},
+		{"name": "partner", "issuers": ["https://a.partner.example", "https://b.partner.example"], "audiences": ["x"], "jwksUrl": "https://partner.example/jwks", "algorithms": ["ES256"], "userIdClaim": "uid"}
+	]`)
+	if err := initAuthProviders(); err != nil {
+		t.Fatal(err)
+	}
+
+	corp, ok := authProviders["corp"].(*oidcProvider)
+	if !ok {
+		t.Fatalf("corp provider = %T", authProviders["corp"])
+	}
+	if corp.config.DiscoveryURL != "https://login.corp.example/.well-known/openid-configuration" {
+		t.Errorf("corp discovery URL = %s", corp.config.DiscoveryURL)
+	}
+	if corp.clockSkew != 30*time.Second || corp.maxTokenAge != time.Hour {
+		t.Errorf("corp clockSkew = %s, maxTokenAge = %s", corp.clockSkew, corp.maxTokenAge)
+	}
+	if !slices.Equal(corp.config.Algorithms, defaultAlgorithms) || corp.config.UserIDClaim != "sub" {
+		t.Errorf("corp algorithms = %v, userIdClaim = %s", corp.config.Algorithms, corp.config.UserIDClaim)
+	}
+
+	partner, ok := authProviders["partner"].(*oidcProvider)
+	if !ok {
+		t.Fatalf("partner provider = %T", authProviders["partner"])
+	}
+	if len(partner.issuers) != 2 || partner.jwksURL != "https://partner.example/jwks" || partner.config.DiscoveryURL != "" {
+		t.Errorf("partner issuers = %v, jwksURL = %s, discovery URL = %s", partner.issuers, partner.jwksURL, partner.config.DiscoveryURL)
+	}
+	if partner.config.UserIDClaim != "uid" {
+		t.Errorf("partner userIdClaim = %s", partner.config.UserIDClaim)
+	}
+}
+
+func TestInitAuthProvidersFile(t *testing.T) {
+	saveAuthProviders(t)
+	path := filepath.Join(t.TempDir(), "providers.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "corp", "issuer": "https://login.corp.example", "audiences": ["opensigner"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTH_PROVIDERS_FILE", path)
+	if err := initAuthProviders(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := authProviders["corp"]; !ok {
+		t.Error("provider of AUTH_PROVIDERS_FILE not registered")
+	}
+
+	t.Setenv("AUTH_PROVIDERS", "[]")
+	if err := initAuthProviders(); err == nil {
+		t.Error("both AUTH_PROVIDERS and AUTH_PROVIDERS_FILE accepted")
+	}
+}
+
+func TestInitAuthProvidersRejectsBadConfig(t *testing.T) {
+	saveAuthProviders(t)
+	for name, config := range map[string]string{
+		"not json":         `{`,
+		"reserved name":    `[{"name": "default", "issuer": "https://i", "audiences": ["a"]}]`,
+		"duplicate name":   `[{"name": "p", "issuer": "https://i", "audiences": ["a"]}, {"name": "p", "issuer": "https://j", "audiences": ["a"]}]`,
+		"missing name":     `[{"issuer": "https://i", "audiences": ["a"]}]`,
+		"missing issuer":   `[{"name": "p", "jwksUrl": "https://i/jwks", "audiences": ["a"]}]`,
+		"missing audience": `[{"name": "p", "issuer": "https://i"}]`,
+		"bad algorithm":    `[{"name": "p", "issuer": "https://i", "audiences": ["a"], "algorithms": ["HS256"]}]`,
+		"bad clock skew":   `[{"name": "p", "issuer": "https://i", "audiences": ["a"], "clockSkew": "-1s"}]`,
+		"bad max age":      `[{"name": "p", "issuer": "https://i", "audiences": ["a"], "maxTokenAge": "soon"}]`,
+	} {
+		t.Setenv("AUTH_PROVIDERS", config)
+		if err := initAuthProviders(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAuthenticateTokenProviderLookup(t *testing.T) {
+	saveAuthProviders(t)
+	useTestProvider(t, staticTokenValidator{"token": "alice"})
+	defaultAuthProvider = staticTokenValidator{"default-token": "bob"}
+
+	identity, err := authenticateToken(context.Background(), "token", authProviderTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != "alice" || identity.AuthProvider != authProviderTest {
+		t.Errorf("identity = %s/%s", identity.UserID, identity.AuthProvider)
+	}
+
+	identity, err = authenticateToken(context.Background(), "default-token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != "bob" || identity.AuthProvider != authProviderDefault {
+		t.Errorf("default identity = %s/%s", identity.UserID, identity.AuthProvider)
+	}
+
+	if _, err := authenticateToken(context.Background(), "token", "unknown"); rejectionReason(err) != rejectUnknownProvider {
+		t.Errorf("unknown provider: err = %v, want %s", err, rejectUnknownProvider)
+	}
+	if _, err := authenticateToken(context.Background(), "default-token", authProviderTest); err == nil {
+		t.Error("token of the default provider accepted by another provider")
+	}
+}
+
+// newDiscoveryServer serves a discovery document naming itself as issuer, or
+// answers with status when it is not 200, and counts the requests. With
+// release, it answers once release is closed.
+func newDiscoveryServer(t *testing.T, status *atomic.Int32, release <-chan struct{}) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if release != nil {
+			<-release
+		}
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		writeJSON(w, map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/jwks"})
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestResolveJWKSDiscoversOnce(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	release := make(chan struct{})
+	server, hits := newDiscoveryServer(t, &status, release)
+	p, err := newOIDCProvider(oidcProviderConfig{Name: "p", Issuer: server.URL, Audiences: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = p.resolveJWKS(context.Background())
+		}()
+	}
+	// Let the callers pile up behind the first fetch before it answers.
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, got := range results {
+		if got != server.URL+"/jwks" {
+			t.Errorf("caller %d got %q", i, got)
+		}
+	}
+	if _, err := p.resolveJWKS(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d discovery requests, want 1", n)
+	}
+}
+
+func TestResolveJWKSBacksOffAfterFailure(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server, hits := newDiscoveryServer(t, &status, nil)
+	p, err := newOIDCProvider(oidcProviderConfig{Name: "p", Issuer: server.URL, Audiences: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		if _, err := p.resolveJWKS(context.Background()); err == nil {
+			t.Fatalf("call %d succeeded", i)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d discovery requests during the backoff, want 1", n)
+	}
+	if p.discoveryBackoff != oidcDiscoveryMinBackoff {
+		t.Errorf("backoff = %s, want %s", p.discoveryBackoff, oidcDiscoveryMinBackoff)
+	}
+
+	// The next failure doubles the backoff.
+	p.discoveryRetry = time.Now()
+	p.resolveJWKS(context.Background())
+	if p.discoveryBackoff != 2*oidcDiscoveryMinBackoff {
+		t.Errorf("backoff = %s after a second failure, want %s", p.discoveryBackoff, 2*oidcDiscoveryMinBackoff)
+	}
+
+	status.Store(http.StatusOK)
+	p.discoveryRetry = time.Now()
+	jwksURL, err := p.resolveJWKS(context.Background())
+	if err != nil {
+		t.Fatalf("after the backoff: %v", err)
+	}
+	if want := fmt.Sprintf("%s/jwks", server.URL); jwksURL != want {
+		t.Errorf("jwks URL = %s, want %s", jwksURL, want)
+	}
+	if p.discoveryErr != nil || p.discoveryBackoff != 0 {
+		t.Errorf("failure kept after a successful discovery")
+	}
+}
+
+func TestValidateClaims(t *testing.T) {
+	p, err := newOIDCProvider(oidcProviderConfig{
+		Name:        "p",
+		Issuer:      "https://issuer.example",
+		JWKSURL:     "https://issuer.example/jwks",
+		Audiences:   []string{"opensigner"},
+		ClockSkew:   "1m",
+		MaxTokenAge: "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	at := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"iss": "https://issuer.example", "aud": "opensigner", "exp": at(time.Hour), "iat": at(-time.Minute)}
+	}
+
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+		want   string
+	}{
+		{"valid", func(c jwt.MapClaims) {}, ""},
+		{"audience list", func(c jwt.MapClaims) { c["aud"] = []any{"other", "opensigner"} }, ""},
+		{"expired within skew", func(c jwt.MapClaims) { c["exp"] = at(-30 * time.Second) }, ""},
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://other.example" }, rejectIssuer},
+		{"missing issuer", func(c jwt.MapClaims) { delete(c, "iss") }, rejectIssuer},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other" }, rejectAudience},
+		{"missing audience", func(c jwt.MapClaims) { delete(c, "aud") }, rejectAudience},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = at(-2 * time.Minute) }, rejectExpired},
+		{"missing exp", func(c jwt.MapClaims) { delete(c, "exp") }, rejectMissingExpiry},
+		{"malformed exp", func(c jwt.MapClaims) { c["exp"] = "tomorrow" }, rejectMalformed},
+		{"not yet valid", func(c jwt.MapClaims) { c["nbf"] = at(2 * time.Minute) }, rejectNotYetValid},
+		{"nbf within skew", func(c jwt.MapClaims) { c["nbf"] = at(30 * time.Second) }, ""},
+		{"issued in future", func(c jwt.MapClaims) { c["iat"] = at(2 * time.Minute) }, rejectIssuedInFuture},
+		{"too old", func(c jwt.MapClaims) { c["iat"] = at(-2 * time.Hour) }, rejectTooOld},
+		{"missing iat", func(c jwt.MapClaims) { delete(c, "iat") }, rejectMissingIssuedAt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := valid()
+			test.change(claims)
+			err := p.validateClaims(claims, now)
+			if got := rejectionReason(err); got != test.want || (test.want == "" && err != nil) {
+				t.Errorf("validateClaims: %v (%q), want %q", err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDefaultAuthServiceClaim(t *testing.T) {
+	prev := authServerURL
+	t.Cleanup(func() { authServerURL = prev })
+	authServerURL = "http://auth:3000"
+
+	if got := defaultAuthServiceClaim("AUTH_ISSUERS", "iss"); !slices.Equal(got, []string{"http://auth:3000"}) {
+		t.Errorf("without BETTER_AUTH_BASE_URL = %v", got)
+	}
+	t.Setenv("BETTER_AUTH_BASE_URL", "https://auth.example")
+	if got := defaultAuthServiceClaim("AUTH_ISSUERS", "iss"); !slices.Equal(got, []string{"https://auth.example"}) {
+		t.Errorf("with BETTER_AUTH_BASE_URL = %v", got)
+	}
+	t.Setenv("AUTH_ISSUERS", "https://a.example, https://b.example")
+	if got := defaultAuthServiceClaim("AUTH_ISSUERS", "iss"); !slices.Equal(got, []string{"https://a.example", "https://b.example"}) {
+		t.Errorf("with AUTH_ISSUERS = %v", got)
+	}
+	t.Setenv("AUTH_ISSUERS", "*")
+	if got := defaultAuthServiceClaim("AUTH_ISSUERS", "iss"); got != nil {
+		t.Errorf("with AUTH_ISSUERS=* = %v, want any", got)
+	}
+}
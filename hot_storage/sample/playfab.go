@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	playFabTokenSessionTicket = "session_ticket"
+	playFabTokenEntity        = "entity_token"
+
+	headerPlayFabSecretKey   = "X-SecretKey"
+	headerPlayFabEntityToken = "X-EntityToken"
+)
+
+// playFab is set by initPlayFab when PLAYFAB_TITLE_ID is configured.
+var playFab *playFabAuth
+
+// playFabAuth validates PlayFab player credentials against the title's API:
+//
+//	session_ticket  POST /Server/AuthenticateSessionTicket  (X-SecretKey)
+//	entity_token    POST /Authentication/ValidateEntityToken (X-EntityToken of the title)
+//
+// Either way the player's master PlayFabId becomes the user id, so both token
+// types map to the same Account.Username.
+type playFabAuth struct {
+	titleId   string
+	baseURL   string
+	secretKey string
+	tokenType string
+	client    *http.Client
+	cache     *tokenCache
+
+	titleTokenMu      sync.Mutex
+	titleToken        string
+	titleTokenExpires time.Time
+}
+
+type playFabResponse struct {
+	Code         int             `json:"code"`
+	Status       string          `json:"status"`
+	Error        string          `json:"error"`
+	ErrorMessage string          `json:"errorMessage"`
+	Data         json.RawMessage `json:"data"`
+}
+
+type playFabSessionTicketRequest struct {
+	SessionTicket string `json:"SessionTicket"`
+}
+
+type playFabSessionTicketResult struct {
+	UserInfo struct {
+		PlayFabId string `json:"PlayFabId"`
+	} `json:"UserInfo"`
+	IsSessionTicketExpired bool `json:"IsSessionTicketExpired"`
+}
+
+type playFabEntityTokenRequest struct {
+	EntityToken string `json:"EntityToken"`
+}
+
+type playFabEntityTokenResult struct {
+	Entity struct {
+		Id   string `json:"Id"`
+		Type string `json:"Type"`
+	} `json:"Entity"`
+	Lineage struct {
+		MasterPlayerAccountId string `json:"MasterPlayerAccountId"`
+		TitleId               string `json:"TitleId"`
+	} `json:"Lineage"`
+}
+
+type playFabGetEntityTokenResult struct {
+	EntityToken     string    `json:"EntityToken"`
+	TokenExpiration time.Time `json:"TokenExpiration"`
+}
+
+// initPlayFab configures the playfab auth provider:
+//
+//	PLAYFAB_TITLE_ID         title id; the provider is disabled when unset
+//	PLAYFAB_SECRET_KEY_FILE  file holding the title secret key (or PLAYFAB_SECRET_KEY)
+//	PLAYFAB_API_URL          title endpoint, default https://<title id>.playfabapi.com
+//	PLAYFAB_TOKEN_TYPE       "session_ticket" (default) or "entity_token"
+//	PLAYFAB_TIMEOUT          upstream request timeout, default 5s
+//	PLAYFAB_CACHE_TTL        how long a validated token is reused, default 1m
+//	PLAYFAB_CACHE_SIZE       maximum cached tokens, default 10000
+func initPlayFab() error {
+	titleId := os.Getenv("PLAYFAB_TITLE_ID")
+	if titleId == "" {
+		return nil
+	}
+
+	secretKey := os.Getenv("PLAYFAB_SECRET_KEY")
+	if path := os.Getenv("PLAYFAB_SECRET_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read PLAYFAB_SECRET_KEY_FILE: %w", err)
+		}
+		secretKey = strings.TrimSpace(string(data))
+	}
+	if secretKey == "" {
+		return fmt.Errorf("PLAYFAB_SECRET_KEY_FILE or PLAYFAB_SECRET_KEY must be set when PLAYFAB_TITLE_ID is set")
+	}
+
+	baseURL := strings.TrimSuffix(os.Getenv("PLAYFAB_API_URL"), "/")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("https://%s.playfabapi.com", strings.ToLower(titleId))
+	}
+	tokenType := os.Getenv("PLAYFAB_TOKEN_TYPE")
+	if tokenType == "" {
+		tokenType = playFabTokenSessionTicket
+	}
+	if tokenType != playFabTokenSessionTicket && tokenType != playFabTokenEntity {
+		return fmt.Errorf("PLAYFAB_TOKEN_TYPE must be %q or %q", playFabTokenSessionTicket, playFabTokenEntity)
+	}
+	timeout, err := envDuration("PLAYFAB_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	cacheTTL, err := envDuration("PLAYFAB_CACHE_TTL", time.Minute)
+	if err != nil {
+		return err
+	}
+	cacheSize, err := envInt("PLAYFAB_CACHE_SIZE", 10000)
+	if err != nil {
+		return err
+	}
+
+	playFab = &playFabAuth{
+		titleId:   titleId,
+		baseURL:   baseURL,
+		secretKey: secretKey,
+		tokenType: tokenType,
+		client:    &http.Client{Timeout: timeout},
+		cache:     newTokenCache(cacheTTL, cacheSize),
+	}
+	return nil
+}
+
+// Validate returns the PlayFabId the token belongs to. The claims carry it as
+// "sub" together with the title id as "title_id".
+func (p *playFabAuth) Validate(ctx context.Context, token string) (string, jwt.MapClaims, error) {
+	if userId, claims, ok := p.cache.get(token); ok {
+		return userId, claims, nil
+	}
+
+	var playFabId string
+	var err error
+	switch p.tokenType {
+	case playFabTokenEntity:
+		playFabId, err = p.validateEntityToken(ctx, token)
+	default:
+		playFabId, err = p.validateSessionTicket(ctx, token)
+	}
+	if err != nil {
+		slog.Info(fmt.Sprintf("failed to authenticate playfab user: '%v'", err))
+		return "", nil, err
+	}
+
+	claims := jwt.MapClaims{"sub": playFabId, "title_id": p.titleId}
+	p.cache.put(token, playFabId, claims, time.Time{})
+	return playFabId, claims, nil
+}
+
+func (p *playFabAuth) validateSessionTicket(ctx context.Context, ticket string) (string, error) {
+	var result playFabSessionTicketResult
+	err := p.call(ctx, "/Server/AuthenticateSessionTicket", headerPlayFabSecretKey, p.secretKey, playFabSessionTicketRequest{SessionTicket: ticket}, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.IsSessionTicketExpired {
+		return "", errors.New("playfab session ticket expired")
+	}
+	if result.UserInfo.PlayFabId == "" {
+		return "", errors.New("playfab returned no PlayFabId")
+	}
+	return result.UserInfo.PlayFabId, nil
+}
+
+func (p *playFabAuth) validateEntityToken(ctx context.Context, entityToken string) (string, error) {
+	titleToken, err := p.titleEntityToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	var result playFabEntityTokenResult
+	if err := p.call(ctx, "/Authentication/ValidateEntityToken", headerPlayFabEntityToken, titleToken, playFabEntityTokenRequest{EntityToken: entityToken}, &result); err != nil {
+		return "", err
+	}
+	if result.Entity.Type != "title_player_account" && result.Entity.Type != "master_player_account" {
+		return "", fmt.Errorf("playfab entity type %q is not a player", result.Entity.Type)
+	}
+	if result.Lineage.TitleId != "" && !strings.EqualFold(result.Lineage.TitleId, p.titleId) {
+		return "", fmt.Errorf("playfab entity token belongs to title %q", result.Lineage.TitleId)
+	}
+	if result.Lineage.MasterPlayerAccountId == "" {
+		return "", errors.New("playfab returned no master player account id")
+	}
+	return result.Lineage.MasterPlayerAccountId, nil
+}
+
+// titleEntityToken returns the title's own entity token, needed to validate
+// player entity tokens, refreshing it a minute before it expires.
+func (p *playFabAuth) titleEntityToken(ctx context.Context) (string, error) {
+	p.titleTokenMu.Lock()
+	defer p.titleTokenMu.Unlock()
+	if p.titleToken != "" && time.Now().Add(time.Minute).Before(p.titleTokenExpires) {
+		return p.titleToken, nil
+	}
+
+	var result playFabGetEntityTokenResult
+	if err := p.call(ctx, "/Authentication/GetEntityToken", headerPlayFabSecretKey, p.secretKey, struct{}{}, &result); err != nil {
+		return "", fmt.Errorf("failed to get playfab title entity token: %w", err)
+	}
+	if result.EntityToken == "" {
+		return "", errors.New("playfab returned no title entity token")
+	}
+	p.titleToken, p.titleTokenExpires = result.EntityToken, result.TokenExpiration
+	return p.titleToken, nil
+}
+
+func (p *playFabAuth) call(ctx context.Context, path, authHeader, authValue string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeHeader, contentTypeJSON)
+	req.Header.Set(authHeader, authValue)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("playfab request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope playFabResponse
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<16)).Decode(&envelope); err != nil {
+		return fmt.Errorf("failed to decode playfab response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || envelope.Code != http.StatusOK {
+		return fmt.Errorf("playfab rejected the request: %d %s: %s", resp.StatusCode, envelope.Error, envelope.ErrorMessage)
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("failed to decode playfab response data: %w", err)
+	}
+	return nil
+}
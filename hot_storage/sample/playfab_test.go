@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPlayFabSecret = "title-secret"
+
+// mockPlayFab is a local stand-in for a PlayFab title API.
+type mockPlayFab struct {
+	*httptest.Server
+	calls atomic.Int32
+	// handle answers a call the mock does not answer itself.
+	handle func(w http.ResponseWriter, path string, body map[string]any)
+}
+
+func newMockPlayFab(t *testing.T, handle func(w http.ResponseWriter, path string, body map[string]any)) *mockPlayFab {
+	t.Helper()
+	m := &mockPlayFab{handle: handle}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.calls.Add(1)
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		switch r.URL.Path {
+		case "/Server/AuthenticateSessionTicket", "/Authentication/GetEntityToken":
+			if got := r.Header.Get(headerPlayFabSecretKey); got != testPlayFabSecret {
+				writePlayFab(w, http.StatusUnauthorized, "NotAuthorized", nil)
+				return
+			}
+		case "/Authentication/ValidateEntityToken":
+			if got := r.Header.Get(headerPlayFabEntityToken); got != "title-entity-token" {
+				writePlayFab(w, http.StatusUnauthorized, "NotAuthorized", nil)
+				return
+			}
+		}
+		if r.URL.Path == "/Authentication/GetEntityToken" {
+			writePlayFab(w, http.StatusOK, "", playFabGetEntityTokenResult{EntityToken: "title-entity-token", TokenExpiration: time.Now().Add(time.Hour)})
+			return
+		}
+		m.handle(w, r.URL.Path, body)
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func writePlayFab(w http.ResponseWriter, code int, playFabError string, data any) {
+	raw, _ := json.Marshal(data)
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(playFabResponse{Code: code, Status: http.StatusText(code), Error: playFabError, Data: raw})
+}
+
+func setupPlayFab(t *testing.T, url, tokenType string) {
+	t.Helper()
+	t.Setenv("PLAYFAB_TITLE_ID", "A1B2C")
+	t.Setenv("PLAYFAB_SECRET_KEY", testPlayFabSecret)
+	t.Setenv("PLAYFAB_API_URL", url)
+	t.Setenv("PLAYFAB_TOKEN_TYPE", tokenType)
+	t.Setenv("PLAYFAB_TIMEOUT", "200ms")
+	if err := initPlayFab(); err != nil {
+		t.Fatalf("initPlayFab: %v", err)
+	}
+	t.Cleanup(func() { playFab = nil })
+}
+
+func sessionTicketResult(playFabId string, expired bool) playFabSessionTicketResult {
+	var result playFabSessionTicketResult
+	result.UserInfo.PlayFabId = playFabId
+	result.IsSessionTicketExpired = expired
+	return result
+}
+
+func TestPlayFabValidSessionTicket(t *testing.T) {
+	m := newMockPlayFab(t, func(w http.ResponseWriter, path string, body map[string]any) {
+		if path != "/Server/AuthenticateSessionTicket" || body["SessionTicket"] != "ticket" {
+			writePlayFab(w, http.StatusBadRequest, "InvalidSessionTicket", nil)
+			return
+		}
+		writePlayFab(w, http.StatusOK, "", sessionTicketResult("PLAYER1", false))
+	})
+	setupPlayFab(t, m.URL, playFabTokenSessionTicket)
+
+	for range 2 {
+		userId, claims, err := playFab.Validate(context.Background(), "ticket")
+		if err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		if userId != "PLAYER1" || claims["sub"] != "PLAYER1" || claims["title_id"] != "A1B2C" {
+			t.Fatalf("got user %q claims %v", userId, claims)
+		}
+	}
+	if got := m.calls.Load(); got != 1 {
+		t.Errorf("PlayFab was called %d times, want 1 with the second call cached", got)
+	}
+}
+
+func TestPlayFabInvalidSessionTicket(t *testing.T) {
+	m := newMockPlayFab(t, func(w http.ResponseWriter, path string, body map[string]any) {
+		switch body["SessionTicket"] {
+		case "expired":
+			writePlayFab(w, http.StatusOK, "", sessionTicketResult("PLAYER1", true))
+		default:
+			writePlayFab(w, http.StatusBadRequest, "InvalidSessionTicket", nil)
+		}
+	})
+	setupPlayFab(t, m.URL, playFabTokenSessionTicket)
+
+	for _, ticket := range []string{"invalid", "expired"} {
+		if _, _, err := playFab.Validate(context.Background(), ticket); err == nil {
+			t.Errorf("Validate(%q) succeeded", ticket)
+		}
+		// A refused ticket must not be cached as valid.
+		if _, _, ok := playFab.cache.get(ticket); ok {
+			t.Errorf("refused ticket %q was cached", ticket)
+		}
+	}
+}
+
+func TestPlayFabUpstreamFailure(t *testing.T) {
+	t.Run("5xx", func(t *testing.T) {
+		m := newMockPlayFab(t, func(w http.ResponseWriter, path string, body map[string]any) {
+			writePlayFab(w, http.StatusServiceUnavailable, "ServiceUnavailable", nil)
+		})
+		setupPlayFab(t, m.URL, playFabTokenSessionTicket)
+		if _, _, err := playFab.Validate(context.Background(), "ticket"); err == nil {
+			t.Fatal("Validate succeeded on a 503")
+		}
+	})
+
+	t.Run("non-JSON 5xx", func(t *testing.T) {
+		m := newMockPlayFab(t, func(w http.ResponseWriter, path string, body map[string]any) {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		})
+		setupPlayFab(t, m.URL, playFabTokenSessionTicket)
+		if _, _, err := playFab.Validate(context.Background(), "ticket"); err == nil {
+			t.Fatal("Validate succeeded on a 502")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		m := newMockPlayFab(t, func(w http.ResponseWriter, path string, body map[string]any) {
+			<-release
+		})
+		t.Cleanup(func() { close(release) })
+		setupPlayFab(t, m.URL, playFabTokenSessionTicket)
+
+		start := time.Now()
+		if _, _, err := playFab.Validate(context.Background(), "ticket"); err == nil {
+			t.Fatal("Validate succeeded although PlayFab never answered")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Validate took %v, want PLAYFAB_TIMEOUT to cut it short", elapsed)
+		}
+	})
+}
+
+func TestPlayFabEntityToken(t *testing.T) {
+	lineage := func(titleId string) func(w http.ResponseWriter, path string, body map[string]any) {
+		return func(w http.ResponseWriter, path string, body map[string]any) {
+			var result playFabEntityTokenResult
+			result.Entity.Type = "title_player_account"
+			result.Lineage.MasterPlayerAccountId = "MASTER1"
+			result.Lineage.TitleId = titleId
+			writePlayFab(w, http.StatusOK, "", result)
+		}
+	}
+
+	t.Run("same title", func(t *testing.T) {
+		m := newMockPlayFab(t, lineage("a1b2c"))
+		setupPlayFab(t, m.URL, playFabTokenEntity)
+		userId, _, err := playFab.Validate(context.Background(), "player-entity-token")
+		if err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+		if userId != "MASTER1" {
+			t.Errorf("user = %q, want the master player account", userId)
+		}
+	})
+
+	t.Run("title mismatch", func(t *testing.T) {
+		m := newMockPlayFab(t, lineage("OTHER"))
+		setupPlayFab(t, m.URL, playFabTokenEntity)
+		if _, _, err := playFab.Validate(context.Background(), "player-entity-token"); err == nil {
+			t.Fatal("Validate accepted an entity token of another title")
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	quotaAccounts         = "accounts"
+	quotaAccountsPerChain = "accounts_per_chain"
+	quotaDevices          = "devices"
+)
+
+// quotaLimits caps what a user can create. A zero limit is unlimited.
+type quotaLimits struct {
+	// MaxAccounts caps the accounts of a user.
+	MaxAccounts int
+	// MaxAccountsPerChain caps the accounts of a user on one chain.
+	MaxAccountsPerChain int
+	// MaxDevices caps the non-primary devices of a signer.
+	MaxDevices int
+}
+
+var (
+	// defaultQuota applies to auth providers without an entry in
+	// providerQuotas.
+	defaultQuota = quotaLimits{MaxAccounts: 100, MaxDevices: 10}
+
+	// providerQuotas is QUOTA_PROVIDERS, keyed by account auth provider.
+	providerQuotas map[string]quotaLimits
+)
+
+// quotaError is returned when creating an account or device would exceed a
+// quota.
+type quotaError struct {
+	Quota string
+	Limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s quota of %d exceeded", e.Quota, e.Limit)
+}
+
+// initQuotas reads the quotas:
+//
+//	QUOTA_MAX_ACCOUNTS            accounts per user, default 100
+//	QUOTA_MAX_ACCOUNTS_PER_CHAIN  accounts per user and chain, default unlimited
+//	QUOTA_MAX_DEVICES             non-primary devices per signer, default 10
+//	QUOTA_PROVIDERS               JSON object of limits by auth provider, overriding the above
+func initQuotas() error {
+	for _, setting := range []struct {
+		env   string
+		limit *int
+	}{
+		{"QUOTA_MAX_ACCOUNTS", &defaultQuota.MaxAccounts},
+		{"QUOTA_MAX_ACCOUNTS_PER_CHAIN", &defaultQuota.MaxAccountsPerChain},
+		{"QUOTA_MAX_DEVICES", &defaultQuota.MaxDevices},
+	} {
+		n, err := envInt(setting.env, *setting.limit)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("%s must not be negative", setting.env)
+		}
+		*setting.limit = n
+	}
+
+	providerQuotas = nil
+	v := os.Getenv("QUOTA_PROVIDERS")
+	if v == "" {
+		return nil
+	}
+	// Limits a provider leaves out keep the defaults; 0 makes them unlimited.
+	var configs map[string]struct {
+		MaxAccounts         *int `json:"maxAccounts"`
+		MaxAccountsPerChain *int `json:"maxAccountsPerChain"`
+		MaxDevices          *int `json:"maxDevices"`
+	}
+	if err := json.Unmarshal([]byte(v), &configs); err != nil {
+		return fmt.Errorf("failed to parse QUOTA_PROVIDERS: %w", err)
+	}
+	providerQuotas = make(map[string]quotaLimits, len(configs))
+	for provider, config := range configs {
+		limits := defaultQuota
+		for _, field := range []struct {
+			value *int
+			limit *int
+		}{
+			{config.MaxAccounts, &limits.MaxAccounts},
+			{config.MaxAccountsPerChain, &limits.MaxAccountsPerChain},
+			{config.MaxDevices, &limits.MaxDevices},
+		} {
+			if field.value == nil {
+				continue
+			}
+			if *field.value < 0 {
+				return fmt.Errorf("QUOTA_PROVIDERS: limits of %q must not be negative", provider)
+			}
+			*field.limit = *field.value
+		}
+		providerQuotas[provider] = limits
+	}
+	return nil
+}
+
+// quotaFor returns the quota of a user: their override of each limit where
+// one is set, including 0 for unlimited, otherwise the quota of their auth
+// provider. An entry for "firebase" covers
+// every "firebase:<project id>" provider without an entry of its own.
+func quotaFor(tx *gorm.DB, userId, authProvider string) (quotaLimits, error) {
+	limits, ok := providerQuotas[authProvider]
+	if !ok {
+		base, _, _ := strings.Cut(authProvider, ":")
+		if limits, ok = providerQuotas[base]; !ok {
+			limits = defaultQuota
+		}
+	}
+
+	var override UserQuota
+	err := tx.First(&override, "username = ? AND auth_provider = ?", userId, authProvider).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return limits, nil
+	}
+	if err != nil {
+		return quotaLimits{}, fmt.Errorf("failed to read quota: %w", err)
+	}
+	if override.MaxAccounts != nil {
+		limits.MaxAccounts = *override.MaxAccounts
+	}
+	if override.MaxAccountsPerChain != nil {
+		limits.MaxAccountsPerChain = *override.MaxAccountsPerChain
+	}
+	if override.MaxDevices != nil {
+		limits.MaxDevices = *override.MaxDevices
+	}
+	return limits, nil
+}
+
+// checkAccountQuota refuses a new account for the user on chainId when it
+// would exceed their quota. It holds a lock on the user until tx ends, so
+// concurrent requests cannot both take the last slot.
+func checkAccountQuota(tx *gorm.DB, userId, authProvider string, chainId int64) error {
+	limits, err := quotaFor(tx, userId, authProvider)
+	if err != nil {
+		return databaseError(err)
+	}
+	if limits.MaxAccounts == 0 && limits.MaxAccountsPerChain == 0 {
+		return nil
+	}
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "quota:"+authProvider+":"+userId).Error; err != nil {
+		return databaseError(fmt.Errorf("failed to lock quota: %w", err))
+	}
+
+	if limits.MaxAccounts != 0 {
+		var count int64
+		if err := tx.Model(&Account{}).Where("username = ? AND auth_provider = ?", userId, authProvider).Count(&count).Error; err != nil {
+			return databaseError(fmt.Errorf("failed to count accounts: %w", err))
+		}
+		if count >= int64(limits.MaxAccounts) {
+			return &quotaError{Quota: quotaAccounts, Limit: limits.MaxAccounts}
+		}
+	}
+	if limits.MaxAccountsPerChain != 0 {
+		var count int64
+		if err := tx.Model(&Account{}).Where("username = ? AND auth_provider = ? AND chain_id = ?", userId, authProvider, chainId).Count(&count).Error; err != nil {
+			return databaseError(fmt.Errorf("failed to count accounts: %w", err))
+		}
+		if count >= int64(limits.MaxAccountsPerChain) {
+			return &quotaError{Quota: quotaAccountsPerChain, Limit: limits.MaxAccountsPerChain}
+		}
+	}
+	return nil
+}
+
+// checkDeviceQuota refuses a new non-primary device for account's signer when
+// it would exceed the quota of the account's owner. It locks the signer until
+// tx ends.
+func checkDeviceQuota(tx *gorm.DB, account Account) error {
+	limits, err := quotaFor(tx, account.Username, account.AuthProvider)
+	if err != nil {
+		return databaseError(err)
+	}
+	if limits.MaxDevices == 0 {
+		return nil
+	}
+	var signer Signer
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&signer, "id = ?", account.SignerId).Error; err != nil {
+		return databaseError(fmt.Errorf("failed to lock signer: %w", err))
+	}
+	var count int64
+	if err := tx.Model(&Device{}).Where("signer_id = ? AND is_primary = false", account.SignerId).Count(&count).Error; err != nil {
+		return databaseError(fmt.Errorf("failed to count devices: %w", err))
+	}
+	if count >= int64(limits.MaxDevices) {
+		return &quotaError{Quota: quotaDevices, Limit: limits.MaxDevices}
+	}
+	return nil
+}
+
+// databaseError logs err and returns the "database error" handlers pass on
+// to the client.
+func databaseError(err error) error {
+	slog.Error(err.Error())
+	return fmt.Errorf("database error")
+}
+
+// writeQuotaError answers a request refused by a quota with 403 and the
+// quota that was hit.
+func writeQuotaError(w http.ResponseWriter, err *quotaError) {
+	slog.Info("quota exceeded", slog.String("quota", err.Quota), slog.Int("limit", err.Limit))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(QuotaErrorResponse{Error: "quota_exceeded", Quota: err.Quota, Limit: err.Limit})
+}
+
+// handleAdminQuotas reads (GET), sets (POST) or removes (DELETE) the quota
+// override of a user. GET and DELETE take userId and authProvider query
+// parameters.
+func handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userId := r.URL.Query().Get(fieldUserId)
+		authProvider := r.URL.Query().Get(fieldAuthProvider)
+		if userId == "" || authProvider == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		limits, err := quotaFor(db.WithContext(r.Context()), userId, authProvider)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(contentTypeHeader, contentTypeJSON)
+		json.NewEncoder(w).Encode(QuotaResponse{UserId: userId, AuthProvider: authProvider, MaxAccounts: limits.MaxAccounts, MaxAccountsPerChain: limits.MaxAccountsPerChain, MaxDevices: limits.MaxDevices})
+	case http.MethodPost:
+		var req QuotaRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil ||
+			req.UserId == "" || req.AuthProvider == "" || isNegative(req.MaxAccounts) || isNegative(req.MaxAccountsPerChain) || isNegative(req.MaxDevices) {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		override := UserQuota{
+			ID:                  uuid.NewString(),
+			Username:            req.UserId,
+			AuthProvider:        req.AuthProvider,
+			MaxAccounts:         req.MaxAccounts,
+			MaxAccountsPerChain: req.MaxAccountsPerChain,
+			MaxDevices:          req.MaxDevices,
+		}
+		if err := db.WithContext(r.Context()).Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "username"}, {Name: "auth_provider"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"max_accounts":           req.MaxAccounts,
+				"max_accounts_per_chain": req.MaxAccountsPerChain,
+				"max_devices":            req.MaxDevices,
+				"updated_at":             time.Now(),
+			}),
+		}).Create(&override).Error; err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "failed to set quota", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("quota override set", slog.String("authProvider", req.AuthProvider),
+			quotaLimitAttr("maxAccounts", req.MaxAccounts), quotaLimitAttr("maxAccountsPerChain", req.MaxAccountsPerChain), quotaLimitAttr("maxDevices", req.MaxDevices))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		userId := r.URL.Query().Get(fieldUserId)
+		authProvider := r.URL.Query().Get(fieldAuthProvider)
+		if userId == "" || authProvider == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := db.Unscoped().Where("username = ? AND auth_provider = ?", userId, authProvider).Delete(&UserQuota{}).Error; err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("quota override removed", slog.String("authProvider", authProvider))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// isNegative reports whether an optional limit is set below 0.
+func isNegative(limit *int) bool {
+	return limit != nil && *limit < 0
+}
+
+// quotaLimitAttr logs an optional limit, "default" when it is not set.
+func quotaLimitAttr(name string, limit *int) slog.Attr {
+	if limit == nil {
+		return slog.String(name, "default")
+	}
+	return slog.Int(name, *limit)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// useQuota sets the default quota for the length of the test.
+func useQuota(t *testing.T, limits quotaLimits) {
+	t.Helper()
+	prevDefault, prevProviders := defaultQuota, providerQuotas
+	t.Cleanup(func() { defaultQuota, providerQuotas = prevDefault, prevProviders })
+	defaultQuota, providerQuotas = limits, nil
+}
+
+func setQuotaOverride(t *testing.T, body string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleAdminQuotas(w, httptest.NewRequest(http.MethodPost, "/admin/quotas", strings.NewReader(body)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("set override: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestQuotaForOverrides(t *testing.T) {
+	newTestDB(t)
+	useQuota(t, quotaLimits{MaxAccounts: 100, MaxAccountsPerChain: 5, MaxDevices: 10})
+
+	limits, err := quotaFor(db, "alice", authProviderDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits != defaultQuota {
+		t.Errorf("without override = %+v, want %+v", limits, defaultQuota)
+	}
+
+	// maxDevices is left out, so it keeps the provider's limit; 0 lifts one.
+	setQuotaOverride(t, `{"userId": "alice", "authProvider": "default", "maxAccounts": 0, "maxAccountsPerChain": 7}`)
+	limits, err = quotaFor(db, "alice", authProviderDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaLimits{MaxAccounts: 0, MaxAccountsPerChain: 7, MaxDevices: 10}); limits != want {
+		t.Errorf("with override = %+v, want %+v", limits, want)
+	}
+
+	// Setting the override again replaces every field.
+	setQuotaOverride(t, `{"userId": "alice", "authProvider": "default", "maxDevices": 0}`)
+	limits, err = quotaFor(db, "alice", authProviderDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaLimits{MaxAccounts: 100, MaxAccountsPerChain: 5, MaxDevices: 0}); limits != want {
+		t.Errorf("with replaced override = %+v, want %+v", limits, want)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminQuotas(w, httptest.NewRequest(http.MethodPost, "/admin/quotas", strings.NewReader(`{"userId": "alice", "authProvider": "default", "maxDevices": -1}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("negative limit: status %d, want 400", w.Code)
+	}
+}
+
+func TestDeviceQuota(t *testing.T) {
+	newTestDB(t)
+	useQuota(t, quotaLimits{MaxDevices: 2})
+	account := createTestAccount(t, "alice", "signer-1")
+
+	addDevice := func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := checkDeviceQuota(tx, account); err != nil {
+				return err
+			}
+			return tx.Create(&Device{ID: uuid.NewString(), Share: "sealed-share", SignerId: account.SignerId}).Error
+		})
+	}
+	// The primary device of createTestAccount does not count.
+	for i := range 2 {
+		if err := addDevice(); err != nil {
+			t.Fatalf("device %d: %v", i, err)
+		}
+	}
+	var quotaErr *quotaError
+	if err := addDevice(); !errors.As(err, &quotaErr) || quotaErr.Quota != quotaDevices || quotaErr.Limit != 2 {
+		t.Errorf("third device: err = %v, want the devices quota of 2", err)
+	}
+
+	setQuotaOverride(t, `{"userId": "alice", "authProvider": "default", "maxDevices": 0}`)
+	if err := addDevice(); err != nil {
+		t.Errorf("with an unlimited override: %v", err)
+	}
+}
+
+// createAccountUnderQuota creates an account for the user on chainId as the
+// handlers do, after checking the quota in the same transaction.
+func createAccountUnderQuota(userId string, chainId int64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := checkAccountQuota(tx, userId, authProviderDefault, chainId); err != nil {
+			return err
+		}
+		return tx.Create(&Account{ID: uuid.NewString(), Address: uuid.NewString(), Username: userId, AuthProvider: authProviderDefault, ChainId: chainId, SignerId: uuid.NewString()}).Error
+	})
+}
+
+func TestAccountQuota(t *testing.T) {
+	newTestDB(t)
+	requirePostgres(t)
+	useQuota(t, quotaLimits{MaxAccounts: 3, MaxAccountsPerChain: 2})
+
+	var quotaErr *quotaError
+	for i := range 2 {
+		if err := createAccountUnderQuota("alice", 1); err != nil {
+			t.Fatalf("account %d on chain 1: %v", i, err)
+		}
+	}
+	if err := createAccountUnderQuota("alice", 1); !errors.As(err, &quotaErr) || quotaErr.Quota != quotaAccountsPerChain {
+		t.Errorf("third account on chain 1: err = %v, want the accounts_per_chain quota", err)
+	}
+	if err := createAccountUnderQuota("alice", 2); err != nil {
+		t.Fatalf("account on chain 2: %v", err)
+	}
+	if err := createAccountUnderQuota("alice", 3); !errors.As(err, &quotaErr) || quotaErr.Quota != quotaAccounts || quotaErr.Limit != 3 {
+		t.Errorf("fourth account: err = %v, want the accounts quota of 3", err)
+	}
+	if err := createAccountUnderQuota("bob", 1); err != nil {
+		t.Errorf("another user: %v", err)
+	}
+}
+
+func TestAccountQuotaConcurrentCreates(t *testing.T) {
+	newTestDB(t)
+	requirePostgres(t)
+	useQuota(t, quotaLimits{MaxAccounts: 3})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = createAccountUnderQuota("alice", int64(i))
+		}()
+	}
+	wg.Wait()
+
+	var refused int
+	for _, err := range errs {
+		var quotaErr *quotaError
+		switch {
+		case errors.As(err, &quotaErr):
+			refused++
+		case err != nil:
+			t.Errorf("create: %v", err)
+		}
+	}
+	if n := countRows(t, &Account{}, "username = ?", "alice"); n != 3 || refused != 7 {
+		t.Errorf("%d accounts created and %d refused, want 3 and 7", n, refused)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	rateLimitPolicyDefault = "default"
+	rateLimitPolicyWrite   = "write"
+	rateLimitPolicyShare   = "share"
+
+	rateLimitKeyUser = "user"
+	rateLimitKeyIP   = "ip"
+	rateLimitKeyPair = "pair"
+
+	rateLimitStoreMemory   = "memory"
+	rateLimitStorePostgres = "postgres"
+)
+
+// rateLimit allows Count requests per Period. A zero Count disables it.
+type rateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// rateLimitPolicy limits a group of routes per user, per client IP and per
+// user and IP pair. Each policy counts its requests separately.
+type rateLimitPolicy struct {
+	Name  string
+	User  rateLimit
+	IP    rateLimit
+	Pair  rateLimit
+	store rateLimitStore
+}
+
+// rateLimitStore counts requests. The memory store only sees one replica;
+// replicas that must share their budgets use a shared store.
+type rateLimitStore interface {
+	// Allow counts a request under key and reports whether limit still
+	// allows it, or else how long until it would.
+	Allow(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error)
+}
+
+var (
+	rateLimitPolicies = map[string]*rateLimitPolicy{
+		rateLimitPolicyDefault: {
+			Name: rateLimitPolicyDefault,
+			User: rateLimit{600, time.Minute},
+			IP:   rateLimit{1200, time.Minute},
+			Pair: rateLimit{300, time.Minute},
+		},
+		rateLimitPolicyWrite: {
+			Name: rateLimitPolicyWrite,
+			User: rateLimit{20, time.Minute},
+			IP:   rateLimit{60, time.Minute},
+			Pair: rateLimit{10, time.Minute},
+		},
+		rateLimitPolicyShare: {
+			Name: rateLimitPolicyShare,
+			User: rateLimit{10, time.Minute},
+			IP:   rateLimit{30, time.Minute},
+			Pair: rateLimit{5, time.Minute},
+		},
+	}
+
+	// trustedProxies are the RATE_LIMIT_TRUSTED_PROXIES networks whose
+	// X-Forwarded-For header names the client.
+	trustedProxies []*net.IPNet
+
+	rateLimitRejections = expvar.NewMap("rate_limit_rejections")
+)
+
+// initRateLimits reads the limits of every policy and the store they use:
+//
+//	RATE_LIMIT_<POLICY>_<KEY>   "<count>/<period>", such as "10/m" or "100/1h"; "0" disables it.
+//	                            POLICY is DEFAULT, WRITE or SHARE; KEY is USER, IP or PAIR.
+//	RATE_LIMIT_STORE            "memory" (default) or "postgres" to share budgets between replicas
+//	RATE_LIMIT_CACHE_SIZE       maximum buckets kept by the memory store, default 100000
+//	RATE_LIMIT_TRUSTED_PROXIES  comma-separated CIDRs of proxies whose X-Forwarded-For is used
+func initRateLimits() error {
+	for name, policy := range rateLimitPolicies {
+		for key, limit := range map[string]*rateLimit{rateLimitKeyUser: &policy.User, rateLimitKeyIP: &policy.IP, rateLimitKeyPair: &policy.Pair} {
+			env := fmt.Sprintf("RATE_LIMIT_%s_%s", strings.ToUpper(name), strings.ToUpper(key))
+			v := os.Getenv(env)
+			if v == "" {
+				continue
+			}
+			parsed, err := parseRateLimit(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*limit = parsed
+		}
+	}
+
+	var store rateLimitStore
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", rateLimitStoreMemory:
+		size, err := envInt("RATE_LIMIT_CACHE_SIZE", 100000)
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("RATE_LIMIT_CACHE_SIZE must be positive")
+		}
+		store = newMemoryRateLimitStore(size)
+	case rateLimitStorePostgres:
+		store = &postgresRateLimitStore{}
+	default:
+		return fmt.Errorf("RATE_LIMIT_STORE must be %q or %q", rateLimitStoreMemory, rateLimitStorePostgres)
+	}
+	for _, policy := range rateLimitPolicies {
+		policy.store = store
+	}
+
+	trustedProxies = nil
+	for _, cidr := range envList("RATE_LIMIT_TRUSTED_PROXIES") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("RATE_LIMIT_TRUSTED_PROXIES: %w", err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// parseRateLimit parses "<count>/<period>", where period is a duration or a
+// bare unit such as "s", "m" or "h".
+func parseRateLimit(v string) (rateLimit, error) {
+	if v == "0" {
+		return rateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(v, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit must be \"<count>/<period>\"")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return rateLimit{}, fmt.Errorf("rate limit count must be a non-negative integer")
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateLimit{}, fmt.Errorf("rate limit period must be a positive duration")
+	}
+	return rateLimit{Count: n, Period: d}, nil
+}
+
+// rateLimitMiddleware applies every limit of the named policy. A refused
+// request gets 429 with Retry-After. When the store fails, the request is let
+// through: rate limiting must not take the service down.
+func rateLimitMiddleware(name string, next http.Handler) http.Handler {
+	return ipRateLimitMiddleware(name, userRateLimitMiddleware(name, next))
+}
+
+// ipRateLimitMiddleware applies the IP limit of the named policy. It needs no
+// identity, so it runs ahead of authMiddleware and also limits requests whose
+// token is missing or refused.
+func ipRateLimitMiddleware(name string, next http.Handler) http.Handler {
+	policy := rateLimitPolicies[name]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy.store == nil || checkRateLimit(w, r, policy, rateLimitKeyIP, clientIP(r), policy.IP) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// userRateLimitMiddleware applies the user and pair limits of the named
+// policy to authenticated requests.
+func userRateLimitMiddleware(name string, next http.Handler) http.Handler {
+	policy := rateLimitPolicies[name]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy.store == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userId, _ := r.Context().Value(fieldUserId).(string)
+		authProvider, _ := r.Context().Value(fieldAuthProvider).(string)
+		user := authProvider + ":" + userId
+		if checkRateLimit(w, r, policy, rateLimitKeyUser, user, policy.User) &&
+			checkRateLimit(w, r, policy, rateLimitKeyPair, user+"|"+clientIP(r), policy.Pair) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// checkRateLimit counts the request under one key of policy. It reports
+// whether the request may go on, and answers it with 429 otherwise.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, policy *rateLimitPolicy, key, value string, limit rateLimit) bool {
+	if limit.Count == 0 {
+		return true
+	}
+	ok, retryAfter, err := policy.store.Allow(r.Context(), policy.Name+":"+key+":"+value, limit)
+	if err != nil {
+		slog.Warn("rate limit store failed, allowing request", slog.String("error", err.Error()))
+		return true
+	}
+	if !ok {
+		rateLimitRejections.Add(policy.Name+":"+key, 1)
+		slog.Info("request rate limited", slog.String("policy", policy.Name), slog.String("key", key))
+		tooManyRequests(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`{"error":"rate_limited"}`))
+}
+
+// clientIP returns the address of the client. Behind a trusted proxy, it is
+// the last X-Forwarded-For entry not added by a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryRateLimitStore keeps a token bucket per key: a limit of Count per
+// Period allows bursts of Count and refills at Count/Period. When full, the
+// least recently used bucket is evicted, granting that key a fresh budget
+// should it come back.
+type memoryRateLimitStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	buckets    map[string]*list.Element
+	// lru holds the *rateLimitBucket entries, most recently used first.
+	lru *list.List
+}
+
+type rateLimitBucket struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newMemoryRateLimitStore(maxEntries int) *memoryRateLimitStore {
+	return &memoryRateLimitStore{maxEntries: maxEntries, buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (s *memoryRateLimitStore) Allow(_ context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	var limiter *rate.Limiter
+	if elem, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(elem)
+		limiter = elem.Value.(*rateLimitBucket).limiter
+	} else {
+		if s.lru.Len() >= s.maxEntries {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.buckets, oldest.Value.(*rateLimitBucket).key)
+		}
+		limiter = rate.NewLimiter(rate.Limit(float64(limit.Count)/limit.Period.Seconds()), limit.Count)
+		s.buckets[key] = s.lru.PushFront(&rateLimitBucket{key: key, limiter: limiter})
+	}
+	s.mu.Unlock()
+
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay, nil
+	}
+	return true, 0, nil
+}
+
+// postgresRateLimitStore counts requests per fixed window of Period in the
+// rate_limit_counters table, so every replica shares the same budget.
+type postgresRateLimitStore struct {
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func (s *postgresRateLimitStore) Allow(ctx context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	windowStart := now.Truncate(limit.Period)
+	windowEnd := windowStart.Add(limit.Period)
+	counter := RateLimitCounter{ID: fmt.Sprintf("%s@%d", key, windowStart.Unix()), Count: 1, ExpiresAt: windowEnd}
+	err := db.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.Assignments(map[string]any{"count": gorm.Expr("rate_limit_counters.count + 1")}),
+		},
+		clause.Returning{Columns: []clause.Column{{Name: "count"}}},
+	).Create(&counter).Error
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to count request: %w", err)
+	}
+	s.prune(ctx, now)
+	if counter.Count > limit.Count {
+		return false, windowEnd.Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+// prune deletes expired counters at most once a minute per replica.
+func (s *postgresRateLimitStore) prune(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastPrune) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	s.mu.Unlock()
+	if err := db.WithContext(ctx).Unscoped().Where("expires_at < ?", now).Delete(&RateLimitCounter{}).Error; err != nil {
+		slog.Warn(fmt.Sprintf("failed to prune rate limit counters: %v", err))
+	}
+}
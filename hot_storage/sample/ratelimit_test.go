@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useTestRateLimitPolicy registers a "test" policy backed by a memory store
+// for the length of the test.
+func useTestRateLimitPolicy(t *testing.T, policy rateLimitPolicy) {
+	t.Helper()
+	policy.Name = "test"
+	policy.store = newMemoryRateLimitStore(100)
+	rateLimitPolicies[policy.Name] = &policy
+	t.Cleanup(func() { delete(rateLimitPolicies, policy.Name) })
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	useTestRateLimitPolicy(t, rateLimitPolicy{User: rateLimit{2, time.Minute}})
+	handler := rateLimitMiddleware("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(userId, remoteAddr string) *httptest.ResponseRecorder {
+		r := withIdentity(httptest.NewRequest(http.MethodGet, "/v2/accounts", nil), userId, authProviderDefault, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for i := range 2 {
+		if w := request("alice", "192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+	w := request("alice", "192.0.2.2:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 30 {
+		t.Errorf("Retry-After = %q, want the 30s until a token refills", w.Header().Get("Retry-After"))
+	}
+	if w := request("bob", "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("another user: status %d", w.Code)
+	}
+}
+
+func TestIPRateLimitBeforeAuth(t *testing.T) {
+	useTestRateLimitPolicy(t, rateLimitPolicy{IP: rateLimit{1, time.Hour}})
+	var reached int
+	handler := ipRateLimitMiddleware("test", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached++ })))
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/v2/accounts", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("request %d without a token: status %d, want %d", i, w.Code, want)
+		}
+	}
+	if reached != 0 {
+		t.Errorf("unauthenticated requests reached the handler")
+	}
+}
+
+func TestMemoryRateLimitStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newMemoryRateLimitStore(2)
+	limit := rateLimit{1, time.Hour}
+	ctx := context.Background()
+
+	store.Allow(ctx, "a", limit)
+	store.Allow(ctx, "b", limit)
+	if ok, _, _ := store.Allow(ctx, "a", limit); ok {
+		t.Fatal("second request of a allowed")
+	}
+	store.Allow(ctx, "c", limit)
+
+	if ok, _, _ := store.Allow(ctx, "a", limit); ok {
+		t.Error("a was evicted although b was used less recently")
+	}
+	if ok, _, _ := store.Allow(ctx, "b", limit); !ok {
+		t.Error("b was kept although it was used least recently")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rateLimit
+	}{
+		{"0", rateLimit{}},
+		{"10/m", rateLimit{10, time.Minute}},
+		{"100/1h", rateLimit{100, time.Hour}},
+		{"5/30s", rateLimit{5, 30 * time.Second}},
+		{"0/s", rateLimit{0, time.Second}},
+	}
+	for _, test := range tests {
+		got, err := parseRateLimit(test.in)
+		if err != nil || got != test.want {
+			t.Errorf("parseRateLimit(%q) = %v, %v, want %v", test.in, got, err, test.want)
+		}
+	}
+
+	for _, in := range []string{"", "10", "x/m", "-1/m", "10/", "10/0s", "10/-1m", "10/fortnight"} {
+		if _, err := parseRateLimit(in); err == nil {
+			t.Errorf("parseRateLimit(%q) succeeded", in)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	prev := trustedProxies
+	t.Cleanup(func() { trustedProxies = prev })
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"headers", "10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1"}, "198.51.100.1"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, v := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != test.want {
+				t.Errorf("clientIP = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
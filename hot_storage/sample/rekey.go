@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// rekeyCheckpoint is persisted after every batch so an interrupted run
+// resumes after the last device it finished. FromKeys and ToKeys fingerprint
+// the key files of the run, so it only resumes with the same ones.
+type rekeyCheckpoint struct {
+	FromKeys     string    `json:"fromKeys"`
+	ToKeys       string    `json:"toKeys"`
+	LastDeviceID string    `json:"lastDeviceId"`
+	Processed    int       `json:"processed"`
+	Rekeyed      int       `json:"rekeyed"`
+	Skipped      int       `json:"skipped"`
+	Failed       []string  `json:"failed"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// runRekey implements `sample rekey`: it re-encrypts every device share, the
+// tenant keys and the key check from the keys in one key file to the keys in
+// another. The service must be stopped while it runs.
+func runRekey(args []string) int {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	fromKeyFile := fs.String("from-key-file", "", "key file currently sealing the shares (required)")
+	toKeyFile := fs.String("to-key-file", "", "key file to re-seal the shares with (required)")
+	checkpointPath := fs.String("checkpoint", "rekey.checkpoint.json", "file recording progress; an existing one resumes the run")
+	restart := fs.Bool("restart", false, "discard an existing checkpoint and start from the first device")
+	dryRun := fs.Bool("dry-run", false, "decrypt and re-encrypt every share without writing anything")
+	batchSize := fs.Int("batch-size", 100, "devices read per batch")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *fromKeyFile == "" || *toKeyFile == "" || *batchSize <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := initShareAlgorithm(); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	from, err := loadKeyFile(*fromKeyFile)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to load --from-key-file: %v", err))
+		return 1
+	}
+	defer from.wipe()
+	to, err := loadKeyFile(*toKeyFile)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to load --to-key-file: %v", err))
+		return 1
+	}
+	defer to.wipe()
+	if err := initDB(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize DB: %v", err))
+		return 1
+	}
+
+	r := rekeyer{
+		from:      shareCipher{provider: from, direct: from},
+		to:        shareCipher{provider: to},
+		batchSize: *batchSize,
+		dryRun:    *dryRun,
+		restart:   *restart,
+		progress:  rekeyCheckpoint{FromKeys: keyRingFingerprint(from), ToKeys: keyRingFingerprint(to)},
+	}
+	if !r.dryRun {
+		r.checkpointPath = *checkpointPath
+	}
+
+	ctx := context.Background()
+	if err := r.run(ctx); err != nil {
+		slog.Error(fmt.Sprintf("Rekey stopped: %v", err))
+		return 1
+	}
+	if len(r.progress.Failed) > 0 {
+		slog.Error("rekey finished with failures", slog.Any("failedDeviceIds", r.progress.Failed))
+		return 1
+	}
+	slog.Info("rekey finished", slog.Bool("dryRun", r.dryRun), slog.Int("rekeyed", r.progress.Rekeyed), slog.Int("skipped", r.progress.Skipped))
+	return 0
+}
+
+type rekeyer struct {
+	from, to       shareCipher
+	batchSize      int
+	dryRun         bool
+	restart        bool
+	checkpointPath string
+	progress       rekeyCheckpoint
+}
+
+func (r *rekeyer) run(ctx context.Context) error {
+	if err := r.loadCheckpoint(); err != nil {
+		return err
+	}
+
+	var total int64
+	if err := db.WithContext(ctx).Unscoped().Model(&Device{}).Count(&total).Error; err != nil {
+		return fmt.Errorf("failed to count devices: %w", err)
+	}
+	slog.Info("rekey started", slog.Int64("devices", total), slog.Bool("dryRun", r.dryRun), slog.String("resumeAfter", r.progress.LastDeviceID))
+
+	for {
+		var devices []Device
+		if err := db.WithContext(ctx).Unscoped().Where("id > ?", r.progress.LastDeviceID).Order("id").Limit(r.batchSize).Find(&devices).Error; err != nil {
+			return fmt.Errorf("failed to list devices: %w", err)
+		}
+		if len(devices) == 0 {
+			break
+		}
+
+		owners, err := signerOwners(ctx, devices)
+		if err != nil {
+			return err
+		}
+		for _, device := range devices {
+			if err := r.rekeyDevice(ctx, device, owners); err != nil {
+				return err
+			}
+			r.progress.LastDeviceID = device.ID
+			r.progress.Processed++
+		}
+
+		if err := r.saveCheckpoint(); err != nil {
+			return err
+		}
+		slog.Info("rekey progress",
+			slog.Int("processed", r.progress.Processed),
+			slog.Int64("total", total),
+			slog.Int("rekeyed", r.progress.Rekeyed),
+			slog.Int("skipped", r.progress.Skipped),
+			slog.Int("failed", len(r.progress.Failed)))
+	}
+
+	rewrapped, err := rewrapTenantKeys(ctx, r.from.provider, r.to.provider, r.dryRun)
+	if err != nil {
+		return err
+	}
+	slog.Info("tenant keys re-wrapped", slog.Int("rewrapped", rewrapped))
+
+	return r.rekeyKeyCheck(ctx)
+}
+
+// rekeyDevice re-seals one device share. Shares the target keys already open
+// were handled by an earlier, interrupted run and are skipped. Shares neither
+// key set opens are recorded as failed and left untouched.
+func (r *rekeyer) rekeyDevice(ctx context.Context, device Device, owners map[string]Account) error {
+	account, ok := owners[device.SignerId]
+	if !ok {
+		slog.Error("device has no owning account", slog.String("deviceId", device.ID))
+		r.progress.Failed = append(r.progress.Failed, device.ID)
+		return nil
+	}
+	if account.Tenant != "" {
+		// Tenant shares are sealed under the tenant key, which is re-wrapped
+		// as a whole by rewrapTenantKeys.
+		r.progress.Skipped++
+		return nil
+	}
+	binding := newShareBinding(device.ID, account)
+
+	if stale, err := r.to.needsRotation(device.Share); err == nil && !stale {
+		if plaintext, err := r.to.decrypt(ctx, device.Share, binding); err == nil {
+			plaintext.Wipe()
+			r.progress.Skipped++
+			return nil
+		}
+	}
+
+	plaintext, err := r.from.decrypt(ctx, device.Share, binding)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to decrypt share: %v", err), slog.String("deviceId", device.ID))
+		r.progress.Failed = append(r.progress.Failed, device.ID)
+		return nil
+	}
+	reencrypted, err := r.to.encrypt(ctx, plaintext.Bytes(), binding)
+	plaintext.Wipe()
+	if err != nil {
+		return err
+	}
+	if r.dryRun {
+		r.progress.Rekeyed++
+		return nil
+	}
+
+	result := db.WithContext(ctx).Unscoped().Model(&Device{}).
+		Where("id = ? AND share = ?", device.ID, device.Share).
+		Update("share", reencrypted)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update device %s: %w", device.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("device %s changed during rekey; is the service still running?", device.ID)
+	}
+	r.progress.Rekeyed++
+	return nil
+}
+
+// rekeyKeyCheck re-seals the key check canary so the service boots with the
+// new keys.
+func (r *rekeyer) rekeyKeyCheck(ctx context.Context) error {
+	var check KeyCheck
+	if err := db.WithContext(ctx).First(&check, "id = ?", keyCheckId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load key check: %w", err)
+	}
+	if plaintext, err := r.to.decrypt(ctx, check.Value, keyCheckBinding); err == nil {
+		plaintext.Wipe()
+		return nil
+	}
+	plaintext, err := r.from.decrypt(ctx, check.Value, keyCheckBinding)
+	if err != nil {
+		return fmt.Errorf("%w: the key check does not open with --from-key-file", ErrKeyMismatch)
+	}
+	plaintext.Wipe()
+	sealed, err := r.to.encrypt(ctx, []byte(keyCheckPlaintext), keyCheckBinding)
+	if err != nil {
+		return err
+	}
+	if r.dryRun {
+		return nil
+	}
+	return db.WithContext(ctx).Model(&KeyCheck{}).Where("id = ?", keyCheckId).Update("value", sealed).Error
+}
+
+// loadCheckpoint resumes from the checkpoint file unless restart is set. A
+// checkpoint written for other key files is refused: resuming it would skip
+// every device it lists as done, although those are sealed with other keys.
+func (r *rekeyer) loadCheckpoint() error {
+	if r.checkpointPath == "" || r.restart {
+		return nil
+	}
+	data, err := os.ReadFile(r.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var saved rekeyCheckpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse checkpoint %s: %w", r.checkpointPath, err)
+	}
+	if saved.FromKeys != r.progress.FromKeys || saved.ToKeys != r.progress.ToKeys {
+		return fmt.Errorf("checkpoint %s was written for other key files; pass --restart to discard it", r.checkpointPath)
+	}
+	r.progress = saved
+	return nil
+}
+
+// keyRingFingerprint identifies the keys of a ring without revealing them: a
+// hash of each version with an HMAC of a fixed label under its key.
+func keyRingFingerprint(k *keyRing) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "active=%s\n", k.active)
+	for _, version := range k.versions() {
+		mac := hmac.New(sha256.New, k.keys[version].Bytes())
+		mac.Write([]byte("rekey checkpoint"))
+		fmt.Fprintf(h, "%s=%x\n", version, mac.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// saveCheckpoint writes the checkpoint through a temporary file and a rename
+// so a crash never leaves it half-written.
+func (r *rekeyer) saveCheckpoint() error {
+	if r.checkpointPath == "" {
+		return nil
+	}
+	r.progress.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(r.progress, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.checkpointPath), ".rekey-checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.checkpointPath); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
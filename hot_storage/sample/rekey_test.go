@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRekeyCheckpointKeyFingerprints(t *testing.T) {
+	from, to, other := newTestKeyRing(t), newTestKeyRing(t), newTestKeyRing(t)
+	if keyRingFingerprint(from) == keyRingFingerprint(to) {
+		t.Fatal("different key rings have the same fingerprint")
+	}
+	path := filepath.Join(t.TempDir(), "rekey.checkpoint.json")
+	newRekeyer := func(from, to *keyRing, restart bool) *rekeyer {
+		return &rekeyer{
+			checkpointPath: path,
+			restart:        restart,
+			progress:       rekeyCheckpoint{FromKeys: keyRingFingerprint(from), ToKeys: keyRingFingerprint(to)},
+		}
+	}
+
+	first := newRekeyer(from, to, false)
+	first.progress.LastDeviceID = "device-42"
+	if err := first.saveCheckpoint(); err != nil {
+		t.Fatalf("saveCheckpoint: %v", err)
+	}
+
+	resumed := newRekeyer(from, to, false)
+	if err := resumed.loadCheckpoint(); err != nil {
+		t.Fatalf("loadCheckpoint with the same keys: %v", err)
+	}
+	if resumed.progress.LastDeviceID != "device-42" {
+		t.Errorf("resumed after %q, want device-42", resumed.progress.LastDeviceID)
+	}
+
+	for name, r := range map[string]*rekeyer{
+		"other from keys": newRekeyer(other, to, false),
+		"other to keys":   newRekeyer(from, other, false),
+	} {
+		if err := r.loadCheckpoint(); err == nil || !strings.Contains(err.Error(), "--restart") {
+			t.Errorf("loadCheckpoint with %s: err = %v", name, err)
+		}
+	}
+
+	restarted := newRekeyer(other, to, true)
+	if err := restarted.loadCheckpoint(); err != nil {
+		t.Fatalf("loadCheckpoint with --restart: %v", err)
+	}
+	if restarted.progress.LastDeviceID != "" {
+		t.Errorf("--restart resumed after %q", restarted.progress.LastDeviceID)
+	}
+
+	// Checkpoints written before fingerprints were recorded match no keys.
+	if err := os.WriteFile(path, []byte(`{"lastDeviceId": "device-42"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newRekeyer(from, to, false).loadCheckpoint(); err == nil {
+		t.Error("loadCheckpoint accepted a checkpoint without key fingerprints")
+	}
+}
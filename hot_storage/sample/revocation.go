@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	headerWebhookSignature = "X-Signature-256"
+	headerWebhookTimestamp = "X-Signature-Timestamp"
+	webhookSignaturePrefix = "sha256="
+
+	// webhookTolerance is how far the signed timestamp of a webhook request
+	// may be from the local clock.
+	webhookTolerance = 5 * time.Minute
+
+	rejectRevoked = "revoked"
+)
+
+// revocationWebhookSecret is REVOCATION_WEBHOOK_SECRET, the HMAC key of the
+// revocation webhook. The webhook is disabled while it is empty.
+var revocationWebhookSecret = os.Getenv("REVOCATION_WEBHOOK_SECRET")
+
+// revocationEnabled reports whether revocations can be recorded at all. Until
+// then, tokens are not checked against the database.
+func revocationEnabled() bool {
+	return adminToken != "" || revocationWebhookSecret != ""
+}
+
+// checkRevocation refuses a token whose jti or sid claim is on the deny-list,
+// or whose user has a cutoff at or after the token's iat. Tokens without iat
+// cannot be shown to postdate a cutoff and are refused while one exists.
+func checkRevocation(ctx context.Context, identity *authIdentity) error {
+	if !revocationEnabled() {
+		return nil
+	}
+
+	var ids []string
+	for _, claim := range []string{"jti", "sid"} {
+		if id, ok := identity.Claims[claim].(string); ok && id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		var count int64
+		if err := db.WithContext(ctx).Model(&RevokedToken{}).Where("id IN ? AND (expires_at IS NULL OR expires_at > ?)", ids, time.Now()).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check token revocation: %w", err)
+		}
+		if count > 0 {
+			return reject(rejectRevoked)
+		}
+	}
+
+	var cutoff RevocationCutoff
+	err := db.WithContext(ctx).First(&cutoff, "username = ? AND auth_provider = ?", identity.UserID, identity.AuthProvider).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	iat, err := identity.Claims.GetIssuedAt()
+	if err != nil || iat == nil || !iat.After(cutoff.IssuedBefore) {
+		return reject(rejectRevoked)
+	}
+	return nil
+}
+
+// revoke records req: jti and sessionId go on the deny-list until expiresAt,
+// and userId gets a cutoff of issuedBefore, or now when it is zero. A cutoff
+// only ever moves forward.
+func revoke(ctx context.Context, req RevocationRequest) error {
+	tx := db.WithContext(ctx)
+	var expiresAt *time.Time
+	if req.ExpiresAt > 0 {
+		t := time.Unix(req.ExpiresAt, 0)
+		expiresAt = &t
+	}
+	for _, id := range []string{req.Jti, req.SessionId} {
+		if id == "" {
+			continue
+		}
+		entry := RevokedToken{ID: id, ExpiresAt: expiresAt}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&entry).Error; err != nil {
+			return fmt.Errorf("failed to revoke token: %w", err)
+		}
+	}
+
+	if req.UserId != "" {
+		issuedBefore := time.Now().Truncate(time.Second)
+		if req.IssuedBefore > 0 {
+			issuedBefore = time.Unix(req.IssuedBefore, 0)
+		}
+		authProvider := req.AuthProvider
+		if authProvider == "" {
+			authProvider = authProviderDefault
+		}
+		cutoff := RevocationCutoff{ID: uuid.NewString(), Username: req.UserId, AuthProvider: authProvider, IssuedBefore: issuedBefore}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "username"}, {Name: "auth_provider"}},
+			DoUpdates: clause.Assignments(map[string]any{"issued_before": gorm.Expr("GREATEST(revocation_cutoffs.issued_before, excluded.issued_before)"), "updated_at": time.Now()}),
+		}).Create(&cutoff).Error; err != nil {
+			return fmt.Errorf("failed to revoke user tokens: %w", err)
+		}
+	}
+
+	// Expired entries can no longer match a valid token.
+	if err := tx.Unscoped().Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error; err != nil {
+		slog.Warn(fmt.Sprintf("failed to prune revoked tokens: %v", err))
+	}
+	return nil
+}
+
+// handleAdminRevocations records a revocation (POST) or lifts a user's cutoff
+// (DELETE with userId and authProvider query parameters).
+func handleAdminRevocations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req RevocationRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || !req.valid() {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := revoke(r.Context(), req); err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "failed to record revocation", http.StatusInternalServerError)
+			return
+		}
+		logRevocation("admin", req)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		userId := r.URL.Query().Get(fieldUserId)
+		authProvider := r.URL.Query().Get(fieldAuthProvider)
+		if userId == "" || authProvider == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := db.Unscoped().Where("username = ? AND auth_provider = ?", userId, authProvider).Delete(&RevocationCutoff{}).Error; err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("revocation cutoff lifted", slog.String("authProvider", authProvider))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevocationWebhook accepts revocations from the auth service. The body
+// is a RevocationRequest signed with REVOCATION_WEBHOOK_SECRET: the
+// X-Signature-Timestamp header carries the Unix time of the request, and
+// X-Signature-256 carries "sha256=" and the hex HMAC-SHA256 of the timestamp,
+// a ".", and the body. Requests more than webhookTolerance away from now are
+// refused, and a cutoff without issuedBefore takes the signed timestamp, so a
+// captured request cannot be replayed later to revoke the user's new tokens.
+func handleRevocationWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if revocationWebhookSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	timestamp := r.Header.Get(headerWebhookTimestamp)
+	signedAt, tsErr := strconv.ParseInt(timestamp, 10, 64)
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(headerWebhookSignature), webhookSignaturePrefix))
+	mac := hmac.New(sha256.New, []byte(revocationWebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if tsErr != nil || err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		unauthorized(w)
+		return
+	}
+	if skew := time.Since(time.Unix(signedAt, 0)); skew > webhookTolerance || skew < -webhookTolerance {
+		slog.Warn("revocation webhook refused: timestamp outside the tolerance", slog.Duration("skew", skew))
+		unauthorized(w)
+		return
+	}
+
+	var req RevocationRequest
+	if err := json.Unmarshal(body, &req); err != nil || !req.valid() {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.IssuedBefore == 0 {
+		req.IssuedBefore = signedAt
+	}
+	if err := revoke(r.Context(), req); err != nil {
+		slog.Error(err.Error())
+		http.Error(w, "failed to record revocation", http.StatusInternalServerError)
+		return
+	}
+	logRevocation("webhook", req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (req RevocationRequest) valid() bool {
+	return req.Jti != "" || req.SessionId != "" || req.UserId != ""
+}
+
+func logRevocation(source string, req RevocationRequest) {
+	slog.Info("tokens revoked", slog.String("source", source),
+		slog.Bool("jti", req.Jti != ""), slog.Bool("session", req.SessionId != ""), slog.Bool("user", req.UserId != ""))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// useRevocationWebhook enables revocations with the webhook secret for the
+// length of the test.
+func useRevocationWebhook(t *testing.T) {
+	t.Helper()
+	prev := revocationWebhookSecret
+	t.Cleanup(func() { revocationWebhookSecret = prev })
+	revocationWebhookSecret = "webhook-secret"
+}
+
+// revocationWebhookRequest signs body with secret at signedAt.
+func revocationWebhookRequest(body, secret string, signedAt time.Time) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/revocations", strings.NewReader(body))
+	r.Header.Set(headerWebhookTimestamp, timestamp)
+	r.Header.Set(headerWebhookSignature, webhookSignaturePrefix+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestCheckRevocation(t *testing.T) {
+	newTestDB(t)
+	useRevocationWebhook(t)
+	ctx := context.Background()
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	for _, entry := range []RevokedToken{{ID: "revoked-jti"}, {ID: "revoked-sid"}, {ID: "expired-jti", ExpiresAt: &expired}} {
+		if err := db.Create(&entry).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := RevocationCutoff{ID: uuid.NewString(), Username: "bob", AuthProvider: authProviderDefault, IssuedBefore: now.Add(-time.Hour).Truncate(time.Second)}
+	if err := db.Create(&cutoff).Error; err != nil {
+		t.Fatal(err)
+	}
+	iat := func(d time.Duration) float64 { return float64(cutoff.IssuedBefore.Add(d).Unix()) }
+
+	tests := []struct {
+		name    string
+		userId  string
+		claims  jwt.MapClaims
+		revoked bool
+	}{
+		{"not revoked", "alice", jwt.MapClaims{"jti": "other-jti", "iat": iat(0)}, false},
+		{"revoked jti", "alice", jwt.MapClaims{"jti": "revoked-jti"}, true},
+		{"revoked session", "alice", jwt.MapClaims{"jti": "other-jti", "sid": "revoked-sid"}, true},
+		{"expired entry", "alice", jwt.MapClaims{"jti": "expired-jti"}, false},
+		{"issued before the cutoff", "bob", jwt.MapClaims{"iat": iat(-time.Minute)}, true},
+		{"issued at the cutoff", "bob", jwt.MapClaims{"iat": iat(0)}, true},
+		{"issued after the cutoff", "bob", jwt.MapClaims{"iat": iat(time.Second)}, false},
+		{"no iat under a cutoff", "bob", jwt.MapClaims{}, true},
+	}
+	for _, test := range tests {
+		identity := &authIdentity{UserID: test.userId, AuthProvider: authProviderDefault, Claims: test.claims}
+		err := checkRevocation(ctx, identity)
+		if got := rejectionReason(err) == rejectRevoked; got != test.revoked || (err != nil && !got) {
+			t.Errorf("%s: err = %v, want revoked %v", test.name, err, test.revoked)
+		}
+	}
+
+	// Without the admin endpoint or the webhook nothing can be revoked, so
+	// tokens are not looked up.
+	revocationWebhookSecret = ""
+	if err := checkRevocation(ctx, &authIdentity{UserID: "alice", Claims: jwt.MapClaims{"jti": "revoked-jti"}}); err != nil {
+		t.Errorf("with revocation disabled: %v", err)
+	}
+}
+
+func TestRevokeCutoffOnlyMovesForward(t *testing.T) {
+	newTestDB(t)
+	requirePostgres(t)
+	useRevocationWebhook(t)
+	ctx := context.Background()
+	later, earlier := time.Now().Add(-time.Minute).Unix(), time.Now().Add(-time.Hour).Unix()
+
+	for _, issuedBefore := range []int64{later, earlier} {
+		if err := revoke(ctx, RevocationRequest{UserId: "alice", IssuedBefore: issuedBefore}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var cutoff RevocationCutoff
+	if err := db.First(&cutoff, "username = ?", "alice").Error; err != nil {
+		t.Fatal(err)
+	}
+	if cutoff.IssuedBefore.Unix() != later {
+		t.Errorf("cutoff = %s, want the later one", cutoff.IssuedBefore)
+	}
+}
+
+func TestRevocationWebhookSignature(t *testing.T) {
+	useRevocationWebhook(t)
+	body := `{"jti": "stolen"}`
+	now := time.Now()
+
+	tampered := revocationWebhookRequest(body, revocationWebhookSecret, now)
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"userId": "alice"}`)).Body
+	retimed := revocationWebhookRequest(body, revocationWebhookSecret, now)
+	retimed.Header.Set(headerWebhookTimestamp, strconv.FormatInt(now.Unix()+1, 10))
+	unsigned := revocationWebhookRequest(body, revocationWebhookSecret, now)
+	unsigned.Header.Del(headerWebhookSignature)
+	untimed := revocationWebhookRequest(body, revocationWebhookSecret, now)
+	untimed.Header.Del(headerWebhookTimestamp)
+
+	tests := []struct {
+		name string
+		r    *http.Request
+	}{
+		{"wrong secret", revocationWebhookRequest(body, "other-secret", now)},
+		{"tampered body", tampered},
+		{"changed timestamp", retimed},
+		{"no signature", unsigned},
+		{"no timestamp", untimed},
+		{"stale", revocationWebhookRequest(body, revocationWebhookSecret, now.Add(-webhookTolerance-time.Minute))},
+		{"from the future", revocationWebhookRequest(body, revocationWebhookSecret, now.Add(webhookTolerance+time.Minute))},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handleRevocationWebhook(w, test.r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", test.name, w.Code)
+		}
+	}
+
+	revocationWebhookSecret = ""
+	w := httptest.NewRecorder()
+	handleRevocationWebhook(w, revocationWebhookRequest(body, "", now))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("without a secret: status %d, want 404", w.Code)
+	}
+}
+
+func TestRevocationWebhook(t *testing.T) {
+	newTestDB(t)
+	useRevocationWebhook(t)
+
+	w := httptest.NewRecorder()
+	handleRevocationWebhook(w, revocationWebhookRequest(`{"jti": "stolen"}`, revocationWebhookSecret, time.Now().Add(-time.Minute)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if n := countRows(t, &RevokedToken{}, "id = ?", "stolen"); n != 1 {
+		t.Error("jti not on the deny-list")
+	}
+
+	w = httptest.NewRecorder()
+	handleRevocationWebhook(w, revocationWebhookRequest(`{"expiresAt": 1}`, revocationWebhookSecret, time.Now()))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("request without a token or user: status %d, want 400", w.Code)
+	}
+}
+
+func TestRevocationWebhookCutoffTakesSignedTimestamp(t *testing.T) {
+	newTestDB(t)
+	requirePostgres(t)
+	useRevocationWebhook(t)
+	signedAt := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+
+	w := httptest.NewRecorder()
+	handleRevocationWebhook(w, revocationWebhookRequest(`{"userId": "alice"}`, revocationWebhookSecret, signedAt))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var cutoff RevocationCutoff
+	if err := db.First(&cutoff, "username = ? AND auth_provider = ?", "alice", authProviderDefault).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !cutoff.IssuedBefore.Equal(signedAt) {
+		t.Errorf("cutoff = %s, want the signed timestamp %s", cutoff.IssuedBefore, signedAt)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// startShareRotation periodically re-encrypts shares, and re-wraps tenant keys,
+// that were sealed with a non-active key version. It runs once immediately and then every
+// SHARE_KEY_ROTATION_INTERVAL (default 1h, 0 disables it).
+func startShareRotation(ctx context.Context) error {
+	interval, err := envDuration("SHARE_KEY_ROTATION_INTERVAL", time.Hour)
+	if err != nil {
+		return err
+	}
+	batchSize, err := envInt("SHARE_KEY_ROTATION_BATCH_SIZE", 100)
+	if err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("SHARE_KEY_ROTATION_BATCH_SIZE must be positive")
+	}
+	if interval <= 0 {
+		slog.Info("share key rotation disabled")
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			rotated, err := rotateShares(ctx, batchSize)
+			if err != nil {
+				slog.Error(fmt.Sprintf("share key rotation failed: %v", err))
+			} else if rotated > 0 {
+				slog.Info("share key rotation completed", slog.Int("rotated", rotated), slog.String("activeKey", shareKeyProvider.ActiveKeyID()))
+			}
+			rewrapped, err := rewrapTenantKeys(ctx, shareKeyProvider, shareKeyProvider, false)
+			if err != nil {
+				slog.Error(fmt.Sprintf("tenant key rotation failed: %v", err))
+			} else if rewrapped > 0 {
+				slog.Info("tenant key rotation completed", slog.Int("rewrapped", rewrapped), slog.String("activeKey", shareKeyProvider.ActiveKeyID()))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// rotateShares re-encrypts every device share not sealed with the active key
+// or not yet bound to its owner, walking the table in primary-key order
+// batchSize rows at a time. Each row is only updated if its ciphertext is
+// unchanged since it was read, so a share written concurrently by a handler is
+// never overwritten.
+func rotateShares(ctx context.Context, batchSize int) (int, error) {
+	rotated := 0
+	lastId := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return rotated, err
+		}
+
+		var devices []Device
+		if err := db.WithContext(ctx).Unscoped().Where("id > ?", lastId).Order("id").Limit(batchSize).Find(&devices).Error; err != nil {
+			return rotated, fmt.Errorf("failed to list devices: %w", err)
+		}
+		if len(devices) == 0 {
+			return rotated, nil
+		}
+
+		owners, err := signerOwners(ctx, devices)
+		if err != nil {
+			return rotated, err
+		}
+
+		for _, device := range devices {
+			lastId = device.ID
+
+			account, ok := owners[device.SignerId]
+			if !ok {
+				slog.Error("skipping device without an owning account", slog.String("deviceId", device.ID))
+				continue
+			}
+			binding := newShareBinding(device.ID, account)
+
+			stale, err := shareNeedsRotation(ctx, device.Share, binding)
+			if err != nil {
+				slog.Error(fmt.Sprintf("skipping device with unreadable share header: %v", err), slog.String("deviceId", device.ID))
+				continue
+			}
+			if !stale {
+				continue
+			}
+
+			plaintext, err := decryptShare(ctx, device.Share, binding)
+			if err != nil {
+				slog.Error(fmt.Sprintf("skipping device that failed to decrypt: %v", err), slog.String("deviceId", device.ID))
+				continue
+			}
+			reencrypted, err := encryptShare(ctx, plaintext.Bytes(), binding)
+			plaintext.Wipe()
+			if err != nil {
+				return rotated, err
+			}
+
+			result := db.WithContext(ctx).Unscoped().Model(&Device{}).
+				Where("id = ? AND share = ?", device.ID, device.Share).
+				Update("share", reencrypted)
+			if result.Error != nil {
+				return rotated, fmt.Errorf("failed to update device %s: %w", device.ID, result.Error)
+			}
+			rotated += int(result.RowsAffected)
+		}
+	}
+}
+
+// signerOwners loads the account owning each device's signer, keyed by
+// signer id. When a signer has several accounts the oldest one wins, matching
+// the account the share was first bound to.
+func signerOwners(ctx context.Context, devices []Device) (map[string]Account, error) {
+	signerIds := make([]string, 0, len(devices))
+	for _, device := range devices {
+		signerIds = append(signerIds, device.SignerId)
+	}
+
+	var accounts []Account
+	if err := db.WithContext(ctx).Unscoped().Where("signer_id IN ?", signerIds).Order("created_at DESC").Find(&accounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	owners := make(map[string]Account, len(accounts))
+	for _, account := range accounts {
+		owners[account.SignerId] = account
+	}
+	return owners, nil
+}
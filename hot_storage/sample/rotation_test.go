@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// rotateKeyRing returns a ring that holds the keys of ring plus a new active
+// version, leaving ring's active version retired.
+func rotateKeyRing(ring *keyRing, version string) *keyRing {
+	key := make([]byte, 32)
+	rand.Read(key)
+	rotated := &keyRing{active: version, keys: maps.Clone(ring.keys)}
+	rotated.keys[version] = newSecret(key)
+	return rotated
+}
+
+// useShareKeys makes ring the configured key provider and direct key ring for
+// the length of the test.
+func useShareKeys(t *testing.T, ring *keyRing) {
+	t.Helper()
+	prevProvider, prevKeys := shareKeyProvider, shareKeys
+	t.Cleanup(func() { shareKeyProvider, shareKeys = prevProvider, prevKeys })
+	shareKeyProvider, shareKeys = ring, ring
+}
+
+// sealLegacyShare seals plaintext the way shares were stored before key
+// versions: unbound AES-256-GCM under the key of legacyKeyVersion, without a
+// header.
+func sealLegacyShare(t *testing.T, ring *keyRing, plaintext string) string {
+	t.Helper()
+	key, err := ring.key(legacyKeyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newAEAD(algorithmAESGCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func TestDecryptWithRetiredKey(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestKeyRing(t)
+	binding := shareBinding{DeviceID: "device-1", SignerID: "signer-1"}
+	encoded, err := shareCipher{provider: ring}.encrypt(ctx, []byte("share"), binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := shareCipher{provider: rotateKeyRing(ring, "2")}
+	plaintext, err := c.decrypt(ctx, encoded, binding)
+	if err != nil {
+		t.Fatalf("decrypt with the retired key: %v", err)
+	}
+	defer plaintext.Wipe()
+	if string(plaintext.Bytes()) != "share" {
+		t.Errorf("decrypt = %q", plaintext.Bytes())
+	}
+	if rotate, err := c.needsRotation(encoded); err != nil || !rotate {
+		t.Errorf("needsRotation = %v, %v for a share of the retired key", rotate, err)
+	}
+
+	reencrypted, err := c.encrypt(ctx, plaintext.Bytes(), binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := decodeSealedShare(reencrypted); s.KeyID != "2" {
+		t.Errorf("new share sealed under key %q, want 2", s.KeyID)
+	}
+
+	// Once the retired key is removed, its shares no longer open.
+	removed := &keyRing{active: "2", keys: maps.Clone(c.provider.(*keyRing).keys)}
+	delete(removed.keys, "1")
+	if _, err := (shareCipher{provider: removed}).decrypt(ctx, encoded, binding); err == nil || !strings.Contains(err.Error(), `"1"`) {
+		t.Errorf("decrypt without the retired key: err = %v", err)
+	}
+}
+
+func TestRotateShares(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	ring := newTestKeyRing(t)
+	ring.keys[legacyKeyVersion] = newTestKeyRing(t).keys["1"]
+	useShareKeys(t, ring)
+	account := createTestAccount(t, "alice", "signer-1")
+
+	current := Device{ID: uuid.NewString(), SignerId: account.SignerId}
+	share, err := encryptShare(ctx, []byte("current"), newShareBinding(current.ID, account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Share = share
+	legacy := Device{ID: uuid.NewString(), SignerId: account.SignerId, Share: sealLegacyShare(t, ring, "legacy")}
+	orphan := Device{ID: uuid.NewString(), SignerId: "signer-without-account", Share: share}
+	for _, device := range []*Device{&current, &legacy, &orphan} {
+		if err := db.Create(device).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The legacy share is the only one to rotate before the key changes; the
+	// placeholder share of createTestAccount cannot be read and is skipped.
+	if rotated, err := rotateShares(ctx, 1); err != nil || rotated != 1 {
+		t.Fatalf("first rotation: rotated %d, err %v, want 1", rotated, err)
+	}
+
+	useShareKeys(t, rotateKeyRing(ring, "2"))
+	if rotated, err := rotateShares(ctx, 1); err != nil || rotated != 2 {
+		t.Fatalf("rotation to key 2: rotated %d, err %v, want 2", rotated, err)
+	}
+	for _, device := range []Device{current, legacy} {
+		var stored Device
+		if err := db.First(&stored, "id = ?", device.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := decodeSealedShare(stored.Share); s.KeyID != "2" || !s.Bound {
+			t.Errorf("device %s: key %q, bound %v after rotation", device.ID, s.KeyID, s.Bound)
+		}
+		plaintext, err := decryptShare(ctx, stored.Share, newShareBinding(device.ID, account))
+		if err != nil {
+			t.Fatalf("decrypt after rotation: %v", err)
+		}
+		plaintext.Wipe()
+	}
+	if n := countRows(t, &Device{}, "id = ? AND share = ?", orphan.ID, share); n != 1 {
+		t.Error("share of a device without an owning account was rotated")
+	}
+	if rotated, err := rotateShares(ctx, 1); err != nil || rotated != 0 {
+		t.Errorf("second rotation: rotated %d, err %v, want none", rotated, err)
+	}
+}
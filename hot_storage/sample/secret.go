@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+const redacted = "[REDACTED]"
+
+// secret holds sensitive bytes such as a plaintext share or an encryption
+// key. It redacts itself when formatted through fmt or slog, and writeShareJSON
+// is the only way its contents leave the process. Call Wipe once the value is
+// no longer needed. Copies of a secret share the same backing array, so
+// wiping any copy wipes them all.
+type secret struct {
+	b []byte
+}
+
+func newSecret(b []byte) secret {
+	return secret{b: b}
+}
+
+// Bytes returns the underlying bytes without copying them.
+func (s secret) Bytes() []byte {
+	return s.b
+}
+
+// Wipe overwrites the secret with zeros.
+func (s secret) Wipe() {
+	clear(s.b)
+}
+
+func (s secret) String() string {
+	return redacted
+}
+
+func (s secret) GoString() string {
+	return redacted
+}
+
+func (s secret) Format(f fmt.State, _ rune) {
+	io.WriteString(f, redacted)
+}
+
+func (s secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// errSecretJSON is returned by MarshalJSON for a secret that is not empty.
+var errSecretJSON = errors.New("secrets must be written with writeShareJSON")
+
+// MarshalJSON only encodes an empty secret, as "". encoding/json copies the
+// output of MarshalJSON into buffers it pools and never clears, so a secret
+// with contents is refused; responses carrying one go through writeShareJSON.
+func (s secret) MarshalJSON() ([]byte, error) {
+	if len(s.b) > 0 {
+		return nil, errSecretJSON
+	}
+	return []byte(`""`), nil
+}
+
+// shareMember is how an empty share member of a response encodes.
+var shareMember = []byte(`"share":""`)
+
+// writeShareJSON writes v as the JSON response with share as the contents of
+// its share member, which v leaves empty. The response is built in a single
+// buffer sized up front and cleared once written, so the handler leaves no
+// copy of the share behind; the copies net/http makes while sending it are
+// out of its reach.
+func writeShareJSON(w http.ResponseWriter, v any, share secret) {
+	body, err := json.Marshal(v)
+	i := bytes.Index(body, shareMember)
+	if err != nil || i < 0 || bytes.Count(body, shareMember) != 1 {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	at := i + len(shareMember) - 1
+
+	buf := make([]byte, 0, len(body)+share.escapedLen()+1)
+	buf = append(buf, body[:at]...)
+	buf = share.appendEscaped(buf)
+	buf = append(buf, body[at:]...)
+	buf = append(buf, '\n')
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.Write(buf)
+	clear(buf)
+}
+
+// escapedLen is the length of the secret escaped for a JSON string.
+func (s secret) escapedLen() int {
+	n := 0
+	for _, c := range s.b {
+		switch {
+		case c == '"' || c == '\\':
+			n += 2
+		case c < 0x20:
+			n += 6
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// appendEscaped appends the secret escaped for a JSON string, without the
+// quotes and without converting it to a Go string, which could not be wiped.
+func (s secret) appendEscaped(buf []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	for _, c := range s.b {
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteShareJSON(t *testing.T) {
+	share := newSecret([]byte("line\n\"quoted\" \\ \x01 é"))
+	rec := httptest.NewRecorder()
+	writeShareJSON(rec, DeviceResponse{ID: "device-1", Object: "device", IsPrimary: true}, share)
+
+	if ct := rec.Header().Get(contentTypeHeader); ct != contentTypeJSON {
+		t.Errorf("content type = %q", ct)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response %q is not JSON: %v", rec.Body.String(), err)
+	}
+	if got["share"] != string(share.Bytes()) || got["id"] != "device-1" || got["isPrimary"] != true {
+		t.Errorf("response = %v", got)
+	}
+}
+
+func TestWriteShareJSONNested(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeShareJSON(rec, NextAction{NextAction: actionRecover, Embedded: &Embedded{ChainID: 1, Share: &secret{}}}, newSecret([]byte("share")))
+
+	var embedded struct {
+		Embedded struct {
+			Share string `json:"share"`
+		} `json:"embedded"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &embedded); err != nil {
+		t.Fatalf("response %q is not JSON: %v", rec.Body.String(), err)
+	}
+	if embedded.Embedded.Share != "share" {
+		t.Errorf("share = %q", embedded.Embedded.Share)
+	}
+}
+
+func TestSecretMarshalJSON(t *testing.T) {
+	if out, err := json.Marshal(DeviceResponse{ID: "device-1"}); err != nil || !json.Valid(out) {
+		t.Errorf("empty secret: %s, %v", out, err)
+	}
+	_, err := json.Marshal(DeviceResponse{Share: newSecret([]byte("share"))})
+	if !errors.Is(err, errSecretJSON) {
+		t.Errorf("marshalling a secret: err = %v, want %v", err, errSecretJSON)
+	}
+}
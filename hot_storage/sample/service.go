@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	headerServiceUser   = "X-User-Id"
+	headerServiceTenant = "X-Tenant"
+
+	spiffeScheme = "spiffe"
+
+	permissionAccountsImport = "accounts:import"
+	permissionAccountsRead   = "accounts:read"
+)
+
+// ErrServiceForbidden is returned when a service calls a route its
+// permissions do not cover.
+var ErrServiceForbidden = errors.New("service is not allowed to call this route")
+
+// servicePermissions maps each permission to the routes it opens, as
+// "METHOD path". Services can call no other route.
+var servicePermissions = map[string][]string{
+	permissionAccountsImport: {"POST /v2/accounts/import-share"},
+	permissionAccountsRead:   {"GET /v2/accounts", "GET /v2/accounts/signer", "GET /v2/accounts/migrated-data"},
+}
+
+// serviceIdentity is a backend service that authenticates with a client
+// certificate instead of a user token. It acts for the user named in the
+// X-User-Id header.
+type serviceIdentity struct {
+	Name string `json:"name"`
+	// Subjects are certificate subjects in RFC 2253 form, such as
+	// "CN=migrator,O=Openfort".
+	Subjects []string `json:"subjects"`
+	// SPIFFEIDs are URI SANs such as "spiffe://example.org/migrator".
+	SPIFFEIDs   []string `json:"spiffeIds"`
+	Permissions []string `json:"permissions"`
+	// AuthProviders limits the accounts the service can act for to these auth
+	// providers. Empty allows every provider.
+	AuthProviders []string `json:"authProviders"`
+}
+
+// serviceIdentities is set by initServiceIdentities.
+var serviceIdentities []serviceIdentity
+
+// initServiceIdentities reads the service identities from SERVICE_IDENTITIES
+// or SERVICE_IDENTITIES_FILE, a JSON array of serviceIdentity.
+func initServiceIdentities() error {
+	inline := os.Getenv("SERVICE_IDENTITIES")
+	path := os.Getenv("SERVICE_IDENTITIES_FILE")
+	var data []byte
+	switch {
+	case inline != "" && path != "":
+		return fmt.Errorf("set only one of SERVICE_IDENTITIES and SERVICE_IDENTITIES_FILE")
+	case inline != "":
+		data = []byte(inline)
+	case path != "":
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read SERVICE_IDENTITIES_FILE: %w", err)
+		}
+	default:
+		return nil
+	}
+
+	var identities []serviceIdentity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return fmt.Errorf("failed to parse service identities: %w", err)
+	}
+	if len(identities) > 0 && (serverTLS == nil || serverTLS.ClientCAs == nil) {
+		return fmt.Errorf("service identities need TLS_CLIENT_CA_FILE")
+	}
+	seen := make(map[string]bool)
+	for _, identity := range identities {
+		if identity.Name == "" {
+			return fmt.Errorf("service identity name must be set")
+		}
+		if len(identity.Subjects) == 0 && len(identity.SPIFFEIDs) == 0 {
+			return fmt.Errorf("service identity %q must set subjects or spiffeIds", identity.Name)
+		}
+		for _, id := range append(identity.Subjects, identity.SPIFFEIDs...) {
+			if seen[id] {
+				return fmt.Errorf("%q is mapped to more than one service identity", id)
+			}
+			seen[id] = true
+		}
+		for _, permission := range identity.Permissions {
+			if _, ok := servicePermissions[permission]; !ok {
+				return fmt.Errorf("service identity %q: unknown permission %q", identity.Name, permission)
+			}
+		}
+	}
+	serviceIdentities = identities
+	return nil
+}
+
+// clientService returns the service identity of the request's verified client
+// certificate, or nil when there is none or it maps to no service.
+func clientService(r *http.Request) *serviceIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for i := range serviceIdentities {
+		if serviceIdentities[i].matches(cert) {
+			return &serviceIdentities[i]
+		}
+	}
+	return nil
+}
+
+func (s *serviceIdentity) matches(cert *x509.Certificate) bool {
+	if slices.Contains(s.Subjects, cert.Subject.String()) {
+		return true
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == spiffeScheme && slices.Contains(s.SPIFFEIDs, uri.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *serviceIdentity) allowed(r *http.Request) bool {
+	route := r.Method + " " + r.URL.Path
+	for _, permission := range s.Permissions {
+		if slices.Contains(servicePermissions[permission], route) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateService authenticates a request made by service for the user
+// in X-User-Id, whose accounts belong to the X-Auth-Provider provider.
+// When tenants come from a token claim, X-Tenant names the tenant.
+func authenticateService(ctx context.Context, r *http.Request, service *serviceIdentity) (*authIdentity, error) {
+	if !service.allowed(r) {
+		slog.Info("service request refused", slog.String("service", service.Name), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+		return nil, ErrServiceForbidden
+	}
+	userId := r.Header.Get(headerServiceUser)
+	if userId == "" {
+		return nil, ErrMissingToken
+	}
+	authProvider := r.Header.Get(headerAuthProvider)
+	if authProvider == "" {
+		authProvider = authProviderDefault
+	}
+	if len(service.AuthProviders) > 0 && !slices.Contains(service.AuthProviders, authProvider) {
+		slog.Info("service request refused", slog.String("service", service.Name), slog.String("authProvider", authProvider))
+		return nil, ErrServiceForbidden
+	}
+
+	identity := &authIdentity{UserID: userId, AuthProvider: authProvider, Service: service.Name, SenderConstrained: true}
+	if err := resolveLinkedIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(tenantSource, tenantSourceClaimPrefix) {
+		identity.Tenant = r.Header.Get(headerServiceTenant)
+		if identity.Tenant == "" {
+			return nil, fmt.Errorf("service request is missing the %s header", headerServiceTenant)
+		}
+	} else {
+		tenant, err := resolveTenant(identity)
+		if err != nil {
+			return nil, err
+		}
+		identity.Tenant = tenant
+	}
+	slog.Info("authenticated service", slog.String("service", service.Name), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+	return identity, nil
+}
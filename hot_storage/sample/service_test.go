@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate for subject and the URI SANs.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// useServiceIdentities reads identities as SERVICE_IDENTITIES, with client
+// certificates of ca accepted, for the length of the test.
+func useServiceIdentities(t *testing.T, ca *testCA, identities string) {
+	t.Helper()
+	prevTLS, prevIdentities := serverTLS, serviceIdentities
+	t.Cleanup(func() { serverTLS, serviceIdentities = prevTLS, prevIdentities })
+	serverTLS = &tls.Config{ClientCAs: x509.NewCertPool(), ClientAuth: tls.VerifyClientCertIfGiven}
+	serverTLS.ClientCAs.AddCert(ca.cert)
+	t.Setenv("SERVICE_IDENTITIES", identities)
+	t.Setenv("SERVICE_IDENTITIES_FILE", "")
+	if err := initServiceIdentities(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newServiceTestServer serves handler over TLS with the client certificate
+// settings of serverTLS, and returns a function that makes clients
+// presenting certs.
+func newServiceTestServer(t *testing.T, handler http.Handler) (*httptest.Server, func(certs ...tls.Certificate) *http.Client) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = serverTLS.Clone()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, func(certs ...tls.Certificate) *http.Client {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		return &http.Client{Transport: transport}
+	}
+}
+
+func TestClientService(t *testing.T) {
+	ca := newTestCA(t)
+	useServiceIdentities(t, ca, `[
+		{"name": "migrator", "subjects": ["CN=migrator,O=Openfort"], "permissions": ["accounts:import"]},
+		{"name": "reader", "spiffeIds": ["spiffe://example.org/reader"], "permissions": ["accounts:read"]}
+	]`)
+	server, client := newServiceTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if service := clientService(r); service != nil {
+			io.WriteString(w, service.Name)
+		}
+	}))
+
+	tests := []struct {
+		name string
+		cert []tls.Certificate
+		want string
+	}{
+		{"subject", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "migrator", Organization: []string{"Openfort"}})}, "migrator"},
+		{"spiffe id", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "anything"}, "spiffe://example.org/reader")}, "reader"},
+		{"unmapped subject", []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "migrator"})}, ""},
+		{"other spiffe id", []tls.Certificate{ca.issue(t, pkix.Name{}, "spiffe://example.org/writer")}, ""},
+		{"not spiffe", []tls.Certificate{ca.issue(t, pkix.Name{}, "https://example.org/reader")}, ""},
+		{"no certificate", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client(test.cert...).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != test.want {
+				t.Errorf("service = %q, want %q", body, test.want)
+			}
+		})
+	}
+
+	// A certificate of another CA fails the handshake.
+	other := newTestCA(t).issue(t, pkix.Name{CommonName: "migrator", Organization: []string{"Openfort"}})
+	if resp, err := client(other).Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Error("certificate of an untrusted CA accepted")
+	}
+}
+
+func TestInitServiceIdentities(t *testing.T) {
+	ca := newTestCA(t)
+	useServiceIdentities(t, ca, "")
+
+	for _, identities := range []string{
+		`[{"subjects": ["CN=a"]}]`,
+		`[{"name": "a"}]`,
+		`[{"name": "a", "subjects": ["CN=a"], "permissions": ["accounts:delete"]}]`,
+		`[{"name": "a", "subjects": ["CN=a"]}, {"name": "b", "subjects": ["CN=a"]}]`,
+		`{"name": "a"}`,
+	} {
+		t.Setenv("SERVICE_IDENTITIES", identities)
+		if err := initServiceIdentities(); err == nil {
+			t.Errorf("SERVICE_IDENTITIES=%s accepted", identities)
+		}
+	}
+
+	serverTLS = nil
+	t.Setenv("SERVICE_IDENTITIES", `[{"name": "a", "subjects": ["CN=a"]}]`)
+	if err := initServiceIdentities(); err == nil {
+		t.Error("service identities accepted without a client CA")
+	}
+}
+
+func TestAuthenticateService(t *testing.T) {
+	newTestDB(t)
+	ca := newTestCA(t)
+	useServiceIdentities(t, ca, `[
+		{"name": "reader", "subjects": ["CN=reader"], "permissions": ["accounts:read"], "authProviders": ["default"]}
+	]`)
+	prevTenantSource := tenantSource
+	t.Cleanup(func() { tenantSource = prevTenantSource })
+	server, client := newServiceTestServer(t, authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s/%s/%s", r.Context().Value(fieldUserId), r.Context().Value(fieldAuthProvider), r.Context().Value(fieldTenant))
+	})))
+	reader := client(ca.issue(t, pkix.Name{CommonName: "reader"}))
+
+	request := func(method, path string, header map[string]string) (int, string) {
+		t.Helper()
+		r, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		resp, err := reader.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	tenantSource = ""
+	if status, body := request(http.MethodGet, "/v2/accounts", map[string]string{headerServiceUser: "alice"}); status != http.StatusOK || body != "alice/default/" {
+		t.Errorf("permitted route: status %d: %s", status, body)
+	}
+	if status, _ := request(http.MethodPost, "/v2/accounts/import-share", map[string]string{headerServiceUser: "alice"}); status != http.StatusForbidden {
+		t.Errorf("route outside the permissions: status %d, want 403", status)
+	}
+	if status, _ := request(http.MethodGet, "/v2/accounts", map[string]string{headerServiceUser: "alice", headerAuthProvider: authProviderGoogle}); status != http.StatusForbidden {
+		t.Errorf("other auth provider: status %d, want 403", status)
+	}
+	if status, _ := request(http.MethodGet, "/v2/accounts", nil); status != http.StatusUnauthorized {
+		t.Errorf("without %s: status %d, want 401", headerServiceUser, status)
+	}
+
+	tenantSource = tenantSourceClaimPrefix + "org"
+	if status, _ := request(http.MethodGet, "/v2/accounts", map[string]string{headerServiceUser: "alice"}); status != http.StatusUnauthorized {
+		t.Errorf("without %s: status %d, want 401", headerServiceTenant, status)
+	}
+	if status, body := request(http.MethodGet, "/v2/accounts", map[string]string{headerServiceUser: "alice", headerServiceTenant: "acme"}); status != http.StatusOK || body != "alice/default/acme" {
+		t.Errorf("with %s: status %d: %s", headerServiceTenant, status, body)
+	}
+
+	tenantSource = tenantSourceAuthProvider
+	if status, body := request(http.MethodGet, "/v2/accounts", map[string]string{headerServiceUser: "alice", headerServiceTenant: "acme"}); status != http.StatusOK || body != "alice/default/default" {
+		t.Errorf("tenant from the auth provider: status %d: %s", status, body)
+	}
+}
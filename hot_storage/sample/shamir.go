@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Shamir's secret sharing over GF(2^8) with the AES reduction polynomial.
+// Each share is the evaluation of one random polynomial per secret byte at a
+// distinct non-zero x, encoded as y-values followed by the x coordinate.
+
+var errInvalidShares = errors.New("invalid key shares")
+
+// gfMul multiplies in GF(2^8) without data-dependent branches or table
+// lookups, so timing does not depend on the secret.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= -(b & 1) & a
+		hi := a >> 7
+		a = (a << 1) ^ (-hi & 0x1b)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, the multiplicative inverse of a non-zero a.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for range 254 {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// shamirSplit splits secret into n shares, any threshold of which recover it.
+func shamirSplit(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("threshold must be between 2 and the number of shares, and at most 255 shares")
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("cannot split an empty secret")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	defer clear(coefficients)
+	for b, s := range secret {
+		coefficients[0] = s
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %w", err)
+		}
+		for i := range shares {
+			x := shares[i][len(secret)]
+			// Horner's rule from the highest coefficient down.
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i][b] = y
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from at least threshold shares by
+// Lagrange interpolation at x = 0. Too few shares yield a wrong secret rather
+// than an error, so callers must verify the result.
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%w: at least two shares are required", errInvalidShares)
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, fmt.Errorf("%w: share too short", errInvalidShares)
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if len(share) != size {
+			return nil, fmt.Errorf("%w: shares have different lengths", errInvalidShares)
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("%w: duplicate or zero share index", errInvalidShares)
+		}
+		seen[x] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		xi := share[size-1]
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			xj := other[size-1]
+			basis = gfMul(basis, gfMul(xj, gfInv(xj^xi)))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share[b], basis)
+		}
+	}
+	return secret, nil
+}
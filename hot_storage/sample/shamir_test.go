@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	// Products and inverse from FIPS 197, sections 4.2 and 5.1.1.
+	for _, test := range []struct{ a, b, want byte }{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x01, 0x57},
+		{0x57, 0x00, 0x00},
+	} {
+		if got := gfMul(test.a, test.b); got != test.want {
+			t.Errorf("gfMul(%#x, %#x) = %#x, want %#x", test.a, test.b, got, test.want)
+		}
+	}
+	if got := gfInv(0x53); got != 0xca {
+		t.Errorf("gfInv(0x53) = %#x, want 0xca", got)
+	}
+}
+
+func TestShamirCombineKnownAnswer(t *testing.T) {
+	// f(x) = 0x42 + x and g(x) = 0x00 + 0x80x, so f(1) = 0x43, f(2) = 0x40,
+	// g(1) = 0x80 and g(2) = 0x1b after reduction.
+	shares := [][]byte{{0x43, 0x80, 0x01}, {0x40, 0x1b, 0x02}}
+	secret, err := shamirCombine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x42, 0x00}; !bytes.Equal(secret, want) {
+		t.Errorf("secret = %x, want %x", secret, want)
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	shares, err := shamirSplit(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {2, 3, 4}, {4, 0, 2}, {0, 1, 2, 3, 4}} {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		got, err := shamirCombine(picked)
+		if err != nil {
+			t.Fatalf("shares %v: %v", subset, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("shares %v recovered %x, want %x", subset, got, secret)
+		}
+	}
+
+	got, err := shamirCombine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("two shares of a threshold of three recovered the secret")
+	}
+}
+
+func TestShamirCombineRejectsInvalidShares(t *testing.T) {
+	shares, err := shamirSplit([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := bytes.Clone(shares[1])
+	zero[len(zero)-1] = 0
+
+	for name, set := range map[string][][]byte{
+		"one share":       shares[:1],
+		"duplicate index": {shares[0], shares[0]},
+		"zero index":      {shares[0], zero},
+		"length mismatch": {shares[0], shares[1][1:]},
+	} {
+		if _, err := shamirCombine(set); !errors.Is(err, errInvalidShares) {
+			t.Errorf("%s: err = %v, want errInvalidShares", name, err)
+		}
+	}
+}
+
+func TestShamirSplitRejectsBadParameters(t *testing.T) {
+	for _, test := range []struct{ n, threshold int }{{3, 1}, {3, 4}, {256, 2}} {
+		if _, err := shamirSplit([]byte("secret"), test.n, test.threshold); err == nil {
+			t.Errorf("shamirSplit(n=%d, threshold=%d) succeeded", test.n, test.threshold)
+		}
+	}
+	if _, err := shamirSplit(nil, 3, 2); err == nil {
+		t.Error("shamirSplit of an empty secret succeeded")
+	}
+}
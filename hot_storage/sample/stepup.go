@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	shareEndpointAll              = "*"
+	shareEndpointRecover          = "recover"
+	shareEndpointInitRecover      = "init_recover"
+	shareEndpointGetDevice        = "get_device"
+	shareEndpointGetPrimaryDevice = "get_primary_device"
+
+	stepUpLinkIdentity   = "link_identity"
+	stepUpUnlinkIdentity = "unlink_identity"
+	stepUpDeleteAccount  = "delete_account"
+)
+
+// defaultStepUpPolicies apply until STEP_UP_POLICIES sets a policy for the
+// same endpoint. A stolen token must not be able to link an identity of the
+// attacker's, which would outlive the token's revocation, nor erase the
+// user's accounts.
+var defaultStepUpPolicies = map[string]stepUpPolicy{
+	stepUpLinkIdentity:   {MaxAge: 10 * time.Minute},
+	stepUpUnlinkIdentity: {MaxAge: 10 * time.Minute},
+	stepUpDeleteAccount:  {MaxAge: 10 * time.Minute},
+}
+
+// stepUpPolicy is the authentication a token needs to read shares through
+// an endpoint. Every condition that is set must hold.
+type stepUpPolicy struct {
+	// MaxAge is how long ago the user may have authenticated, going by the
+	// auth_time claim or else iat.
+	MaxAge time.Duration
+	// ACR lists accepted acr claim values.
+	ACR []string
+	// AMR lists amr claim values of which the token must carry at least one.
+	AMR []string
+}
+
+// stepUpPolicies is STEP_UP_POLICIES over defaultStepUpPolicies, keyed by
+// endpoint. The "*" policy applies to share endpoints without one of their
+// own.
+var stepUpPolicies = defaultStepUpPolicies
+
+// initStepUp reads STEP_UP_POLICIES, a JSON object such as
+//
+//	{"recover": {"maxAge": "5m", "amr": ["mfa", "hwk"]}, "*": {"maxAge": "1h"}}
+//
+// keyed by recover, init_recover, get_device, get_primary_device, "*",
+// link_identity, unlink_identity or delete_account.
+func initStepUp() error {
+	stepUpPolicies = maps.Clone(defaultStepUpPolicies)
+	v := os.Getenv("STEP_UP_POLICIES")
+	if v == "" {
+		return nil
+	}
+	var configs map[string]struct {
+		MaxAge string   `json:"maxAge"`
+		ACR    []string `json:"acr"`
+		AMR    []string `json:"amr"`
+	}
+	if err := json.Unmarshal([]byte(v), &configs); err != nil {
+		return fmt.Errorf("failed to parse STEP_UP_POLICIES: %w", err)
+	}
+	for endpoint, config := range configs {
+		switch endpoint {
+		case shareEndpointAll, shareEndpointRecover, shareEndpointInitRecover, shareEndpointGetDevice, shareEndpointGetPrimaryDevice,
+			stepUpLinkIdentity, stepUpUnlinkIdentity, stepUpDeleteAccount:
+		default:
+			return fmt.Errorf("STEP_UP_POLICIES: unknown endpoint %q", endpoint)
+		}
+		policy := stepUpPolicy{ACR: config.ACR, AMR: config.AMR}
+		if config.MaxAge != "" {
+			d, err := time.ParseDuration(config.MaxAge)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("STEP_UP_POLICIES: maxAge of %q must be a positive duration", endpoint)
+			}
+			policy.MaxAge = d
+		}
+		stepUpPolicies[endpoint] = policy
+	}
+	return nil
+}
+
+// stepUpRefusal is returned when a token does not meet a step-up: a step-up
+// policy of the endpoint, or a step-up a share read anomaly requires.
+type stepUpRefusal struct {
+	// MaxAge is the maximum age of the authentication the step-up needs.
+	MaxAge time.Duration
+	// ACRValues and AMRValues are the acr and amr values it accepts.
+	ACRValues []string
+	AMRValues []string
+}
+
+func (e *stepUpRefusal) Error() string {
+	return errStepUpRequired
+}
+
+// refuseStepUp answers a request refused for a step-up with 401 and the
+// insufficient_user_authentication challenge of RFC 9470.
+func refuseStepUp(w http.ResponseWriter, refusal *stepUpRefusal) {
+	maxAge := int(refusal.MaxAge.Seconds())
+	challenge := `Bearer error="insufficient_user_authentication", error_description="A more recent or stronger authentication is required"`
+	if len(refusal.ACRValues) > 0 {
+		challenge += fmt.Sprintf(`, acr_values="%s"`, strings.Join(refusal.ACRValues, " "))
+	}
+	if refusal.MaxAge > 0 {
+		challenge += fmt.Sprintf(`, max_age=%d`, maxAge)
+	}
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.Header().Set(headerWWWAuthenticate, challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(StepUpErrorResponse{Error: errStepUpRequired, MaxAge: maxAge, AcrValues: refusal.ACRValues, AmrValues: refusal.AMRValues})
+}
+
+// checkStepUp refuses a request to endpoint when the token does not meet the
+// endpoint's step-up policy.
+func checkStepUp(claims jwt.MapClaims, endpoint string, now time.Time) *stepUpRefusal {
+	policy, ok := stepUpPolicies[endpoint]
+	if !ok && isShareEndpoint(endpoint) {
+		policy, ok = stepUpPolicies[shareEndpointAll]
+	}
+	if !ok {
+		return nil
+	}
+	refusal := &stepUpRefusal{MaxAge: policy.MaxAge, ACRValues: policy.ACR, AMRValues: policy.AMR}
+	if policy.MaxAge > 0 {
+		at, ok := authenticatedAt(claims)
+		if !ok || now.Sub(at) > policy.MaxAge {
+			return refusal
+		}
+	}
+	if len(policy.ACR) > 0 && !hasACR(claims, policy.ACR) {
+		return refusal
+	}
+	if len(policy.AMR) > 0 && !hasAMR(claims, policy.AMR) {
+		return refusal
+	}
+	return nil
+}
+
+// isShareEndpoint reports whether endpoint reads shares, so that the "*"
+// policy applies to it.
+func isShareEndpoint(endpoint string) bool {
+	switch endpoint {
+	case shareEndpointRecover, shareEndpointInitRecover, shareEndpointGetDevice, shareEndpointGetPrimaryDevice:
+		return true
+	}
+	return false
+}
+
+// hasACR reports whether the acr claim is one of values.
+func hasACR(claims jwt.MapClaims, values []string) bool {
+	acr, _ := claims["acr"].(string)
+	return acr != "" && slices.Contains(values, acr)
+}
+
+// hasAMR reports whether the amr claim holds one of values.
+func hasAMR(claims jwt.MapClaims, values []string) bool {
+	amr, _ := claims["amr"].([]any)
+	return slices.ContainsFunc(amr, func(method any) bool {
+		s, _ := method.(string)
+		return s != "" && slices.Contains(values, s)
+	})
+}
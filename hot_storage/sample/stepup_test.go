@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useStepUpPolicies sets STEP_UP_POLICIES for the length of the test.
+func useStepUpPolicies(t *testing.T, policies string) {
+	t.Helper()
+	prev := stepUpPolicies
+	t.Cleanup(func() { stepUpPolicies = prev })
+	t.Setenv("STEP_UP_POLICIES", policies)
+	if err := initStepUp(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckStepUp(t *testing.T) {
+	useStepUpPolicies(t, `{
+		"recover": {"maxAge": "5m", "acr": ["urn:mace:incommon:iap:silver"]},
+		"get_device": {"amr": ["hwk", "otp"]},
+		"*": {"maxAge": "1h"}
+	}`)
+	now := time.Unix(1_700_000_000, 0)
+	ago := func(d time.Duration) float64 { return float64(now.Add(-d).Unix()) }
+	silver := "urn:mace:incommon:iap:silver"
+
+	tests := []struct {
+		name     string
+		endpoint string
+		claims   jwt.MapClaims
+		refused  bool
+	}{
+		{"recent with acr", shareEndpointRecover, jwt.MapClaims{"auth_time": ago(time.Minute), "acr": silver}, false},
+		{"too old", shareEndpointRecover, jwt.MapClaims{"auth_time": ago(6 * time.Minute), "acr": silver}, true},
+		{"iat without auth_time", shareEndpointRecover, jwt.MapClaims{"iat": ago(time.Minute), "acr": silver}, false},
+		{"auth_time over iat", shareEndpointRecover, jwt.MapClaims{"auth_time": ago(6 * time.Minute), "iat": ago(time.Minute), "acr": silver}, true},
+		{"no time", shareEndpointRecover, jwt.MapClaims{"acr": silver}, true},
+		{"other acr", shareEndpointRecover, jwt.MapClaims{"auth_time": ago(time.Minute), "acr": "pwd"}, true},
+		{"no acr", shareEndpointRecover, jwt.MapClaims{"auth_time": ago(time.Minute)}, true},
+		{"one amr", shareEndpointGetDevice, jwt.MapClaims{"amr": []any{"pwd", "otp"}}, false},
+		{"other amr", shareEndpointGetDevice, jwt.MapClaims{"amr": []any{"pwd"}}, true},
+		{"amr not a list", shareEndpointGetDevice, jwt.MapClaims{"amr": "otp"}, true},
+		{"fallback met", shareEndpointInitRecover, jwt.MapClaims{"auth_time": ago(30 * time.Minute)}, false},
+		{"fallback too old", shareEndpointGetPrimaryDevice, jwt.MapClaims{"auth_time": ago(2 * time.Hour)}, true},
+		{"default link policy", stepUpLinkIdentity, jwt.MapClaims{"auth_time": ago(11 * time.Minute)}, true},
+		{"default delete policy", stepUpDeleteAccount, jwt.MapClaims{"auth_time": ago(9 * time.Minute)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if refusal := checkStepUp(test.claims, test.endpoint, now); (refusal != nil) != test.refused {
+				t.Errorf("refused = %v, want %v", refusal != nil, test.refused)
+			}
+		})
+	}
+}
+
+func TestCheckStepUpFallback(t *testing.T) {
+	useStepUpPolicies(t, `{"*": {"amr": ["hwk"]}, "link_identity": {"maxAge": "1h"}}`)
+	claims := jwt.MapClaims{"auth_time": float64(time.Now().Add(-5 * time.Minute).Unix())}
+
+	// The "*" policy is for share endpoints only.
+	if refusal := checkStepUp(claims, shareEndpointRecover, time.Now()); refusal == nil || len(refusal.AMRValues) != 1 {
+		t.Errorf("recover: refusal = %+v, want the \"*\" policy", refusal)
+	}
+	for _, endpoint := range []string{stepUpLinkIdentity, stepUpDeleteAccount} {
+		if refusal := checkStepUp(claims, endpoint, time.Now()); refusal != nil {
+			t.Errorf("%s: refused by %+v", endpoint, refusal)
+		}
+	}
+	if refusal := checkStepUp(jwt.MapClaims{}, stepUpUnlinkIdentity, time.Now()); refusal == nil || refusal.MaxAge != 10*time.Minute {
+		t.Errorf("unlink_identity: refusal = %+v, want the default policy", refusal)
+	}
+}
+
+func TestInitStepUp(t *testing.T) {
+	prev := stepUpPolicies
+	t.Cleanup(func() { stepUpPolicies = prev })
+
+	for _, v := range []string{
+		`{"export": {"maxAge": "5m"}}`,
+		`{"recover": {"maxAge": "soon"}}`,
+		`{"recover": {"maxAge": "-5m"}}`,
+		`["recover"]`,
+	} {
+		t.Setenv("STEP_UP_POLICIES", v)
+		if err := initStepUp(); err == nil {
+			t.Errorf("STEP_UP_POLICIES=%s accepted", v)
+		}
+	}
+}
+
+func TestRefuseStepUp(t *testing.T) {
+	w := httptest.NewRecorder()
+	refuseStepUp(w, &stepUpRefusal{MaxAge: 5 * time.Minute, ACRValues: []string{"a", "b"}, AMRValues: []string{"hwk"}})
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+	challenge := w.Header().Get(headerWWWAuthenticate)
+	for _, param := range []string{`error="insufficient_user_authentication"`, `acr_values="a b"`, `max_age=300`} {
+		if !strings.Contains(challenge, param) {
+			t.Errorf("challenge %q lacks %s", challenge, param)
+		}
+	}
+	var response StepUpErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Error != errStepUpRequired || response.MaxAge != 300 || len(response.AmrValues) != 1 {
+		t.Errorf("body = %+v", response)
+	}
+}
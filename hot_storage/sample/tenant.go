@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	tenantSourceAuthProvider = "auth_provider"
+	tenantSourceClaimPrefix  = "claim:"
+
+	tenantKeyIdPrefix = "tenant:"
+)
+
+var (
+	// ErrTenantMismatch is returned when a request touches a share that was
+	// sealed for a different tenant than the caller's.
+	ErrTenantMismatch = errors.New("share belongs to another tenant")
+
+	// ErrTenantKeyDestroyed is returned for shares of a crypto-shredded tenant.
+	ErrTenantKeyDestroyed = errors.New("tenant key has been destroyed")
+
+	// tenantSource is SHARE_TENANT_SOURCE: empty to disable tenant keys,
+	// "auth_provider", or "claim:<name>" to read the tenant from a token claim.
+	tenantSource = os.Getenv("SHARE_TENANT_SOURCE")
+
+	tenantKeys = &tenantKeyStore{ttl: 5 * time.Minute, keys: make(map[string]cachedTenantKey), loading: make(map[string]chan struct{})}
+)
+
+// initTenants validates SHARE_TENANT_SOURCE and reads
+// SHARE_TENANT_KEY_CACHE_TTL, the time a replica may keep using a tenant key
+// after it was shredded.
+func initTenants() error {
+	if tenantSource != "" && tenantSource != tenantSourceAuthProvider &&
+		(!strings.HasPrefix(tenantSource, tenantSourceClaimPrefix) || tenantSource == tenantSourceClaimPrefix) {
+		return fmt.Errorf("SHARE_TENANT_SOURCE must be empty, %q or %q<claim>", tenantSourceAuthProvider, tenantSourceClaimPrefix)
+	}
+	ttl, err := envDuration("SHARE_TENANT_KEY_CACHE_TTL", tenantKeys.ttl)
+	if err != nil {
+		return err
+	}
+	tenantKeys.ttl = ttl
+	return nil
+}
+
+// resolveTenant returns the tenant an authenticated caller belongs to, or ""
+// when tenant keys are disabled.
+func resolveTenant(identity *authIdentity) (string, error) {
+	switch {
+	case tenantSource == "":
+		return "", nil
+	case tenantSource == tenantSourceAuthProvider:
+		return identity.AuthProvider, nil
+	default:
+		claim := strings.TrimPrefix(tenantSource, tenantSourceClaimPrefix)
+		tenant, ok := identity.Claims[claim].(string)
+		if !ok || tenant == "" {
+			return "", fmt.Errorf("token is missing the %q tenant claim", claim)
+		}
+		return tenant, nil
+	}
+}
+
+// cipherFor returns the cipher for shares bound to binding: the tenant's key
+// when the binding names a tenant, the configured key provider otherwise.
+// Within a request, a share sealed for another tenant is refused. Shares of
+// accounts created before tenant keys were enabled have no tenant and stay
+// under the configured provider.
+func cipherFor(ctx context.Context, binding shareBinding) (shareCipher, error) {
+	if binding.Tenant == "" {
+		return currentShareCipher(), nil
+	}
+	if requestTenant, ok := ctx.Value(fieldTenant).(string); ok && requestTenant != binding.Tenant {
+		return shareCipher{}, ErrTenantMismatch
+	}
+	return shareCipher{provider: tenantKeyProvider{tenant: binding.Tenant}}, nil
+}
+
+// tenantKeyProvider wraps share data keys with a tenant's key, itself wrapped
+// by shareKeyProvider and stored in tenant_keys. Shredding that row makes
+// every share of the tenant unrecoverable.
+type tenantKeyProvider struct {
+	tenant string
+}
+
+func (p tenantKeyProvider) ActiveKeyID() string {
+	return tenantKeyIdPrefix + p.tenant
+}
+
+func (p tenantKeyProvider) WrapKey(ctx context.Context, dek []byte) (string, string, []byte, error) {
+	key, err := tenantKeys.get(ctx, p.tenant, true)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer clear(key)
+	algorithm, wrapped, err := sealKey(key, dek)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return p.ActiveKeyID(), algorithm, wrapped, nil
+}
+
+func (p tenantKeyProvider) UnwrapKey(ctx context.Context, keyId, wrapAlgorithm string, wrapped []byte) ([]byte, error) {
+	if keyId != p.ActiveKeyID() {
+		return nil, ErrTenantMismatch
+	}
+	key, err := tenantKeys.get(ctx, p.tenant, false)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return openKey(key, wrapAlgorithm, wrapped)
+}
+
+type cachedTenantKey struct {
+	key     secret
+	expires time.Time
+}
+
+// tenantKeyStore caches unwrapped tenant keys for ttl. mu only guards the
+// maps: a key is loaded without it, one load per tenant at a time, so a slow
+// database or KMS call for one tenant does not hold up the others.
+type tenantKeyStore struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	keys map[string]cachedTenantKey
+	// loading holds a channel per tenant whose key is being loaded, closed
+	// when the load ends.
+	loading map[string]chan struct{}
+}
+
+// get returns a copy of the tenant's key, which the caller must clear. With
+// create, a missing key is generated and stored.
+func (s *tenantKeyStore) get(ctx context.Context, tenant string, create bool) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if cached, ok := s.keys[tenant]; ok {
+			if time.Now().Before(cached.expires) {
+				key := append([]byte(nil), cached.key.Bytes()...)
+				s.mu.Unlock()
+				return key, nil
+			}
+			cached.key.Wipe()
+			delete(s.keys, tenant)
+		}
+		done, ok := s.loading[tenant]
+		if !ok {
+			break
+		}
+		s.mu.Unlock()
+		// Another request is loading the key. Its result may not suit this
+		// one (create differs, or its context was cancelled), so look again
+		// once it is done rather than share its error.
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	s.loading[tenant] = done
+	s.mu.Unlock()
+
+	key, err := loadTenantKey(ctx, tenant, create)
+
+	s.mu.Lock()
+	delete(s.loading, tenant)
+	if err == nil {
+		s.keys[tenant] = cachedTenantKey{key: newSecret(append([]byte(nil), key...)), expires: time.Now().Add(s.ttl)}
+	}
+	s.mu.Unlock()
+	close(done)
+	return key, err
+}
+
+// loadTenantKey reads the tenant's key from tenant_keys. A shredded tenant
+// keeps a tombstone row, a soft-deleted row without key, so that create
+// cannot silently give it a new key.
+func loadTenantKey(ctx context.Context, tenant string, create bool) ([]byte, error) {
+	var row TenantKey
+	err := db.WithContext(ctx).Unscoped().First(&row, "id = ?", tenant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !create {
+			return nil, ErrTenantKeyDestroyed
+		}
+		return createTenantKey(ctx, tenant)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenant key: %w", err)
+	}
+	if row.DeletedAt.Valid {
+		return nil, ErrTenantKeyDestroyed
+	}
+	return shareKeyProvider.UnwrapKey(ctx, row.KeyID, row.WrapAlgorithm, row.WrappedKey)
+}
+
+func createTenantKey(ctx context.Context, tenant string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate tenant key: %w", err)
+	}
+	keyId, wrapAlgorithm, wrapped, err := shareKeyProvider.WrapKey(ctx, key)
+	if err != nil {
+		clear(key)
+		return nil, fmt.Errorf("failed to wrap tenant key: %w", err)
+	}
+
+	row := TenantKey{ID: tenant, KeyID: keyId, WrapAlgorithm: wrapAlgorithm, WrappedKey: wrapped}
+	result := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+	if result.Error != nil {
+		clear(key)
+		return nil, fmt.Errorf("failed to store tenant key: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Another replica created it first, or the tenant was shredded.
+		clear(key)
+		return loadTenantKey(ctx, tenant, false)
+	}
+	slog.Info("created tenant key", slog.String("tenant", tenant))
+	return key, nil
+}
+
+// rewrapTenantKeys re-wraps tenant keys from one key provider to another.
+// With from == to (online rotation) only keys not wrapped under the active KEK
+// with shareAlgorithm are re-wrapped; otherwise (rekey) every key that to
+// cannot already open is.
+func rewrapTenantKeys(ctx context.Context, from, to keyProvider, dryRun bool) (int, error) {
+	active := to.ActiveKeyID()
+	var rows []TenantKey
+	if err := db.WithContext(ctx).Find(&rows).Error; err != nil {
+		return 0, fmt.Errorf("failed to list tenant keys: %w", err)
+	}
+
+	rewrapped := 0
+	for _, row := range rows {
+		if from == to {
+			if active == "" || (row.KeyID == active && keyWrapAlgorithm(row.WrapAlgorithm) == shareAlgorithm) {
+				continue
+			}
+		} else if key, err := to.UnwrapKey(ctx, row.KeyID, row.WrapAlgorithm, row.WrappedKey); err == nil {
+			clear(key)
+			continue
+		}
+		key, err := from.UnwrapKey(ctx, row.KeyID, row.WrapAlgorithm, row.WrappedKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to unwrap key of tenant %s: %w", row.ID, err)
+		}
+		keyId, wrapAlgorithm, wrapped, err := to.WrapKey(ctx, key)
+		clear(key)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to wrap key of tenant %s: %w", row.ID, err)
+		}
+		if dryRun {
+			rewrapped++
+			continue
+		}
+		result := db.WithContext(ctx).Model(&TenantKey{}).
+			Where("id = ? AND key_id = ?", row.ID, row.KeyID).
+			Updates(map[string]any{"key_id": keyId, "wrap_algorithm": wrapAlgorithm, "wrapped_key": wrapped})
+		if result.Error != nil {
+			return rewrapped, fmt.Errorf("failed to update key of tenant %s: %w", row.ID, result.Error)
+		}
+		rewrapped += int(result.RowsAffected)
+	}
+	return rewrapped, nil
+}
+
+// runShredTenant implements `sample shred-tenant`: it permanently deletes a
+// tenant's key, making every share sealed for that tenant unrecoverable. The
+// row stays as a tombstone so no new key is ever created for the tenant.
+func runShredTenant(args []string) int {
+	fs := flag.NewFlagSet("shred-tenant", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "tenant whose key is destroyed (required)")
+	confirm := fs.Bool("yes", false, "confirm that the tenant's shares become permanently unrecoverable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *tenant == "" || !*confirm {
+		fs.Usage()
+		return 2
+	}
+	if err := initDB(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to initialize DB: %v", err))
+		return 1
+	}
+
+	result := db.Model(&TenantKey{}).Where("id = ?", *tenant).
+		Updates(map[string]any{"key_id": "", "wrap_algorithm": "", "wrapped_key": nil, "deleted_at": time.Now()})
+	if result.Error != nil {
+		slog.Error(fmt.Sprintf("Failed to delete tenant key: %v", result.Error))
+		return 1
+	}
+	if result.RowsAffected == 0 {
+		slog.Error("tenant has no key", slog.String("tenant", *tenant))
+		return 1
+	}
+	slog.Info("tenant key destroyed; running replicas drop it within SHARE_TENANT_KEY_CACHE_TTL", slog.String("tenant", *tenant))
+	return 0
+}
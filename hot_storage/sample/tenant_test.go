@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTenantKeys starts from an empty tenant key cache holding keys for ttl,
+// restoring the previous one when the test ends.
+func useTenantKeys(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	prev := tenantKeys
+	t.Cleanup(func() { tenantKeys = prev })
+	tenantKeys = &tenantKeyStore{ttl: ttl, keys: make(map[string]cachedTenantKey), loading: make(map[string]chan struct{})}
+}
+
+func TestResolveTenant(t *testing.T) {
+	prev := tenantSource
+	t.Cleanup(func() { tenantSource = prev })
+	identity := &authIdentity{UserID: "alice", AuthProvider: authProviderGoogle, Claims: jwt.MapClaims{"org": "acme", "team": 7}}
+
+	tests := []struct {
+		source string
+		want   string
+		ok     bool
+	}{
+		{"", "", true},
+		{tenantSourceAuthProvider, authProviderGoogle, true},
+		{tenantSourceClaimPrefix + "org", "acme", true},
+		{tenantSourceClaimPrefix + "team", "", false},
+		{tenantSourceClaimPrefix + "missing", "", false},
+	}
+	for _, test := range tests {
+		tenantSource = test.source
+		tenant, err := resolveTenant(identity)
+		if tenant != test.want || (err == nil) != test.ok {
+			t.Errorf("SHARE_TENANT_SOURCE=%q: %q, %v", test.source, tenant, err)
+		}
+	}
+}
+
+func TestCipherForTenantMismatch(t *testing.T) {
+	useShareKeys(t, newTestKeyRing(t))
+	ctx := context.WithValue(context.Background(), fieldTenant, "acme")
+
+	if _, err := cipherFor(ctx, shareBinding{DeviceID: "device-1", Tenant: "globex"}); !errors.Is(err, ErrTenantMismatch) {
+		t.Errorf("share of another tenant: err = %v, want ErrTenantMismatch", err)
+	}
+	c, err := cipherFor(ctx, shareBinding{DeviceID: "device-1", Tenant: "acme"})
+	if err != nil || c.provider.ActiveKeyID() != tenantKeyIdPrefix+"acme" {
+		t.Errorf("share of the caller's tenant: provider %v, err %v", c.provider, err)
+	}
+	// Shares from before tenant keys stay under the configured provider.
+	if c, err := cipherFor(ctx, shareBinding{DeviceID: "device-1"}); err != nil || c.provider != shareKeyProvider {
+		t.Errorf("share without a tenant: provider %v, err %v", c.provider, err)
+	}
+
+	// A data key wrapped by another tenant's key is refused before any lookup.
+	if _, err := (tenantKeyProvider{tenant: "acme"}).UnwrapKey(ctx, tenantKeyIdPrefix+"globex", algorithmAESGCM, nil); !errors.Is(err, ErrTenantMismatch) {
+		t.Errorf("UnwrapKey of another tenant's key: err = %v, want ErrTenantMismatch", err)
+	}
+}
+
+func TestShreddedTenant(t *testing.T) {
+	newTestDB(t)
+	useShareKeys(t, newTestKeyRing(t))
+	useTenantKeys(t, 0)
+	ctx := context.WithValue(context.Background(), fieldTenant, "acme")
+	binding := shareBinding{DeviceID: "device-1", SignerID: "signer-1", Tenant: "acme"}
+
+	encoded, err := encryptShare(ctx, []byte("share"), binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decryptShare(ctx, encoded, binding)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	plaintext.Wipe()
+
+	// shred-tenant leaves a tombstone in place of the key.
+	if err := db.Model(&TenantKey{}).Where("id = ?", "acme").
+		Updates(map[string]any{"key_id": "", "wrap_algorithm": "", "wrapped_key": nil, "deleted_at": time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptShare(ctx, encoded, binding); !errors.Is(err, ErrTenantKeyDestroyed) {
+		t.Errorf("decrypt after shredding: err = %v, want ErrTenantKeyDestroyed", err)
+	}
+	if _, err := encryptShare(ctx, []byte("share"), binding); !errors.Is(err, ErrTenantKeyDestroyed) {
+		t.Errorf("encrypt after shredding: err = %v, want ErrTenantKeyDestroyed", err)
+	}
+	if n := countRows(t, &TenantKey{}, "id = ? AND wrapped_key IS NOT NULL", "acme"); n != 0 {
+		t.Error("a new key was created for the shredded tenant")
+	}
+
+	// Other tenants are not affected.
+	other := shareBinding{DeviceID: "device-2", SignerID: "signer-2", Tenant: "globex"}
+	if _, err := encryptShare(context.Background(), []byte("share"), other); err != nil {
+		t.Errorf("encrypt for another tenant: %v", err)
+	}
+}
+
+func TestTenantKeyCache(t *testing.T) {
+	newTestDB(t)
+	useShareKeys(t, newTestKeyRing(t))
+	useTenantKeys(t, time.Hour)
+	ctx := context.Background()
+
+	key, err := tenantKeys.get(ctx, "acme", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear(key)
+	if _, err := tenantKeys.get(ctx, "globex", false); !errors.Is(err, ErrTenantKeyDestroyed) {
+		t.Errorf("missing key without create: err = %v, want ErrTenantKeyDestroyed", err)
+	}
+
+	// Until the cache entry expires, a replica keeps the key it loaded.
+	if err := db.Unscoped().Where("id = ?", "acme").Delete(&TenantKey{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	cached, err := tenantKeys.get(ctx, "acme", false)
+	if err != nil || string(cached) != string(key) {
+		t.Errorf("cached key: err = %v", err)
+	}
+	clear(cached)
+}
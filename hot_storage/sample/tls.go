@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	tlsClientAuthOptional = "optional"
+	tlsClientAuthRequire  = "require"
+)
+
+// serverTLS is the TLS configuration of the API listener, set by initTLS, or
+// nil to serve plain HTTP.
+var serverTLS *tls.Config
+
+// initTLS reads the TLS settings of the API listener:
+//
+//	TLS_CERT_FILE       PEM certificate chain; TLS is enabled when it is set
+//	TLS_KEY_FILE        PEM private key of the certificate
+//	TLS_CLIENT_CA_FILE  PEM bundle of the CAs client certificates must chain to
+//	TLS_CLIENT_AUTH     "optional" (default) to verify a client certificate when one is sent,
+//	                    "require" to refuse connections without one
+//
+// The certificate and key are read again when either file changes, so they
+// can be rotated without a restart.
+func initTLS() error {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	clientAuth := os.Getenv("TLS_CLIENT_AUTH")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" || clientAuth != "" {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE and TLS_CLIENT_AUTH need TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("set both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.load(); err != nil {
+		return err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE holds no PEM certificates")
+		}
+		switch clientAuth {
+		case "", tlsClientAuthOptional:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		case tlsClientAuthRequire:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return fmt.Errorf("TLS_CLIENT_AUTH must be %q or %q", tlsClientAuthOptional, tlsClientAuthRequire)
+		}
+	} else if clientAuth != "" {
+		return fmt.Errorf("TLS_CLIENT_AUTH needs TLS_CLIENT_CA_FILE")
+	}
+	serverTLS = config
+	return nil
+}
+
+// certReloader serves the certificate in certFile and keyFile, checking at
+// most once a minute whether they changed.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= time.Minute {
+		c.lastCheck = time.Now()
+		if modTime, err := c.latestModTime(); err == nil && modTime.After(c.modTime) {
+			if err := c.loadLocked(); err != nil {
+				slog.Warn("failed to reload TLS certificate, keeping the previous one", slog.String("error", err.Error()))
+			} else {
+				slog.Info("reloaded TLS certificate")
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCheck = time.Now()
+	return c.loadLocked()
+}
+
+// loadLocked reads the key pair. Callers hold mu.
+func (c *certReloader) loadLocked() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenCache remembers tokens validated by a remote call for ttl, so a busy
+// client does not cost one upstream request per API call. Entries are keyed
+// by the SHA-256 of the token; the token itself is never kept. When full, the
+// least recently used entry is evicted.
+type tokenCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[[sha256.Size]byte]*list.Element
+	// lru holds the *cachedToken entries, most recently used first.
+	lru *list.List
+}
+
+type cachedToken struct {
+	key     [sha256.Size]byte
+	userId  string
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+func newTokenCache(ttl time.Duration, maxEntries int) *tokenCache {
+	return &tokenCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[[sha256.Size]byte]*list.Element), lru: list.New()}
+}
+
+func (c *tokenCache) get(token string) (string, jwt.MapClaims, bool) {
+	if c.ttl <= 0 {
+		return "", nil, false
+	}
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	entry := elem.Value.(*cachedToken)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return "", nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.userId, entry.claims, true
+}
+
+// put caches a validated token until ttl elapses or notAfter, whichever comes
+// first. A zero notAfter is ignored.
+func (c *tokenCache) put(token, userId string, claims jwt.MapClaims, notAfter time.Time) {
+	if c.ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+	key := sha256.Sum256([]byte(token))
+	entry := &cachedToken{key: key, userId: userId, claims: claims, expires: expires}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedToken).key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTokenCache(time.Hour, 3)
+	for i := range 3 {
+		c.put(fmt.Sprintf("token-%d", i), fmt.Sprintf("user-%d", i), nil, time.Time{})
+	}
+	// token-0 is used again, so token-1 is now the least recently used.
+	if _, _, ok := c.get("token-0"); !ok {
+		t.Fatal("token-0 is not cached")
+	}
+	c.put("token-3", "user-3", nil, time.Time{})
+
+	if _, _, ok := c.get("token-1"); ok {
+		t.Error("token-1 was kept although it was the least recently used")
+	}
+	for _, token := range []string{"token-0", "token-2", "token-3"} {
+		if _, _, ok := c.get(token); !ok {
+			t.Errorf("%s was evicted", token)
+		}
+	}
+	if got := c.lru.Len(); got != 3 {
+		t.Errorf("cache holds %d entries, want 3", got)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	c := newTokenCache(time.Hour, 10)
+	c.put("expired", "user-1", nil, time.Now().Add(-time.Second))
+	if _, _, ok := c.get("expired"); ok {
+		t.Error("entry past its notAfter was returned")
+	}
+	if got := c.lru.Len(); got != 0 {
+		t.Errorf("expired entry was not removed, cache holds %d entries", got)
+	}
+
+	c.put("token", "user-1", nil, time.Time{})
+	c.put("token", "user-2", nil, time.Time{})
+	if userId, _, _ := c.get("token"); userId != "user-2" || c.lru.Len() != 1 {
+		t.Errorf("put did not replace the entry: user %q, %d entries", userId, c.lru.Len())
+	}
+}
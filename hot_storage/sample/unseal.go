@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const unsealModeShamir = "shamir"
+
+// unsealer reconstructs the share encryption key from custodian shares. Until
+// threshold valid shares are submitted the service is sealed: /health reports
+// "sealed" and every API request is refused.
+type unsealer struct {
+	mu        sync.Mutex
+	threshold int
+	version   string
+	shares    [][]byte
+	sealed    atomic.Bool
+	onUnseal  func()
+}
+
+type unsealRequest struct {
+	Share string `json:"share"`
+	Reset bool   `json:"reset"`
+}
+
+type unsealResponse struct {
+	Sealed    bool   `json:"sealed"`
+	Progress  int    `json:"progress"`
+	Threshold int    `json:"threshold"`
+	Error     string `json:"error,omitempty"`
+}
+
+// keyUnsealer is set when SHARE_KEY_UNSEAL=shamir; nil otherwise.
+var keyUnsealer *unsealer
+
+func isSealed() bool {
+	return keyUnsealer != nil && keyUnsealer.sealed.Load()
+}
+
+// initUnseal configures the Shamir boot mode from SHARE_KEY_UNSEAL,
+// SHARE_KEY_UNSEAL_THRESHOLD and SHARE_KEY_UNSEAL_VERSION (the key ring
+// version the reconstructed key is registered as, default "0"). The key must
+// not also be present in the environment.
+func initUnseal() error {
+	mode := os.Getenv("SHARE_KEY_UNSEAL")
+	if mode == "" {
+		return nil
+	}
+	if mode != unsealModeShamir {
+		return fmt.Errorf("unsupported SHARE_KEY_UNSEAL %q", mode)
+	}
+	if os.Getenv("SHARE_ENCRYPTION_KEY") != "" || os.Getenv("SHARE_ENCRYPTION_KEYS") != "" {
+		return fmt.Errorf("SHARE_ENCRYPTION_KEY(S) must not be set when SHARE_KEY_UNSEAL=shamir")
+	}
+	if p := os.Getenv("SHARE_KEY_PROVIDER"); p != "" && p != keyProviderEnv {
+		return fmt.Errorf("SHARE_KEY_UNSEAL=shamir only supports SHARE_KEY_PROVIDER=env")
+	}
+	threshold, err := envInt("SHARE_KEY_UNSEAL_THRESHOLD", 0)
+	if err != nil {
+		return err
+	}
+	if threshold < 2 || threshold > 255 {
+		return fmt.Errorf("SHARE_KEY_UNSEAL_THRESHOLD must be between 2 and 255")
+	}
+	version := os.Getenv("SHARE_KEY_UNSEAL_VERSION")
+	if version == "" {
+		version = legacyKeyVersion
+	}
+	if !keyVersionPattern.MatchString(version) {
+		return fmt.Errorf("SHARE_KEY_UNSEAL_VERSION must match [A-Za-z0-9_-]+")
+	}
+
+	keyUnsealer = &unsealer{threshold: threshold, version: version}
+	keyUnsealer.sealed.Store(true)
+	return nil
+}
+
+// start accepts shares on the local unseal endpoint (UNSEAL_ADDR, default
+// 127.0.0.1:8201) and, when SHARE_KEY_UNSEAL_PROMPT=true, from stdin.
+// onUnseal runs once the key has been reconstructed and verified.
+func (u *unsealer) start(onUnseal func()) {
+	u.onUnseal = onUnseal
+
+	addr := os.Getenv("UNSEAL_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8201"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/unseal", u.handleUnseal)
+	go func() {
+		slog.Info(fmt.Sprintf("Sealed: submit %d key shares to http://%s/v1/unseal", u.threshold, addr))
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error(fmt.Sprintf("unseal listener failed: %v", err))
+		}
+	}()
+
+	if os.Getenv("SHARE_KEY_UNSEAL_PROMPT") == "true" {
+		go u.prompt(os.Stdin)
+	}
+}
+
+func (u *unsealer) prompt(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for u.sealed.Load() {
+		fmt.Printf("Key share (%d/%d): ", u.progress(), u.threshold)
+		if !scanner.Scan() {
+			return
+		}
+		if _, err := u.submit(context.Background(), strings.TrimSpace(scanner.Text())); err != nil {
+			fmt.Printf("Rejected: %v\n", err)
+		}
+	}
+}
+
+func (u *unsealer) handleUnseal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req unsealRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Reset {
+			// Anyone who reaches the endpoint may submit a share, but
+			// discarding the custodians' shares takes the admin token.
+			if !hasAdminToken(r) {
+				unauthorized(w)
+				return
+			}
+			u.reset()
+		} else if _, err := u.submit(r.Context(), req.Share); err != nil {
+			w.Header().Set(contentTypeHeader, contentTypeJSON)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(unsealResponse{Sealed: isSealed(), Progress: u.progress(), Threshold: u.threshold, Error: err.Error()})
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	json.NewEncoder(w).Encode(unsealResponse{Sealed: isSealed(), Progress: u.progress(), Threshold: u.threshold})
+}
+
+func (u *unsealer) progress() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.shares)
+}
+
+func (u *unsealer) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, share := range u.shares {
+		clear(share)
+	}
+	u.shares = nil
+}
+
+// submit records one hex-encoded share. Once threshold shares are in, it
+// reconstructs the key and checks it against the stored key check; a key that
+// fails the check discards every submitted share.
+func (u *unsealer) submit(ctx context.Context, shareHex string) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.sealed.Load() {
+		return 0, errors.New("already unsealed")
+	}
+	share, err := hex.DecodeString(shareHex)
+	if err != nil || len(share) != 33 {
+		return len(u.shares), fmt.Errorf("%w: expected 66 hex characters", errInvalidShares)
+	}
+	for _, existing := range u.shares {
+		if existing[32] == share[32] {
+			clear(share)
+			return len(u.shares), fmt.Errorf("%w: share %d was already submitted", errInvalidShares, share[32])
+		}
+	}
+	u.shares = append(u.shares, share)
+	if len(u.shares) < u.threshold {
+		return len(u.shares), nil
+	}
+
+	key, err := shamirCombine(u.shares)
+	for _, s := range u.shares {
+		clear(s)
+	}
+	u.shares = nil
+	if err != nil {
+		return 0, err
+	}
+
+	shareKeys = &keyRing{active: u.version, keys: map[string]secret{u.version: newSecret(key)}}
+	shareKeyProvider = shareKeys
+	if err := verifyKeyCheck(ctx); err != nil {
+		shareKeys.wipe()
+		shareKeys, shareKeyProvider = nil, nil
+		slog.Error(fmt.Sprintf("unseal failed, submitted shares discarded: %v", err))
+		return 0, errors.New("reconstructed key failed the key check; submitted shares were discarded")
+	}
+
+	u.sealed.Store(false)
+	slog.Info("unsealed", slog.String("keyVersion", u.version))
+	if u.onUnseal != nil {
+		go u.onUnseal()
+	}
+	return u.threshold, nil
+}
+
+// runSplitKey implements `sample split-key`: it splits a share encryption key
+// read from stdin as hex, or a freshly generated one, into custodian shares.
+func runSplitKey(args []string) int {
+	fs := flag.NewFlagSet("split-key", flag.ContinueOnError)
+	n := fs.Int("shares", 5, "number of custodian shares to produce")
+	threshold := fs.Int("threshold", 3, "number of shares required to unseal")
+	generate := fs.Bool("generate", false, "generate a new random key instead of reading one from stdin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var key []byte
+	if *generate {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			slog.Error(fmt.Sprintf("Failed to generate key: %v", err))
+			return 1
+		}
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			slog.Error(fmt.Sprintf("Failed to read key: %v", err))
+			return 1
+		}
+		key, err = parseKeyHex("key", strings.TrimSpace(line))
+		if err != nil {
+			slog.Error(err.Error())
+			return 1
+		}
+	}
+	defer clear(key)
+
+	shares, err := shamirSplit(key, *n, *threshold)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	for _, share := range shares {
+		fmt.Println(hex.EncodeToString(share))
+		clear(share)
+	}
+	return 0
+}
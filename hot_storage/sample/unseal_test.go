@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnsealResetRequiresAdminToken(t *testing.T) {
+	prev := adminToken
+	t.Cleanup(func() { adminToken = prev })
+	adminToken = strings.Repeat("a", 32)
+
+	u := &unsealer{threshold: 3}
+	u.sealed.Store(true)
+	share := make([]byte, 33)
+	share[32] = 1
+	if _, err := u.submit(context.Background(), hex.EncodeToString(share)); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/unseal", strings.NewReader(`{"reset":true}`))
+		if token != "" {
+			r.Header.Set(headerAuth, headerAuthPrefix+token)
+		}
+		w := httptest.NewRecorder()
+		u.handleUnseal(w, r)
+		return w.Code
+	}
+	for _, token := range []string{"", "wrong"} {
+		if code := reset(token); code != http.StatusUnauthorized {
+			t.Errorf("reset with token %q: status %d, want 401", token, code)
+		}
+	}
+	if u.progress() != 1 {
+		t.Fatalf("progress %d after refused resets, want 1", u.progress())
+	}
+	if code := reset(adminToken); code != http.StatusOK {
+		t.Fatalf("reset with admin token: status %d", code)
+	}
+	if u.progress() != 0 {
+		t.Errorf("progress %d after reset, want 0", u.progress())
+	}
+
+	adminToken = ""
+	u.submit(context.Background(), hex.EncodeToString(share))
+	if code := reset(""); code != http.StatusUnauthorized {
+		t.Errorf("reset without a configured admin token: status %d, want 401", code)
+	}
+}